@@ -0,0 +1,420 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+// data-channels-bench compares the reliability modes of data channels. Both
+// peers run in this process, over the loopback or a virtual network with
+// loss, delay and jitter, so the one-way latency is measured with one clock.
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pion/logging"
+	"github.com/pion/transport/v3/vnet"
+	"github.com/pion/webrtc/v4"
+)
+
+// headerSize is the sequence number and the send time at the start of
+// every message.
+const headerSize = 16
+
+// flow control of the sender: sending waits once maxBufferedAmount bytes
+// are queued, until the queue drains below bufferedAmountLowThreshold
+const (
+	bufferedAmountLowThreshold = 512 << 10
+	maxBufferedAmount          = 1 << 20
+)
+
+// negotiatedID is the id of the pre-negotiated data channel, out of the
+// range of the ids pion picks for the others.
+const negotiatedID = 1000
+
+// mode is a reliability mode of a data channel, its label is the name.
+type mode struct {
+	name string
+	init webrtc.DataChannelInit
+}
+
+// result is the outcome of one mode.
+type result struct {
+	Mode              string  `json:"mode"`
+	Ordered           bool    `json:"ordered"`
+	MaxRetransmits    *uint16 `json:"max_retransmits,omitempty"`
+	MaxPacketLifeTime *uint16 `json:"max_packet_lifetime_ms,omitempty"`
+	Negotiated        bool    `json:"negotiated"`
+	Sent              int     `json:"sent"`
+	Received          int     `json:"received"`
+	Lost              int     `json:"lost"`
+	LossPercent       float64 `json:"loss_percent"`
+	Reordered         int     `json:"reordered"`
+	ThroughputMbps    float64 `json:"throughput_mbps"`
+	LatencyP50Ms      float64 `json:"latency_p50_ms"`
+	LatencyP90Ms      float64 `json:"latency_p90_ms"`
+	LatencyP99Ms      float64 `json:"latency_p99_ms"`
+	LatencyMaxMs      float64 `json:"latency_max_ms"`
+}
+
+// receiver counts the messages of one mode.
+type receiver struct {
+	mu        sync.Mutex
+	received  int
+	bytes     int
+	reordered int
+	maxSeq    uint64
+	latencies []time.Duration
+	last      time.Time
+}
+
+func (r *receiver) onMessage(msg webrtc.DataChannelMessage) {
+	now := time.Now()
+	if len(msg.Data) < headerSize {
+		return
+	}
+	seq := binary.BigEndian.Uint64(msg.Data)
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(msg.Data[8:]))) //nolint:gosec
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received++
+	r.bytes += len(msg.Data)
+	if seq < r.maxSeq {
+		r.reordered++
+	} else {
+		r.maxSeq = seq
+	}
+	r.latencies = append(r.latencies, now.Sub(sent))
+	r.last = now
+}
+
+func main() { //nolint:gocognit,cyclop
+	modeNames := flag.String("modes", "reliable,unordered,retransmits,unordered-retransmits,lifetime,unordered-lifetime,negotiated",
+		"Reliability modes to compare, comma separated.")
+	size := flag.Int("size", 1024, "Size of the messages in bytes, at least 16.")
+	rate := flag.Int("rate", 0, "Messages sent per second, 0 for as fast as the flow control allows.")
+	duration := flag.Duration("duration", 5*time.Second, "How long to send in each mode.")
+	drain := flag.Duration("drain", 2*time.Second, "How long to wait for late messages after sending.")
+	maxRetransmits := flag.Int("max-retransmits", 0, "MaxRetransmits of the retransmits modes.")
+	maxPacketLifeTime := flag.Duration("max-packet-lifetime", 100*time.Millisecond, "MaxPacketLifeTime of the lifetime modes.")
+	loss := flag.Float64("loss", 0, "Fraction of the packets dropped, runs over a virtual network if set.")
+	delay := flag.Duration("delay", 0, "One-way delay of the packets, runs over a virtual network if set.")
+	jitter := flag.Duration("jitter", 0, "Maximum jitter added to the delay, runs over a virtual network if set.")
+	asJSON := flag.Bool("json", false, "Print the results as JSON instead of a table.")
+	flag.Parse()
+
+	if *size < headerSize {
+		panic(fmt.Sprintf("-size must be at least %d", headerSize))
+	}
+	if *maxRetransmits < 0 || *maxRetransmits > 65535 {
+		panic("-max-retransmits must be between 0 and 65535")
+	}
+	if *maxPacketLifeTime < 0 || *maxPacketLifeTime > 65535*time.Millisecond {
+		panic("-max-packet-lifetime must be between 0 and 65535ms")
+	}
+
+	modes, err := parseModes(*modeNames, uint16(*maxRetransmits), uint16(maxPacketLifeTime.Milliseconds())) //nolint:gosec
+	if err != nil {
+		panic(err)
+	}
+
+	offerAPI, answerAPI := webrtc.NewAPI(), webrtc.NewAPI()
+	if *loss > 0 || *delay > 0 || *jitter > 0 {
+		var router *vnet.Router
+		offerAPI, answerAPI, router = virtualNetwork(*loss, *delay, *jitter)
+		defer func() {
+			if err := router.Stop(); err != nil {
+				fmt.Printf("cannot stop virtual network: %v\n", err)
+			}
+		}()
+	}
+
+	offerPC, err := offerAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		panic(err)
+	}
+	defer closePeerConnection(offerPC)
+	answerPC, err := answerAPI.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		panic(err)
+	}
+	defer closePeerConnection(answerPC)
+
+	// The receivers, by label. Pre-negotiated data channels are created on
+	// both sides, the others are announced to the answer side.
+	receivers := make(map[string]*receiver)
+	for _, m := range modes {
+		receivers[m.name] = &receiver{}
+	}
+	answerPC.OnDataChannel(func(d *webrtc.DataChannel) {
+		if r, ok := receivers[d.Label()]; ok {
+			d.OnMessage(r.onMessage)
+		}
+	})
+
+	var opened sync.WaitGroup
+	channels := make([]*webrtc.DataChannel, len(modes))
+	for i, m := range modes {
+		init := m.init
+		d, err := offerPC.CreateDataChannel(m.name, &init)
+		if err != nil {
+			panic(err)
+		}
+		opened.Add(1)
+		d.OnOpen(opened.Done)
+		channels[i] = d
+
+		if init.Negotiated != nil && *init.Negotiated {
+			answerInit := m.init
+			remote, err := answerPC.CreateDataChannel(m.name, &answerInit)
+			if err != nil {
+				panic(err)
+			}
+			remote.OnMessage(receivers[m.name].onMessage)
+		}
+	}
+
+	connect(offerPC, answerPC)
+	opened.Wait()
+
+	results := make([]result, 0, len(modes))
+	for i, m := range modes {
+		if !*asJSON {
+			fmt.Fprintf(os.Stderr, "Running %s for %s\n", m.name, *duration)
+		}
+		sent, start := send(channels[i], *size, *rate, *duration)
+		waitDrained(channels[i], *drain)
+		results = append(results, summarize(m, receivers[m.name], sent, start))
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			panic(err)
+		}
+
+		return
+	}
+	printTable(results)
+}
+
+// parseModes returns the modes named in names.
+func parseModes(names string, maxRetransmits, maxPacketLifeTime uint16) ([]mode, error) {
+	ordered, unordered, negotiated := true, false, true
+	id := uint16(negotiatedID)
+	all := map[string]webrtc.DataChannelInit{
+		"reliable":              {Ordered: &ordered},
+		"unordered":             {Ordered: &unordered},
+		"retransmits":           {Ordered: &ordered, MaxRetransmits: &maxRetransmits},
+		"unordered-retransmits": {Ordered: &unordered, MaxRetransmits: &maxRetransmits},
+		"lifetime":              {Ordered: &ordered, MaxPacketLifeTime: &maxPacketLifeTime},
+		"unordered-lifetime":    {Ordered: &unordered, MaxPacketLifeTime: &maxPacketLifeTime},
+		"negotiated":            {Ordered: &ordered, Negotiated: &negotiated, ID: &id},
+	}
+
+	var modes []mode
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		init, ok := all[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown mode %q", name) //nolint:err113
+		}
+		modes = append(modes, mode{name: name, init: init})
+	}
+
+	return modes, nil
+}
+
+// virtualNetwork returns APIs whose PeerConnections talk over a virtual
+// network dropping loss of the packets and delaying them.
+func virtualNetwork(loss float64, delay, jitter time.Duration) (*webrtc.API, *webrtc.API, *vnet.Router) {
+	router, err := vnet.NewRouter(&vnet.RouterConfig{
+		CIDR:          "1.2.3.0/24",
+		MinDelay:      delay,
+		MaxJitter:     jitter,
+		LoggerFactory: logging.NewDefaultLoggerFactory(),
+	})
+	if err != nil {
+		panic(err)
+	}
+	router.AddChunkFilter(func(vnet.Chunk) bool {
+		return rand.Float64() >= loss //nolint:gosec
+	})
+
+	newAPI := func(ip string) *webrtc.API {
+		nw, err := vnet.NewNet(&vnet.NetConfig{StaticIPs: []string{ip}})
+		if err != nil {
+			panic(err)
+		}
+		if err = router.AddNet(nw); err != nil {
+			panic(err)
+		}
+
+		settingEngine := webrtc.SettingEngine{}
+		settingEngine.SetNet(nw)
+
+		return webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
+	}
+	offerAPI, answerAPI := newAPI("1.2.3.4"), newAPI("1.2.3.5")
+
+	if err := router.Start(); err != nil {
+		panic(err)
+	}
+
+	return offerAPI, answerAPI, router
+}
+
+// connect exchanges the offer and the answer, with all the candidates, as
+// both sides are in this process.
+func connect(offerPC, answerPC *webrtc.PeerConnection) {
+	offer, err := offerPC.CreateOffer(nil)
+	if err != nil {
+		panic(err)
+	}
+	offerGathered := webrtc.GatheringCompletePromise(offerPC)
+	if err = offerPC.SetLocalDescription(offer); err != nil {
+		panic(err)
+	}
+	<-offerGathered
+	if err = answerPC.SetRemoteDescription(*offerPC.LocalDescription()); err != nil {
+		panic(err)
+	}
+
+	answer, err := answerPC.CreateAnswer(nil)
+	if err != nil {
+		panic(err)
+	}
+	answerGathered := webrtc.GatheringCompletePromise(answerPC)
+	if err = answerPC.SetLocalDescription(answer); err != nil {
+		panic(err)
+	}
+	<-answerGathered
+	if err = offerPC.SetRemoteDescription(*answerPC.LocalDescription()); err != nil {
+		panic(err)
+	}
+}
+
+// send sends messages of size over d, at rate per second or as fast as the
+// flow control allows, for duration. It returns how many were sent and
+// when sending started.
+func send(d *webrtc.DataChannel, size, rate int, duration time.Duration) (int, time.Time) {
+	more := make(chan struct{}, 1)
+	d.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+	d.OnBufferedAmountLow(func() {
+		select {
+		case more <- struct{}{}:
+		default:
+		}
+	})
+
+	var interval time.Duration
+	if rate > 0 {
+		interval = time.Second / time.Duration(rate)
+	}
+
+	buf := make([]byte, size)
+	start := time.Now()
+	sent := 0
+	for time.Since(start) < duration {
+		if interval > 0 {
+			time.Sleep(time.Until(start.Add(time.Duration(sent) * interval)))
+		}
+		for d.BufferedAmount() > maxBufferedAmount {
+			<-more
+		}
+
+		binary.BigEndian.PutUint64(buf, uint64(sent))                      //nolint:gosec
+		binary.BigEndian.PutUint64(buf[8:], uint64(time.Now().UnixNano())) //nolint:gosec
+		if err := d.Send(buf); err != nil {
+			panic(err)
+		}
+		sent++
+	}
+
+	return sent, start
+}
+
+// waitDrained waits drain for d to send everything queued and the last
+// messages to arrive.
+func waitDrained(d *webrtc.DataChannel, drain time.Duration) {
+	deadline := time.Now().Add(drain)
+	for d.BufferedAmount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(time.Until(deadline))
+}
+
+func summarize(m mode, r *receiver, sent int, start time.Time) result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res := result{
+		Mode:              m.name,
+		Ordered:           *m.init.Ordered,
+		MaxRetransmits:    m.init.MaxRetransmits,
+		MaxPacketLifeTime: m.init.MaxPacketLifeTime,
+		Negotiated:        m.init.Negotiated != nil && *m.init.Negotiated,
+		Sent:              sent,
+		Received:          r.received,
+		Lost:              sent - r.received,
+		Reordered:         r.reordered,
+	}
+	if sent > 0 {
+		res.LossPercent = float64(res.Lost) * 100 / float64(sent)
+	}
+	if elapsed := r.last.Sub(start); r.received > 0 && elapsed > 0 {
+		res.ThroughputMbps = float64(r.bytes) * 8 / elapsed.Seconds() / 1e6
+	}
+
+	sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+	res.LatencyP50Ms = percentile(r.latencies, 0.50)
+	res.LatencyP90Ms = percentile(r.latencies, 0.90)
+	res.LatencyP99Ms = percentile(r.latencies, 0.99)
+	res.LatencyMaxMs = percentile(r.latencies, 1)
+
+	return res
+}
+
+// percentile returns the p percentile of the sorted latencies, in
+// milliseconds.
+func percentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+
+	return float64(sorted[i].Microseconds()) / 1000
+}
+
+func printTable(results []result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "mode\tsent\treceived\tlost\tloss %\treordered\tMbit/s\tp50 ms\tp90 ms\tp99 ms\tmax ms\t")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.2f\t%d\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t\n",
+			r.Mode, r.Sent, r.Received, r.Lost, r.LossPercent, r.Reordered,
+			r.ThroughputMbps, r.LatencyP50Ms, r.LatencyP90Ms, r.LatencyP99Ms, r.LatencyMaxMs)
+	}
+	if err := w.Flush(); err != nil {
+		panic(err)
+	}
+}
+
+func closePeerConnection(pc *webrtc.PeerConnection) {
+	if cErr := pc.Close(); cErr != nil {
+		fmt.Printf("cannot close peerConnection: %v\n", cErr)
+	}
+}
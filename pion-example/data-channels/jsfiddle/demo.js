@@ -38,6 +38,46 @@ window.sendMessage = () => {
   sendChannel.send(message)
 }
 
+// Files are sent over a 'file' DataChannel: a manifest first, then binary
+// chunks from the offset the Go side resumes from, sending no more while
+// over 1 MiB is buffered
+const chunkSize = 16 * 1024
+const maxBufferedAmount = 1024 * 1024
+
+window.sendFile = async () => {
+  const file = document.getElementById('file').files[0]
+  if (file === undefined) {
+    return alert('File must be picked')
+  }
+
+  const digest = await crypto.subtle.digest('SHA-256', await file.arrayBuffer())
+  const sha256 = Array.from(new Uint8Array(digest), b => b.toString(16).padStart(2, '0')).join('')
+
+  const fileChannel = pc.createDataChannel('file')
+  fileChannel.bufferedAmountLowThreshold = 256 * 1024
+  fileChannel.onclose = () => log(`DataChannel for ${file.name} has closed`)
+  fileChannel.onopen = () =>
+    fileChannel.send(JSON.stringify({ type: 'manifest', manifest: { name: file.name, size: file.size, sha256 } }))
+  fileChannel.onmessage = async e => {
+    const msg = JSON.parse(e.data)
+    if (msg.type === 'done') {
+      log(msg.error ? `Sending ${file.name} failed: ${msg.error}` : `${file.name} received and verified`)
+      return fileChannel.close()
+    }
+    if (msg.type !== 'resume') {
+      return
+    }
+
+    log(`Sending ${file.name} from byte ${msg.offset} of ${file.size}`)
+    for (let offset = msg.offset; offset < file.size; offset += chunkSize) {
+      if (fileChannel.bufferedAmount > maxBufferedAmount) {
+        await new Promise(resolve => { fileChannel.onbufferedamountlow = resolve })
+      }
+      fileChannel.send(await file.slice(offset, offset + chunkSize).arrayBuffer())
+    }
+  }
+}
+
 window.startSession = () => {
   const sd = document.getElementById('remoteSessionDescription').value
   if (sd === '') {
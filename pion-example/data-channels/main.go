@@ -9,18 +9,24 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 	"time"
 
+	"pion-webrtc-example/pion-example/filetransfer"
+
 	"github.com/pion/randutil"
 	"github.com/pion/webrtc/v4"
 )
 
 // nolint:cyclop
 func main() {
+	recvDir := flag.String("recv-dir", "", "Directory to save the files sent by the browser into, files are refused if empty.")
+	flag.Parse()
+
 	// Everything below is the Pion WebRTC API! Thanks for using it ❤️.
 
 	// Prepare the configuration
@@ -64,10 +70,42 @@ func main() {
 		}
 	})
 
+	// Files are received over the data channels labeled 'file'. Partially
+	// received files are kept in recvDir, sending the same file again
+	// resumes from where the last transfer stopped.
+	receiver := &filetransfer.Receiver{
+		Dir: *recvDir,
+		Progress: func(m filetransfer.Manifest, received int64) {
+			fmt.Printf("Received %d/%d bytes of %s (%.1f%%)\n", received, m.Size, m.Name, percent(received, m.Size))
+		},
+		Done: func(m filetransfer.Manifest, path string, err error) {
+			if err != nil {
+				fmt.Printf("Receiving %s failed: %v\n", m.Name, err)
+
+				return
+			}
+			fmt.Printf("Saved %s, sha256 %s verified\n", path, m.SHA256)
+		},
+	}
+
 	// Register data channel creation handling
 	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
 		fmt.Printf("New DataChannel %s %d\n", dataChannel.Label(), dataChannel.ID())
 
+		if dataChannel.Label() == filetransfer.Label {
+			if *recvDir == "" {
+				fmt.Println("Refusing file, run with -recv-dir to receive files")
+				if cErr := dataChannel.Close(); cErr != nil {
+					fmt.Printf("cannot close DataChannel: %v\n", cErr)
+				}
+
+				return
+			}
+			receiver.Receive(dataChannel)
+
+			return
+		}
+
 		// Register channel opening handling
 		dataChannel.OnOpen(func() {
 			fmt.Printf(
@@ -134,6 +172,14 @@ func main() {
 	select {}
 }
 
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 100
+	}
+
+	return float64(n) * 100 / float64(total)
+}
+
 // Read from stdin until we get a newline.
 func readUntilNewline() (in string) {
 	var err error
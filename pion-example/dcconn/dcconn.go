@@ -0,0 +1,293 @@
+// Package dcconn turns a detached data channel into a net.Conn, so that
+// code written for TCP runs over a PeerConnection. Detaching has to be
+// enabled with SettingEngine.DetachDataChannels, which pion only supports
+// for all the data channels of a PeerConnection at once.
+//
+// Data channels carry messages, the Conn a byte stream: writes are split
+// into messages of at most MaxMessageSize bytes, and a read returns what is
+// left of the message being read. The data channel must be ordered and
+// reliable, which is the default.
+package dcconn
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pion/datachannel"
+	"github.com/pion/webrtc/v4"
+)
+
+// MaxMessageSize is the size of the messages written. It is below the
+// message size every data channel implementation accepts.
+const MaxMessageSize = 16 << 10
+
+// readBufferSize holds the largest message the other end may send.
+const readBufferSize = 64 << 10
+
+// flow control: writing waits once maxBufferedAmount bytes are queued,
+// until the queue drains below bufferedAmountLowThreshold
+const (
+	bufferedAmountLowThreshold = 256 << 10
+	maxBufferedAmount          = 1 << 20
+)
+
+// Addr is the address of one end of a Conn: the label and id of its data
+// channel, and the ICE candidate of that end.
+type Addr struct {
+	Label string
+	ID    uint16
+	Host  string // host:port of the candidate, empty if not known
+}
+
+func (a Addr) Network() string { return "webrtc" }
+
+func (a Addr) String() string {
+	if a.Host == "" {
+		return fmt.Sprintf("%s/%d", a.Label, a.ID)
+	}
+	return fmt.Sprintf("%s/%s/%d", a.Host, a.Label, a.ID)
+}
+
+// Conn is a net.Conn over a detached data channel.
+type Conn struct {
+	d    *webrtc.DataChannel
+	rwc  datachannel.ReadWriteCloserDeadliner
+	addr Addr
+
+	rmu  sync.Mutex // serializes the reads
+	buf  []byte
+	rest []byte // unread part of buf
+
+	wmu  sync.Mutex // serializes the writes
+	more chan struct{}
+
+	mu        sync.Mutex
+	wdeadline time.Time
+	wdChanged chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// New detaches d and returns a Conn over it. It must be called from the
+// OnOpen handler of d, or later.
+func New(d *webrtc.DataChannel) (*Conn, error) {
+	rwc, err := d.DetachWithDeadline()
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		d:         d,
+		rwc:       rwc,
+		buf:       make([]byte, readBufferSize),
+		more:      make(chan struct{}, 1),
+		wdChanged: make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
+	if id := d.ID(); id != nil {
+		c.addr = Addr{Label: d.Label(), ID: *id}
+	} else {
+		c.addr = Addr{Label: d.Label()}
+	}
+	d.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+	d.OnBufferedAmountLow(func() {
+		select {
+		case c.more <- struct{}{}:
+		default:
+		}
+	})
+	return c, nil
+}
+
+// Read reads the next bytes of the stream. It returns io.EOF once the data
+// channel is closed by the other end.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.rest) == 0 {
+		n, err := c.rwc.Read(c.buf)
+		if err != nil {
+			return 0, c.mapErr("read", err)
+		}
+		c.rest = c.buf[:n]
+	}
+	n := copy(b, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+// Write writes b as messages of at most MaxMessageSize bytes, waiting while
+// too much is queued for the other end.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		if err := c.waitBuffered(); err != nil {
+			return written, err
+		}
+
+		n := len(b)
+		if n > MaxMessageSize {
+			n = MaxMessageSize
+		}
+		if _, err := c.rwc.Write(b[:n]); err != nil {
+			return written, c.mapErr("write", err)
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// waitBuffered waits until the queue of the data channel has room, the
+// write deadline passes or the Conn is closed.
+func (c *Conn) waitBuffered() error {
+	for c.d.BufferedAmount() > maxBufferedAmount {
+		c.mu.Lock()
+		deadline := c.wdeadline
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return c.opErr("write", os.ErrDeadlineExceeded)
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+
+		var err error
+		select {
+		case <-c.more:
+		case <-c.wdChanged:
+		case <-timeout:
+		case <-c.closed:
+			err = c.opErr("write", net.ErrClosed)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	select {
+	case <-c.closed:
+		return c.opErr("write", net.ErrClosed)
+	default:
+	}
+	return nil
+}
+
+// Close closes the data channel.
+func (c *Conn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.rwc.Close()
+	})
+	return err
+}
+
+func (c *Conn) LocalAddr() net.Addr { return c.endAddr(false) }
+
+func (c *Conn) RemoteAddr() net.Addr { return c.endAddr(true) }
+
+// endAddr returns the address of the local or the remote end, with the
+// candidate of the pair ICE selected last.
+func (c *Conn) endAddr(remote bool) Addr {
+	a := c.addr
+	sctp := c.d.Transport()
+	if sctp == nil || sctp.Transport() == nil || sctp.Transport().ICETransport() == nil {
+		return a
+	}
+	pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+	if err != nil || pair == nil {
+		return a
+	}
+	cand := pair.Local
+	if remote {
+		cand = pair.Remote
+	}
+	if cand != nil {
+		a.Host = net.JoinHostPort(cand.Address, strconv.Itoa(int(cand.Port)))
+	}
+	return a
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.rwc.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of the writes waiting for the queue of
+// the data channel to drain, the data channel itself never blocks writes.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdeadline = t
+	c.mu.Unlock()
+
+	select {
+	case c.wdChanged <- struct{}{}:
+	default:
+	}
+	return c.rwc.SetWriteDeadline(t)
+}
+
+// mapErr returns the errors of net.Conn for the errors of the data
+// channel.
+func (c *Conn) mapErr(op string, err error) error {
+	select {
+	case <-c.closed:
+		return c.opErr(op, net.ErrClosed)
+	default:
+	}
+	switch {
+	case errors.Is(err, io.EOF):
+		return io.EOF
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return c.opErr(op, os.ErrDeadlineExceeded)
+	}
+	return c.opErr(op, err)
+}
+
+func (c *Conn) opErr(op string, err error) error {
+	return &net.OpError{Op: op, Net: c.addr.Network(), Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+}
+
+// Pipe copies between a and b until either is done, then closes both. Data
+// channels cannot be half closed, so neither can the connections piped to
+// a Conn.
+func Pipe(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(b, a)
+		done <- struct{}{}
+	}()
+
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
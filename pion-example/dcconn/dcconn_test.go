@@ -0,0 +1,146 @@
+package dcconn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"pion-webrtc-example/pion-example/internal/dctest"
+)
+
+// newPair returns the two Conns of a data channel between two
+// PeerConnections of this process.
+func newPair(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+	var s webrtc.SettingEngine
+	s.DetachDataChannels()
+	local, remote := dctest.Pair(t, webrtc.NewAPI(webrtc.WithSettingEngine(s)), "dcconn")
+
+	a, err := New(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a, b
+}
+
+func TestReadWriteLarge(t *testing.T) {
+	a, b := newPair(t)
+	data := make([]byte, 3*MaxMessageSize+7)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	written := make(chan error, 1)
+	go func() {
+		_, err := a.Write(data)
+		written <- err
+	}()
+	got := make([]byte, len(data))
+	// reads of less than a message return its rest on the next read
+	if _, err := io.ReadFull(b, got[:100]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(b, got[100:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("read differs from written")
+	}
+}
+
+// fill writes to c, whose other end does not read, until the writes wait
+// for the queue of the data channel.
+func fill(c *Conn) (int, error) {
+	return c.Write(make([]byte, 16*maxBufferedAmount))
+}
+
+func TestWriteDeadline(t *testing.T) {
+	a, _ := newPair(t)
+	if err := a.SetWriteDeadline(time.Now().Add(500 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := fill(a)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write with the queue full = %v, want ErrDeadlineExceeded", err)
+	}
+	if n < maxBufferedAmount || n%MaxMessageSize != 0 {
+		t.Fatalf("%d bytes written before the deadline", n)
+	}
+}
+
+func TestCloseUnblocksWrite(t *testing.T) {
+	a, _ := newPair(t)
+	written := make(chan error, 1)
+	go func() {
+		_, err := fill(a)
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("Write returned %v with the queue full", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	a.Close()
+	select {
+	case err := <-written:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Write after Close = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write still blocked after Close")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	a, b := newPair(t)
+	inner, outer := net.Pipe()
+	piped := make(chan struct{})
+	go func() {
+		Pipe(a, inner)
+		close(piped)
+	}()
+
+	if _, err := outer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read %q, %v over the pipe", buf, err)
+	}
+	if _, err := b.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(outer, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("read %q, %v back over the pipe", buf, err)
+	}
+
+	// the end of either side closes both
+	b.Close()
+	select {
+	case <-piped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pipe still running once the data channel closed")
+	}
+	if _, err := outer.Read(buf); err == nil {
+		t.Fatal("other connection still open")
+	}
+}
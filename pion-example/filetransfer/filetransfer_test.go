@@ -0,0 +1,53 @@
+package filetransfer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenRejectsInvalidSHA256(t *testing.T) {
+	dir := t.TempDir()
+	valid := strings.Repeat("0123456789abcdef", 4)
+	for _, sum := range []string{
+		"",
+		"/../../../../tmp/x" + valid[18:],
+		strings.ToUpper(valid),
+		valid[:63] + "g",
+		valid + "00",
+	} {
+		rc := &receiving{m: Manifest{Name: "f.bin", Size: 1, SHA256: sum}}
+		if err := rc.open(dir); err == nil {
+			rc.f.Close()
+			t.Errorf("open accepted sha256 %q", sum)
+		}
+	}
+
+	rc := &receiving{m: Manifest{Name: "f.bin", Size: 1, SHA256: valid}}
+	if err := rc.open(dir); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	rc.f.Close()
+	if filepath.Dir(rc.part) != dir {
+		t.Errorf("part file %s outside %s", rc.part, dir)
+	}
+}
+
+func TestFreePath(t *testing.T) {
+	dir := t.TempDir()
+	path, err := freePath(dir, "f.bin")
+	if err != nil || path != filepath.Join(dir, "f.bin") {
+		t.Fatalf("freePath = %q, %v", path, err)
+	}
+
+	for _, name := range []string{"f.bin", "f-1.bin"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, err = freePath(dir, "f.bin")
+	if err != nil || path != filepath.Join(dir, "f-2.bin") {
+		t.Fatalf("freePath = %q, %v, want f-2.bin", path, err)
+	}
+}
@@ -0,0 +1,456 @@
+// Package fragment sends messages of any size over a data channel. SCTP
+// implementations limit the size of a message, 64 KiB between pion peers
+// and less for some browsers, so a message is cut into fragments of at most
+// ChunkSize bytes, sequenced, and reassembled by the other end.
+//
+// The fragments of the messages in flight are interleaved: the large ones
+// take turns, one fragment each, and a message fitting in one fragment is
+// sent before the next fragment of any large one. Fragments of large
+// messages are only queued on the data channel while it holds less than
+// maxLargeBufferedAmount bytes, so a control message waits behind a few
+// fragments at most, not behind a large transfer. A message is delivered
+// once it is complete, so a small message may overtake a large one sent
+// before it.
+//
+// Both ends must use a Channel. The data channel must be ordered and
+// reliable, which is the default.
+package fragment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Label is the label of the data channels carrying fragmented messages.
+const Label = "fragment"
+
+// ChunkSize is the size of the fragments, headers included. It is below the
+// message size every data channel implementation accepts.
+const ChunkSize = 16 << 10
+
+// DefaultMaxSize is the largest message a Channel sends and accepts, unless
+// told otherwise.
+const DefaultMaxSize = 16 << 20
+
+// limits of the reassembly: at most maxPartial messages of the other end,
+// holding at most twice the maximum message size together, the first
+// fragments of more are dropped. A message whose next fragment does not
+// come within partialTimeout is dropped.
+const (
+	maxPartial     = 64
+	partialTimeout = 30 * time.Second
+)
+
+// flow control of the sender: small messages are sent while less than
+// maxBufferedAmount bytes are queued on the data channel, fragments of
+// large messages while less than maxLargeBufferedAmount are. Sending
+// resumes once the queue drains below bufferedAmountLowThreshold.
+const (
+	bufferedAmountLowThreshold = 2 * ChunkSize
+	maxLargeBufferedAmount     = 4 * ChunkSize
+	maxBufferedAmount          = 1 << 20
+)
+
+// Every fragment starts with flags, the id of its message and its sequence
+// number, the first one also with the size of the message.
+const (
+	headerSize      = 9
+	firstHeaderSize = headerSize + 4
+)
+
+// flags of the fragments
+const (
+	flagText  = 1 << 0
+	flagAbort = 1 << 1 // the sender gave up the message, no data
+)
+
+var (
+	// ErrClosed is returned by the sends over a closed data channel.
+	ErrClosed = errors.New("fragment: data channel closed")
+	// ErrTooLarge is returned by the sends of messages over the maximum
+	// size, and reported for the messages of the other end over it.
+	ErrTooLarge = errors.New("fragment: message too large")
+)
+
+// outgoing is a message being sent.
+type outgoing struct {
+	id   uint32
+	text bool
+	data []byte
+	seq  uint32
+	off  int // bytes of data sent
+	done chan error
+}
+
+// small tells whether the message fits in one fragment.
+func (o *outgoing) small() bool {
+	return firstHeaderSize+len(o.data) <= ChunkSize
+}
+
+// next returns the next fragment of the message.
+func (o *outgoing) next() []byte {
+	header := headerSize
+	if o.seq == 0 {
+		header = firstHeaderSize
+	}
+	n := len(o.data) - o.off
+	if n > ChunkSize-header {
+		n = ChunkSize - header
+	}
+
+	b := make([]byte, header+n)
+	if o.text {
+		b[0] |= flagText
+	}
+	binary.BigEndian.PutUint32(b[1:], o.id)
+	binary.BigEndian.PutUint32(b[5:], o.seq)
+	if o.seq == 0 {
+		binary.BigEndian.PutUint32(b[9:], uint32(len(o.data))) //nolint:gosec
+	}
+	copy(b[header:], o.data[o.off:o.off+n])
+
+	o.seq++
+	o.off += n
+	return b
+}
+
+// abort returns the fragment telling the other end to drop the message.
+func (o *outgoing) abort() []byte {
+	b := make([]byte, headerSize)
+	b[0] = flagAbort
+	binary.BigEndian.PutUint32(b[1:], o.id)
+	binary.BigEndian.PutUint32(b[5:], o.seq)
+	return b
+}
+
+// sent tells whether all the fragments have been sent.
+func (o *outgoing) sent() bool {
+	return o.seq > 0 && o.off == len(o.data)
+}
+
+// partial is a message of the other end being reassembled.
+type partial struct {
+	text bool
+	next uint32 // sequence number expected
+	data []byte
+	size int
+	last time.Time // when the last fragment came
+}
+
+// Channel sends and receives messages of up to a maximum size over a data
+// channel.
+type Channel struct {
+	d       *webrtc.DataChannel
+	maxSize int
+
+	mu        sync.Mutex
+	nextID    uint32
+	small     []*outgoing // sent first, in order
+	large     []*outgoing // take turns
+	onMessage func(webrtc.DataChannelMessage)
+	onError   func(error)
+	closed    chan struct{}
+
+	wake chan struct{}
+	more chan struct{}
+
+	// only used by the receive handler
+	partials       map[uint32]*partial // by id
+	pending        int                 // bytes held by partials
+	partialTimeout time.Duration
+}
+
+// New makes a Channel of d accepting messages of up to maxSize bytes,
+// DefaultMaxSize if 0. It takes over the OnMessage, OnClose and
+// OnBufferedAmountLow handlers of d. Messages may be sent once d is open.
+func New(d *webrtc.DataChannel, maxSize int) *Channel {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	c := &Channel{
+		d:              d,
+		maxSize:        maxSize,
+		closed:         make(chan struct{}),
+		wake:           make(chan struct{}, 1),
+		more:           make(chan struct{}, 1),
+		partials:       make(map[uint32]*partial),
+		partialTimeout: partialTimeout,
+	}
+	d.OnMessage(c.receive)
+	d.OnClose(c.close)
+	d.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+	d.OnBufferedAmountLow(func() {
+		select {
+		case c.more <- struct{}{}:
+		default:
+		}
+	})
+	go c.run()
+	return c
+}
+
+// OnMessage sets the handler of the messages of the other end, called once
+// a message is complete.
+func (c *Channel) OnMessage(f func(msg webrtc.DataChannelMessage)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onMessage = f
+}
+
+// OnError sets the handler of the messages of the other end that are
+// dropped, for being over the limits, out of sequence or aborted.
+func (c *Channel) OnError(f func(err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onError = f
+}
+
+// Done is closed once the data channel is.
+func (c *Channel) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Close closes the data channel.
+func (c *Channel) Close() error {
+	return c.d.Close()
+}
+
+// Send sends data as a binary message, returning once all of it is queued
+// on the data channel.
+func (c *Channel) Send(data []byte) error {
+	return c.send(data, false)
+}
+
+// SendText sends s as a text message, returning once all of it is queued
+// on the data channel.
+func (c *Channel) SendText(s string) error {
+	return c.send([]byte(s), true)
+}
+
+func (c *Channel) send(data []byte, text bool) error {
+	if len(data) > c.maxSize {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrTooLarge, len(data), c.maxSize)
+	}
+
+	o := &outgoing{text: text, data: data, done: make(chan error, 1)}
+	c.mu.Lock()
+	select {
+	case <-c.closed:
+		c.mu.Unlock()
+		return ErrClosed
+	default:
+	}
+	o.id = c.nextID
+	c.nextID++
+	if o.small() {
+		c.small = append(c.small, o)
+	} else {
+		c.large = append(c.large, o)
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return <-o.done
+}
+
+// next returns the message to send a fragment of once the data channel has
+// room for it, or nil once the Channel is closed.
+func (c *Channel) next() *outgoing {
+	for {
+		buffered := c.d.BufferedAmount()
+		c.mu.Lock()
+		var o *outgoing
+		switch {
+		case len(c.small) > 0 && buffered < maxBufferedAmount:
+			o = c.small[0]
+			c.small = c.small[1:]
+		case len(c.large) > 0 && buffered < maxLargeBufferedAmount:
+			o = c.large[0]
+			c.large = c.large[1:]
+		}
+		c.mu.Unlock()
+		if o != nil {
+			return o
+		}
+
+		select {
+		case <-c.wake:
+		case <-c.more:
+		case <-c.closed:
+			return nil
+		}
+	}
+}
+
+// run sends the fragments of the queued messages until the Channel is
+// closed.
+func (c *Channel) run() {
+	for {
+		o := c.next()
+		if o == nil {
+			return
+		}
+
+		if err := c.d.Send(o.next()); err != nil {
+			if errors.Is(err, io.ErrClosedPipe) {
+				err = ErrClosed
+			} else if o.seq > 1 {
+				// the other end holds the first fragments, best effort
+				_ = c.d.Send(o.abort())
+			}
+			o.done <- err
+			continue
+		}
+		if o.sent() {
+			o.done <- nil
+			continue
+		}
+
+		c.mu.Lock()
+		select {
+		case <-c.closed:
+			o.done <- ErrClosed
+		default:
+			c.large = append(c.large, o)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// close fails the messages being sent.
+func (c *Channel) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	close(c.closed)
+	for _, o := range append(c.small, c.large...) {
+		o.done <- ErrClosed
+	}
+	c.small, c.large = nil, nil
+}
+
+// receive handles a fragment from the other end.
+func (c *Channel) receive(msg webrtc.DataChannelMessage) {
+	b := msg.Data
+	if msg.IsString || len(b) < headerSize {
+		c.drop(fmt.Errorf("fragment: invalid fragment of %d bytes", len(b)))
+		return
+	}
+	flags := b[0]
+	id := binary.BigEndian.Uint32(b[1:])
+	seq := binary.BigEndian.Uint32(b[5:])
+	c.expire(time.Now())
+
+	p := c.partials[id]
+	switch {
+	case flags&flagAbort != 0:
+		if p != nil {
+			c.forget(id)
+			c.drop(fmt.Errorf("fragment: message %d aborted by the sender", id))
+		}
+		return
+	case seq == 0:
+		if len(b) < firstHeaderSize {
+			c.drop(fmt.Errorf("fragment: invalid first fragment of %d bytes", len(b)))
+			return
+		}
+		size := int(binary.BigEndian.Uint32(b[9:]))
+		if p != nil {
+			c.forget(id)
+			c.drop(fmt.Errorf("fragment: message %d restarted", id))
+			return
+		}
+		switch {
+		case size > c.maxSize:
+			c.drop(fmt.Errorf("%w: message %d of %d bytes, at most %d", ErrTooLarge, id, size, c.maxSize))
+			return
+		case len(c.partials) >= maxPartial:
+			c.drop(fmt.Errorf("fragment: message %d dropped, %d messages in reassembly", id, maxPartial))
+			return
+		}
+		p = &partial{text: flags&flagText != 0, size: size}
+		c.partials[id] = p
+		b = b[firstHeaderSize:]
+	default:
+		if p == nil {
+			// the rest of a dropped message
+			return
+		}
+		if seq != p.next {
+			c.forget(id)
+			c.drop(fmt.Errorf("fragment: message %d got fragment %d, expected %d", id, seq, p.next))
+			return
+		}
+		b = b[headerSize:]
+	}
+
+	switch {
+	case len(p.data)+len(b) > p.size:
+		c.forget(id)
+		c.drop(fmt.Errorf("fragment: message %d longer than its %d bytes", id, p.size))
+		return
+	case c.pending+len(b) > 2*c.maxSize:
+		c.forget(id)
+		c.drop(fmt.Errorf("fragment: message %d dropped, %d bytes in reassembly", id, c.pending))
+		return
+	}
+	// grown as fragments come, the size is only claimed by the other end
+	p.data = append(p.data, b...)
+	c.pending += len(b)
+	p.next++
+	p.last = time.Now()
+	if len(p.data) < p.size {
+		return
+	}
+	c.forget(id)
+
+	c.mu.Lock()
+	f := c.onMessage
+	c.mu.Unlock()
+	if f != nil {
+		f(webrtc.DataChannelMessage{IsString: p.text, Data: p.data})
+	}
+}
+
+// forget stops reassembling the message id.
+func (c *Channel) forget(id uint32) {
+	if p := c.partials[id]; p != nil {
+		c.pending -= len(p.data)
+		delete(c.partials, id)
+	}
+}
+
+// expire drops the messages whose next fragment is overdue, e.g. because
+// their sender could not send it. It runs on every fragment, so a stalled
+// message is dropped as soon as any other traffic comes.
+func (c *Channel) expire(now time.Time) {
+	for id, p := range c.partials {
+		if now.Sub(p.last) > c.partialTimeout {
+			c.forget(id)
+			c.drop(fmt.Errorf("fragment: message %d timed out after %d of %d bytes", id, len(p.data), p.size))
+		}
+	}
+}
+
+// drop reports a message of the other end that is dropped.
+func (c *Channel) drop(err error) {
+	c.mu.Lock()
+	f := c.onError
+	c.mu.Unlock()
+	if f != nil {
+		f(err)
+	}
+}
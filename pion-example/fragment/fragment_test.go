@@ -0,0 +1,266 @@
+package fragment
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+
+	"pion-webrtc-example/pion-example/internal/dctest"
+)
+
+// newPair returns two open Channels over a data channel between two
+// PeerConnections of this process.
+func newPair(t *testing.T, maxSize int) (*Channel, *Channel) {
+	t.Helper()
+	local, remote := dctest.Pair(t, nil, Label)
+	return New(local, maxSize), New(remote, maxSize)
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSendLarge(t *testing.T) {
+	local, remote := newPair(t, 0)
+	received := make(chan webrtc.DataChannelMessage, 2)
+	remote.OnMessage(func(msg webrtc.DataChannelMessage) { received <- msg })
+
+	data := randomBytes(t, 3*ChunkSize+5)
+	if err := local.Send(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := local.SendText(""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []webrtc.DataChannelMessage{{Data: data}, {IsString: true, Data: []byte{}}} {
+		select {
+		case msg := <-received:
+			if msg.IsString != want.IsString || !bytes.Equal(msg.Data, want.Data) {
+				t.Fatalf("got %d bytes, text %t, want %d bytes, text %t", len(msg.Data), msg.IsString, len(want.Data), want.IsString)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("message not received")
+		}
+	}
+}
+
+func TestSmallOvertakesLarge(t *testing.T) {
+	local, remote := newPair(t, 0)
+	var mu sync.Mutex
+	var order []int
+	done := make(chan struct{})
+	remote.OnMessage(func(msg webrtc.DataChannelMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		order = append(order, len(msg.Data))
+		if len(order) == 3 {
+			close(done)
+		}
+	})
+
+	large := randomBytes(t, 4<<20)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := local.Send(large); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// let the large ones start
+	time.Sleep(20 * time.Millisecond)
+	if err := local.SendText("ping"); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("messages not received")
+	}
+	if order[0] != len("ping") {
+		t.Fatalf("received sizes %v, want the ping first", order)
+	}
+}
+
+func TestSendTooLarge(t *testing.T) {
+	local, _ := newPair(t, 100)
+	if err := local.Send(make([]byte, 101)); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("Send = %v, want ErrTooLarge", err)
+	}
+}
+
+// receiver is a Channel only receiving, fed with fragments by the test.
+type receiver struct {
+	*Channel
+	messages [][]byte
+	errs     []error
+}
+
+func newReceiver(maxSize int) *receiver {
+	r := &receiver{Channel: &Channel{
+		maxSize:        maxSize,
+		partials:       make(map[uint32]*partial),
+		partialTimeout: partialTimeout,
+	}}
+	r.onMessage = func(msg webrtc.DataChannelMessage) { r.messages = append(r.messages, msg.Data) }
+	r.onError = func(err error) { r.errs = append(r.errs, err) }
+	return r
+}
+
+func (r *receiver) feed(b []byte) {
+	r.receive(webrtc.DataChannelMessage{Data: b})
+}
+
+// fragments returns the fragments of a message of size bytes.
+func fragments(id uint32, size int) (*outgoing, [][]byte) {
+	o := &outgoing{id: id, data: make([]byte, size)}
+	var frags [][]byte
+	for !o.sent() {
+		frags = append(frags, o.next())
+	}
+	return o, frags
+}
+
+func TestReceiveInterleaved(t *testing.T) {
+	r := newReceiver(DefaultMaxSize)
+	_, a := fragments(1, 3*ChunkSize)
+	_, b := fragments(2, 2*ChunkSize)
+	_, c := fragments(3, 10)
+	r.feed(a[0])
+	r.feed(b[0])
+	r.feed(c[0])
+	r.feed(a[1])
+	r.feed(b[1])
+	r.feed(b[2])
+	r.feed(a[2])
+	r.feed(a[3])
+
+	if len(r.errs) > 0 {
+		t.Fatal(r.errs)
+	}
+	var sizes []int
+	for _, m := range r.messages {
+		sizes = append(sizes, len(m))
+	}
+	if len(sizes) != 3 || sizes[0] != 10 || sizes[1] != 2*ChunkSize || sizes[2] != 3*ChunkSize {
+		t.Fatalf("received sizes %v", sizes)
+	}
+	if r.pending != 0 || len(r.partials) != 0 {
+		t.Fatalf("%d bytes of %d messages left", r.pending, len(r.partials))
+	}
+}
+
+func TestReceiveOutOfSequence(t *testing.T) {
+	r := newReceiver(DefaultMaxSize)
+	_, frags := fragments(1, 3*ChunkSize)
+	r.feed(frags[0])
+	r.feed(frags[2])
+	r.feed(frags[1])
+	r.feed(frags[3])
+
+	if len(r.messages) != 0 || len(r.errs) != 1 {
+		t.Fatalf("got %d messages and errors %v, want one error", len(r.messages), r.errs)
+	}
+	if r.pending != 0 || len(r.partials) != 0 {
+		t.Fatalf("%d bytes of %d messages left", r.pending, len(r.partials))
+	}
+}
+
+func TestReceiveTooLarge(t *testing.T) {
+	r := newReceiver(2 * ChunkSize)
+	_, frags := fragments(1, 2*ChunkSize+1)
+	for _, f := range frags {
+		r.feed(f)
+	}
+	if len(r.messages) != 0 || len(r.errs) != 1 || !errors.Is(r.errs[0], ErrTooLarge) {
+		t.Fatalf("got %d messages and errors %v, want ErrTooLarge", len(r.messages), r.errs)
+	}
+}
+
+func TestReceiveBoundsMemory(t *testing.T) {
+	r := newReceiver(4 * ChunkSize)
+	// first fragments claiming the maximum size do not allocate it
+	for id := uint32(0); id < maxPartial; id++ {
+		_, frags := fragments(id, r.maxSize)
+		r.feed(frags[0][:firstHeaderSize])
+	}
+	for _, p := range r.partials {
+		if cap(p.data) > 0 {
+			t.Fatalf("partial preallocated %d bytes", cap(p.data))
+		}
+	}
+	_, frags := fragments(maxPartial, 10)
+	r.feed(frags[0])
+	if len(r.messages) != 0 || len(r.errs) != 1 {
+		t.Fatalf("got %d messages and errors %v, want the message over maxPartial dropped", len(r.messages), r.errs)
+	}
+
+	// together the messages in reassembly hold at most twice the maximum
+	r = newReceiver(4 * ChunkSize)
+	for id := uint32(0); id < 3; id++ {
+		_, frags := fragments(id, r.maxSize)
+		for _, f := range frags[:len(frags)-1] {
+			r.feed(f)
+		}
+	}
+	if len(r.errs) != 1 || r.pending > 2*r.maxSize {
+		t.Fatalf("%d bytes in reassembly, errors %v", r.pending, r.errs)
+	}
+}
+
+func TestReceiveAbortAndTimeout(t *testing.T) {
+	r := newReceiver(DefaultMaxSize)
+	o, frags := fragments(1, 3*ChunkSize)
+	r.feed(frags[0])
+	r.feed(frags[1])
+	r.feed(o.abort())
+	r.feed(frags[2])
+	if len(r.partials) != 0 || r.pending != 0 || len(r.errs) != 1 {
+		t.Fatalf("%d messages in reassembly after abort, errors %v", len(r.partials), r.errs)
+	}
+
+	r = newReceiver(DefaultMaxSize)
+	r.partialTimeout = time.Millisecond
+	_, frags = fragments(1, 3*ChunkSize)
+	r.feed(frags[0])
+	time.Sleep(5 * time.Millisecond)
+	_, next := fragments(2, 10)
+	r.feed(next[0])
+	if len(r.partials) != 0 || len(r.errs) != 1 || len(r.messages) != 1 {
+		t.Fatalf("%d messages in reassembly after the timeout, errors %v", len(r.partials), r.errs)
+	}
+
+	// any fragment expires, not only the first of a message
+	r = newReceiver(DefaultMaxSize)
+	r.partialTimeout = 100 * time.Millisecond
+	_, stalled := fragments(1, 3*ChunkSize)
+	_, moving := fragments(2, 3*ChunkSize)
+	r.feed(stalled[0])
+	r.feed(moving[0])
+	time.Sleep(60 * time.Millisecond)
+	r.feed(moving[1])
+	time.Sleep(60 * time.Millisecond)
+	r.feed(moving[2])
+	if _, ok := r.partials[1]; ok || len(r.errs) != 1 {
+		t.Fatalf("stalled message kept while another came in, errors %v", r.errs)
+	}
+	r.feed(moving[3])
+	if len(r.errs) != 1 || len(r.messages) != 1 {
+		t.Fatalf("got %d messages and errors %v, want the moving one", len(r.messages), r.errs)
+	}
+}
@@ -0,0 +1,114 @@
+// Package icerecovery brings a PeerConnection back after a network change
+// instead of ending the session. A disconnected connection gets the grace
+// period to come back by itself; after that, or once it has failed, ICE is
+// restarted and given the grace period again. The data channels and their
+// callbacks are kept over a restart.
+package icerecovery
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Recovery restarts ICE as needed, once given the states of a
+// PeerConnection. GiveUp is called once MaxRestarts restarts in a row did
+// not bring the connection back.
+type Recovery struct {
+	Grace       time.Duration
+	MaxRestarts int
+
+	// Restart restarts ICE, e.g. by sending an offer created with
+	// ICERestart. It is nil on the answering side, which waits for the
+	// offers of the other side.
+	Restart func() error
+	GiveUp  func(reason string)
+	// Logf reports the restarts. It may be nil.
+	Logf func(format string, args ...interface{})
+
+	mu        sync.Mutex
+	timer     *time.Timer
+	restarts  int
+	restarted bool // a restart is waiting for the connection
+	done      bool
+}
+
+// OnConnectionStateChange is to be called with every state of the
+// PeerConnection.
+func (r *Recovery) OnConnectionStateChange(s webrtc.PeerConnectionState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return
+	}
+
+	switch s { //nolint:exhaustive
+	case webrtc.PeerConnectionStateConnected:
+		r.stop()
+		if r.restarts > 0 {
+			r.logf("Connection back after %d ICE restart(s)", r.restarts)
+		}
+		r.restarts = 0
+		r.restarted = false
+	case webrtc.PeerConnectionStateDisconnected:
+		if r.timer == nil {
+			r.timer = time.AfterFunc(r.Grace, r.attempt)
+		}
+	case webrtc.PeerConnectionStateFailed:
+		if !r.restarted {
+			r.stop()
+			go r.attempt()
+		}
+	case webrtc.PeerConnectionStateClosed:
+		r.stop()
+		r.done = true
+	}
+}
+
+func (r *Recovery) stop() {
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+}
+
+func (r *Recovery) logf(format string, args ...interface{}) {
+	if r.Logf != nil {
+		r.Logf(format, args...)
+	}
+}
+
+// attempt restarts ICE, or gives up, once the connection has not come back.
+func (r *Recovery) attempt() {
+	r.mu.Lock()
+	if r.done {
+		r.mu.Unlock()
+		return
+	}
+	if r.restarts >= r.MaxRestarts {
+		r.stop()
+		r.done = true
+		r.mu.Unlock()
+		if r.GiveUp != nil {
+			r.GiveUp(fmt.Sprintf("connection not back after %d ICE restart(s)", r.restarts))
+		}
+		return
+	}
+	r.restarts++
+	r.restarted = true
+	r.stop()
+	r.timer = time.AfterFunc(r.Grace, r.attempt)
+	n := r.restarts
+	r.mu.Unlock()
+
+	if r.Restart == nil {
+		r.logf("Waiting for the other side to restart ICE (%d/%d)", n, r.MaxRestarts)
+		return
+	}
+	r.logf("Restarting ICE (%d/%d)", n, r.MaxRestarts)
+	if err := r.Restart(); err != nil {
+		r.logf("ICE restart failed: %v", err)
+	}
+}
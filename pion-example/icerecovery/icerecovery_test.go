@@ -0,0 +1,120 @@
+package icerecovery
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const grace = 20 * time.Millisecond
+
+// counter records the restarts and the give up of a Recovery.
+type counter struct {
+	mu       sync.Mutex
+	restarts int
+	reason   string
+	gaveUp   chan struct{}
+}
+
+func newRecovery(maxRestarts int) (*Recovery, *counter) {
+	c := &counter{gaveUp: make(chan struct{})}
+	r := &Recovery{
+		Grace:       grace,
+		MaxRestarts: maxRestarts,
+		Restart: func() error {
+			c.mu.Lock()
+			c.restarts++
+			c.mu.Unlock()
+			return nil
+		},
+		GiveUp: func(reason string) {
+			c.mu.Lock()
+			c.reason = reason
+			c.mu.Unlock()
+			close(c.gaveUp)
+		},
+	}
+	return r, c
+}
+
+func (c *counter) state() (int, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.restarts, c.reason
+}
+
+func TestBackWithinGrace(t *testing.T) {
+	r, c := newRecovery(3)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateConnected)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateDisconnected)
+	time.Sleep(grace / 4)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateConnected)
+	time.Sleep(3 * grace)
+	if n, reason := c.state(); n != 0 || reason != "" {
+		t.Fatalf("%d restarts, gave up %q, want none", n, reason)
+	}
+}
+
+func TestRestartsThenGivesUp(t *testing.T) {
+	r, c := newRecovery(2)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateDisconnected)
+	select {
+	case <-c.gaveUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("never gave up")
+	}
+	n, reason := c.state()
+	if n != 2 || reason != "connection not back after 2 ICE restart(s)" {
+		t.Fatalf("%d restarts, gave up %q", n, reason)
+	}
+
+	// done once given up
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateFailed)
+	time.Sleep(3 * grace)
+	if n, _ := c.state(); n != 2 {
+		t.Fatalf("%d restarts after giving up", n)
+	}
+}
+
+func TestFailedRestartsAtOnce(t *testing.T) {
+	r, c := newRecovery(3)
+	r.Grace = time.Hour
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateFailed)
+	time.Sleep(grace)
+	if n, _ := c.state(); n != 1 {
+		t.Fatalf("%d restarts once failed, want 1", n)
+	}
+	// failed again while the restart is pending does not restart again
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateFailed)
+	time.Sleep(grace)
+	if n, _ := c.state(); n != 1 {
+		t.Fatalf("%d restarts, want 1", n)
+	}
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateClosed)
+}
+
+func TestConnectedResetsRestarts(t *testing.T) {
+	r, c := newRecovery(1)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateFailed)
+	time.Sleep(grace / 2)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateConnected)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateFailed)
+	time.Sleep(grace / 2)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateConnected)
+	time.Sleep(3 * grace)
+	if n, reason := c.state(); n != 2 || reason != "" {
+		t.Fatalf("%d restarts, gave up %q, want 2 restarts and no give up", n, reason)
+	}
+}
+
+func TestClosedStops(t *testing.T) {
+	r, c := newRecovery(3)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateDisconnected)
+	r.OnConnectionStateChange(webrtc.PeerConnectionStateClosed)
+	time.Sleep(3 * grace)
+	if n, reason := c.state(); n != 0 || reason != "" {
+		t.Fatalf("%d restarts, gave up %q after close", n, reason)
+	}
+}
@@ -0,0 +1,81 @@
+// Package dctest opens data channels between two PeerConnections of the
+// same process for the tests of the data channel packages.
+package dctest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Pair connects two PeerConnections made by api, or with the defaults if
+// api is nil, and returns both ends of an open data channel labeled label.
+// The PeerConnections are closed at the end of the test. Nothing is sent
+// on the channel before Pair returns, so handlers set afterwards miss no
+// message.
+func Pair(t testing.TB, api *webrtc.API, label string) (local, remote *webrtc.DataChannel) {
+	t.Helper()
+	if api == nil {
+		api = webrtc.NewAPI()
+	}
+
+	offerPC, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { offerPC.Close() })
+	answerPC, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { answerPC.Close() })
+
+	remotes := make(chan *webrtc.DataChannel, 1)
+	answerPC.OnDataChannel(func(d *webrtc.DataChannel) {
+		d.OnOpen(func() { remotes <- d })
+	})
+	local, err = offerPC.CreateDataChannel(label, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := make(chan struct{})
+	local.OnOpen(func() { close(opened) })
+
+	offer, err := offerPC.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerPC)
+	if err := offerPC.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := answerPC.SetRemoteDescription(*offerPC.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := answerPC.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerPC)
+	if err := answerPC.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	if err := offerPC.SetRemoteDescription(*answerPC.LocalDescription()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-opened:
+	case <-time.After(10 * time.Second):
+		t.Fatal("data channel not open")
+	}
+	select {
+	case remote = <-remotes:
+	case <-time.After(10 * time.Second):
+		t.Fatal("remote data channel not open")
+	}
+	return local, remote
+}
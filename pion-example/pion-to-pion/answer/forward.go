@@ -0,0 +1,70 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"pion-webrtc-example/pion-example/dcconn"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// labels of the data channels of port forwarding
+const (
+	controlLabel = "control" // open while we forward
+	forwardLabel = "forward" // one per forwarded connection
+)
+
+// dialTimeout is how long dialing the forward target may take.
+const dialTimeout = 10 * time.Second
+
+// serveForward dials target for each 'forward' data channel and copies
+// between them. Detached data channels cannot carry anything else, so
+// other data channels are closed, as are all of them if target is empty.
+func serveForward(dataChannel *webrtc.DataChannel, target string) {
+	if target == "" || (dataChannel.Label() != forwardLabel && dataChannel.Label() != controlLabel) {
+		fmt.Printf("Refusing DataChannel %s, run with -forward-target to forward connections\n", dataChannel.Label())
+		if target != "" {
+			fmt.Println("Only port forwarding is served with -forward-target")
+		}
+		if cErr := dataChannel.Close(); cErr != nil {
+			fmt.Printf("cannot close DataChannel: %v\n", cErr)
+		}
+
+		return
+	}
+
+	dataChannel.OnOpen(func() {
+		conn, err := dcconn.New(dataChannel)
+		if err != nil {
+			fmt.Printf("cannot detach DataChannel %s: %v\n", dataChannel.Label(), err)
+
+			return
+		}
+
+		if dataChannel.Label() == controlLabel {
+			// held open until the offer process goes
+			fmt.Printf("Forwarding connections to %s\n", target)
+			_, _ = io.Copy(io.Discard, conn)
+
+			return
+		}
+
+		tcpConn, err := net.DialTimeout("tcp", target, dialTimeout)
+		if err != nil {
+			fmt.Printf("cannot dial %s for %s: %v\n", target, conn.RemoteAddr(), err)
+			conn.Close()
+
+			return
+		}
+
+		fmt.Printf("Forwarding %s to %s\n", conn.RemoteAddr(), tcpConn.RemoteAddr())
+		dcconn.Pipe(conn, tcpConn)
+		fmt.Printf("Closed %s\n", conn.RemoteAddr())
+	})
+}
@@ -0,0 +1,38 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"pion-webrtc-example/pion-example/fragment"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// receiveLarge prints the reassembled messages of dataChannel, and
+// acknowledges the large ones.
+func receiveLarge(dataChannel *webrtc.DataChannel) {
+	channel := fragment.New(dataChannel, 0)
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		if msg.IsString {
+			fmt.Printf("Message from DataChannel '%s': '%s'\n", dataChannel.Label(), string(msg.Data))
+
+			return
+		}
+
+		fmt.Printf("Received %d bytes from DataChannel '%s', sha256 %x\n", len(msg.Data), dataChannel.Label(), sha256.Sum256(msg.Data))
+		// Sent from a goroutine, as the send waits for the fragments to be
+		// queued and messages are received on the same goroutine
+		go func() {
+			if err := channel.SendText(fmt.Sprintf("got %d bytes", len(msg.Data))); err != nil {
+				fmt.Printf("cannot acknowledge %d bytes: %v\n", len(msg.Data), err)
+			}
+		}()
+	})
+	channel.OnError(func(err error) {
+		fmt.Printf("Dropped a message from DataChannel '%s': %v\n", dataChannel.Label(), err)
+	})
+}
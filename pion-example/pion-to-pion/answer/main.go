@@ -11,10 +11,14 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
 	"sync"
 	"time"
 
+	"pion-webrtc-example/pion-example/filetransfer"
+	"pion-webrtc-example/pion-example/fragment"
+	"pion-webrtc-example/pion-example/icerecovery"
+	"pion-webrtc-example/pion-example/rpc"
+
 	"github.com/pion/randutil"
 	"github.com/pion/webrtc/v4"
 )
@@ -34,8 +38,22 @@ func signalCandidate(addr string, candidate *webrtc.ICECandidate) error {
 func main() {
 	offerAddr := flag.String("offer-address", "localhost:50000", "Address that the Offer HTTP server is hosted on.")
 	answerAddr := flag.String("answer-address", ":60000", "Address that the Answer HTTP server is hosted on.")
+	iceGrace := flag.Duration("ice-grace", 5*time.Second, "How long a disconnected or restarted connection gets to come back.")
+	iceRestarts := flag.Int("ice-restarts", 3, "ICE restarts of the offer process to wait for before exiting.")
+	recvDir := flag.String("recv-dir", "", "Directory to save the files sent by the offer process into, files are refused if empty.")
+	forwardTarget := flag.String("forward-target", "", "Address to dial for each connection forwarded by the offer process, forwarding is refused if empty.")
 	flag.Parse()
 
+	// The callbacks end the process through quit, so that main returns and
+	// closes the PeerConnection
+	exit := make(chan struct{}, 1)
+	quit := func() {
+		select {
+		case exit <- struct{}{}:
+		default:
+		}
+	}
+
 	var candidatesMux sync.Mutex
 	pendingCandidates := make([]*webrtc.ICECandidate, 0)
 	// Everything below is the Pion WebRTC API! Thanks for using it ❤️.
@@ -49,8 +67,17 @@ func main() {
 		},
 	}
 
+	// Port forwarding detaches its data channels to use them as net.Conn,
+	// which pion only supports for all the data channels at once
+	newPeerConnection := webrtc.NewPeerConnection
+	if *forwardTarget != "" {
+		settingEngine := webrtc.SettingEngine{}
+		settingEngine.DetachDataChannels()
+		newPeerConnection = webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine)).NewPeerConnection
+	}
+
 	// Create a new RTCPeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := newPeerConnection(config)
 	if err != nil {
 		panic(err)
 	}
@@ -93,7 +120,8 @@ func main() {
 		}
 	})
 
-	// A HTTP handler that processes a SessionDescription given to us from the other Pion process
+	// A HTTP handler that processes a SessionDescription given to us from the other Pion process,
+	// the first offer or an ICE restart one
 	http.HandleFunc("/sdp", func(res http.ResponseWriter, req *http.Request) { // nolint: revive
 		sdp := webrtc.SessionDescription{}
 		if err := json.NewDecoder(req.Body).Decode(&sdp); err != nil {
@@ -139,34 +167,94 @@ func main() {
 				panic(onICECandidateErr)
 			}
 		}
+		pendingCandidates = nil
 		candidatesMux.Unlock()
 	})
 
+	// The offer process restarts ICE when the connection is lost. One more
+	// round is waited for than it tries, since it starts after us.
+	recovery := &icerecovery.Recovery{
+		Grace:       *iceGrace,
+		MaxRestarts: *iceRestarts + 1,
+		Logf: func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		},
+		GiveUp: func(reason string) {
+			fmt.Printf("Peer Connection did not come back, %s, exiting\n", reason)
+			quit()
+		},
+	}
+
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		fmt.Printf("Peer Connection State has changed: %s\n", state.String())
 
-		if state == webrtc.PeerConnectionStateFailed {
-			// Wait until PeerConnection has had no network activity for 30 seconds or another failure.
-			// It may be reconnected using an ICE Restart.
-			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
-			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-			fmt.Println("Peer Connection has gone to failed exiting")
-			os.Exit(0)
-		}
+		// Disconnected and Failed are handled by recovery, the PeerConnection
+		// may come back from both with an ICE restart
+		recovery.OnConnectionStateChange(state)
 
 		if state == webrtc.PeerConnectionStateClosed {
 			// PeerConnection was explicitly closed. This usually happens from a DTLS CloseNotify
 			fmt.Println("Peer Connection has gone to closed exiting")
-			os.Exit(0)
+			quit()
 		}
 	})
 
+	// Files are received over the data channels labeled 'file'. Partially
+	// received files are kept in recvDir, a new transfer of the same file
+	// resumes from where the last one stopped.
+	receiver := &filetransfer.Receiver{
+		Dir: *recvDir,
+		Progress: func(m filetransfer.Manifest, received int64) {
+			fmt.Printf("Received %d/%d bytes of %s (%.1f%%)\n", received, m.Size, m.Name, percent(received, m.Size))
+		},
+		Done: func(m filetransfer.Manifest, path string, err error) {
+			if err != nil {
+				fmt.Printf("Receiving %s failed: %v\n", m.Name, err)
+
+				return
+			}
+			fmt.Printf("Saved %s, sha256 %s verified\n", path, m.SHA256)
+		},
+	}
+
 	// Register data channel creation handling
 	peerConnection.OnDataChannel(func(dataChannel *webrtc.DataChannel) {
 		fmt.Printf("New DataChannel %s %d\n", dataChannel.Label(), dataChannel.ID())
 
+		if *forwardTarget != "" || dataChannel.Label() == forwardLabel || dataChannel.Label() == controlLabel {
+			serveForward(dataChannel, *forwardTarget)
+
+			return
+		}
+
+		if dataChannel.Label() == rpc.Label {
+			serveRPC(dataChannel)
+
+			return
+		}
+
+		if dataChannel.Label() == fragment.Label {
+			receiveLarge(dataChannel)
+
+			return
+		}
+
+		if dataChannel.Label() == filetransfer.Label {
+			if *recvDir == "" {
+				fmt.Println("Refusing file, run with -recv-dir to receive files")
+				if cErr := dataChannel.Close(); cErr != nil {
+					fmt.Printf("cannot close DataChannel: %v\n", cErr)
+				}
+
+				return
+			}
+			receiver.Receive(dataChannel)
+
+			return
+		}
+
 		// Register channel opening handling
 		dataChannel.OnOpen(func() {
 			fmt.Printf(
@@ -200,5 +288,16 @@ func main() {
 
 	// Start HTTP server that accepts requests from the offer process to exchange SDP and Candidates
 	// nolint: gosec
-	panic(http.ListenAndServe(*answerAddr, nil))
+	go func() { panic(http.ListenAndServe(*answerAddr, nil)) }()
+
+	// Block until a callback ends the process
+	<-exit
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 100
+	}
+
+	return float64(n) * 100 / float64(total)
 }
@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"pion-webrtc-example/pion-example/rpc"
+
+	"github.com/pion/webrtc/v4"
+)
+
+type echo struct {
+	Text string `json:"text"`
+}
+
+type countdown struct {
+	From     int           `json:"from"`
+	Interval time.Duration `json:"interval"`
+}
+
+type sleep struct {
+	Duration time.Duration `json:"duration"`
+}
+
+// serveRPC serves the methods of the answer process over dataChannel, and
+// calls the offer process once it is open.
+func serveRPC(dataChannel *webrtc.DataChannel) {
+	peer := rpc.NewPeer(dataChannel)
+	peer.OnError(func(err error) {
+		fmt.Println(err)
+	})
+
+	peer.Handle("Echo", func(_ context.Context, params json.RawMessage) (interface{}, error) {
+		var req echo
+		if err := rpc.Decode(params, &req); err != nil {
+			return nil, err
+		}
+
+		return req, nil
+	})
+
+	peer.HandleStream("Countdown", func(ctx context.Context, params json.RawMessage, send func(interface{}) error) error {
+		var req countdown
+		if err := rpc.Decode(params, &req); err != nil {
+			return err
+		}
+
+		ticker := time.NewTicker(req.Interval)
+		defer ticker.Stop()
+		for n := req.From; n > 0; n-- {
+			if err := send(n); err != nil {
+				return err
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				fmt.Printf("Countdown stopped at %d: %v\n", n, ctx.Err())
+
+				return ctx.Err()
+			}
+		}
+
+		return nil
+	})
+
+	peer.Handle("Sleep", func(ctx context.Context, params json.RawMessage) (interface{}, error) {
+		var req sleep
+		if err := rpc.Decode(params, &req); err != nil {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(req.Duration):
+			return nil, nil
+		case <-ctx.Done():
+			fmt.Printf("Sleep stopped: %v\n", ctx.Err())
+
+			return nil, ctx.Err()
+		}
+	})
+
+	dataChannel.OnOpen(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var hostname string
+		if err := peer.Call(ctx, "Hostname", nil, &hostname); err != nil {
+			fmt.Printf("RPC failed: %v\n", err)
+
+			return
+		}
+		fmt.Printf("The offer process runs on %s\n", hostname)
+	})
+}
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"pion-webrtc-example/pion-example/dcconn"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// labels of the data channels of port forwarding
+const (
+	controlLabel = "control" // open while the answer process forwards
+	forwardLabel = "forward" // one per forwarded connection
+)
+
+// forwardPort listens on listenAddr once the 'control' data channel is
+// open, and forwards each accepted connection over a new 'forward' data
+// channel to the target the answer process dials, like ssh -L. It quits
+// once the answer process stops forwarding.
+func forwardPort(peerConnection *webrtc.PeerConnection, listenAddr string, quit func(code int)) {
+	// The 'control' data channel carries nothing, but makes the offer
+	// negotiate SCTP for the 'forward' data channels created later
+	control, err := peerConnection.CreateDataChannel(controlLabel, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	control.OnOpen(func() {
+		conn, err := dcconn.New(control)
+		if err != nil {
+			fmt.Printf("cannot detach DataChannel %s: %v\n", control.Label(), err)
+			quit(1)
+
+			return
+		}
+
+		listener, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			fmt.Printf("cannot listen on %s: %v\n", listenAddr, err)
+			quit(1)
+
+			return
+		}
+		fmt.Printf("Forwarding %s to the -forward-target of the answer process\n", listener.Addr())
+
+		go func() {
+			_, _ = io.Copy(io.Discard, conn)
+			fmt.Println("Control data channel closed, is the answer process run with -forward-target? exiting")
+			listener.Close()
+			quit(0)
+		}()
+
+		for {
+			tcpConn, err := listener.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				fmt.Printf("cannot accept on %s: %v\n", listener.Addr(), err)
+				listener.Close()
+				quit(1)
+
+				return
+			}
+			forwardConn(peerConnection, tcpConn)
+		}
+	})
+}
+
+// forwardConn forwards tcpConn over a new 'forward' data channel.
+func forwardConn(peerConnection *webrtc.PeerConnection, tcpConn net.Conn) {
+	dataChannel, err := peerConnection.CreateDataChannel(forwardLabel, nil)
+	if err != nil {
+		fmt.Printf("cannot forward %s: %v\n", tcpConn.RemoteAddr(), err)
+		tcpConn.Close()
+
+		return
+	}
+
+	// The answer process closes the data channel if it cannot dial the target
+	dataChannel.OnClose(func() {
+		tcpConn.Close()
+	})
+
+	dataChannel.OnOpen(func() {
+		conn, err := dcconn.New(dataChannel)
+		if err != nil {
+			fmt.Printf("cannot forward %s: %v\n", tcpConn.RemoteAddr(), err)
+			tcpConn.Close()
+
+			return
+		}
+
+		fmt.Printf("Forwarding %s over %s\n", tcpConn.RemoteAddr(), conn.LocalAddr())
+		dcconn.Pipe(tcpConn, conn)
+		fmt.Printf("Closed %s\n", tcpConn.RemoteAddr())
+	})
+}
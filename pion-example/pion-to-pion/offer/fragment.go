@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+
+	"pion-webrtc-example/pion-example/fragment"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// largeSizes are the sizes of the large messages sent at once, each far
+// over the message size of a data channel.
+var largeSizes = []int{4 << 20, 1 << 20} //nolint:gochecknoglobals
+
+// sendLarge sends large messages over dataChannel once it is open, and
+// small text messages meanwhile, which reach the answer process first.
+func sendLarge(dataChannel *webrtc.DataChannel) {
+	channel := fragment.New(dataChannel, 0)
+	channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+		fmt.Printf("Message from DataChannel '%s': '%s'\n", dataChannel.Label(), string(msg.Data))
+	})
+
+	dataChannel.OnOpen(func() {
+		fmt.Printf("Data channel '%s'-'%d' open. Sending large messages\n", dataChannel.Label(), dataChannel.ID())
+
+		var wg sync.WaitGroup
+		for _, size := range largeSizes {
+			data := make([]byte, size)
+			if _, err := rand.Read(data); err != nil {
+				panic(err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fmt.Printf("Sending %d bytes, sha256 %x\n", len(data), sha256.Sum256(data))
+				if err := channel.Send(data); err != nil {
+					fmt.Printf("Sending %d bytes failed: %v\n", len(data), err)
+				}
+			}()
+		}
+
+		sent := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(sent)
+		}()
+
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 1; ; i++ {
+			select {
+			case <-sent:
+				fmt.Println("Large messages sent")
+
+				return
+			case <-ticker.C:
+			}
+			if err := channel.SendText(fmt.Sprintf("ping %d", i)); err != nil {
+				fmt.Printf("Sending ping failed: %v\n", err)
+
+				return
+			}
+		}
+	})
+}
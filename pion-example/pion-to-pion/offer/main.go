@@ -15,6 +15,11 @@ import (
 	"sync"
 	"time"
 
+	"pion-webrtc-example/pion-example/filetransfer"
+	"pion-webrtc-example/pion-example/fragment"
+	"pion-webrtc-example/pion-example/icerecovery"
+	"pion-webrtc-example/pion-example/rpc"
+
 	"github.com/pion/randutil"
 	"github.com/pion/webrtc/v4"
 )
@@ -33,14 +38,60 @@ func signalCandidate(addr string, candidate *webrtc.ICECandidate) error {
 	return resp.Body.Close()
 }
 
+// sendOffer sends offer to the HTTP server listening in the other process.
+func sendOffer(addr string, offer webrtc.SessionDescription) error {
+	payload, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post( //nolint:noctx
+		fmt.Sprintf("http://%s/sdp", addr),
+		"application/json; charset=utf-8",
+		bytes.NewReader(payload),
+	)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
 //nolint:gocognit, cyclop
 func main() {
 	offerAddr := flag.String("offer-address", ":50000", "Address that the Offer HTTP server is hosted on.")
 	answerAddr := flag.String("answer-address", "127.0.0.1:60000", "Address that the Answer HTTP server is hosted on.")
+	iceGrace := flag.Duration("ice-grace", 5*time.Second, "How long a disconnected or restarted connection gets to come back.")
+	iceRestarts := flag.Int("ice-restarts", 3, "ICE restarts to try before exiting.")
+	sendFile := flag.String("send", "", "File to send to the answer process instead of random messages, exiting once it is verified.")
+	forwardListen := flag.String("forward-listen", "", "Address to listen on, forwarding each connection to the -forward-target of the answer process.")
+	withRPC := flag.Bool("rpc", false, "Also open an 'rpc' data channel and call the functions of the answer process.")
+	withFragment := flag.Bool("fragment", false, "Also open a 'fragment' data channel and send large messages over it.")
 	flag.Parse()
 
+	if *sendFile != "" && *forwardListen != "" {
+		panic("-send and -forward-listen cannot be combined")
+	}
+
+	// The callbacks end the process by sending its exit code to exit, so
+	// that main returns and closes the PeerConnection before exiting
+	exit := make(chan int, 1)
+	quit := func(code int) {
+		select {
+		case exit <- code:
+		default:
+		}
+	}
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
 	var candidatesMux sync.Mutex
 	pendingCandidates := make([]*webrtc.ICECandidate, 0)
+	// set while an ICE restart offer waits for its answer
+	candidatesHeld := false
 
 	// Everything below is the Pion WebRTC API! Thanks for using it ❤️.
 
@@ -53,8 +104,17 @@ func main() {
 		},
 	}
 
+	// Port forwarding detaches its data channels to use them as net.Conn,
+	// which pion only supports for all the data channels at once
+	newPeerConnection := webrtc.NewPeerConnection
+	if *forwardListen != "" {
+		settingEngine := webrtc.SettingEngine{}
+		settingEngine.DetachDataChannels()
+		newPeerConnection = webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine)).NewPeerConnection
+	}
+
 	// Create a new RTCPeerConnection
-	peerConnection, err := webrtc.NewPeerConnection(config)
+	peerConnection, err := newPeerConnection(config)
 	if err != nil {
 		panic(err)
 	}
@@ -75,7 +135,7 @@ func main() {
 		defer candidatesMux.Unlock()
 
 		desc := peerConnection.RemoteDescription()
-		if desc == nil {
+		if desc == nil || candidatesHeld {
 			pendingCandidates = append(pendingCandidates, candidate)
 		} else if onICECandidateErr := signalCandidate(*answerAddr, candidate); onICECandidateErr != nil {
 			panic(onICECandidateErr)
@@ -116,15 +176,130 @@ func main() {
 				panic(onICECandidateErr)
 			}
 		}
+		pendingCandidates = nil
+		candidatesHeld = false
 	})
 	// Start HTTP server that accepts requests from the answer process
 	// nolint: gosec
 	go func() { panic(http.ListenAndServe(*offerAddr, nil)) }()
 
-	// Create a datachannel with label 'data'
-	dataChannel, err := peerConnection.CreateDataChannel("data", nil)
-	if err != nil {
-		panic(err)
+	if *forwardListen != "" {
+		forwardPort(peerConnection, *forwardListen, quit)
+	} else {
+		// Create a datachannel with label 'data', or 'file' to send a file
+		label := "data"
+		if *sendFile != "" {
+			label = filetransfer.Label
+		}
+		dataChannel, err := peerConnection.CreateDataChannel(label, nil)
+		if err != nil {
+			panic(err)
+		}
+
+		// With -rpc, create a datachannel with label 'rpc', the two processes
+		// call the functions of each other over it
+		if *withRPC {
+			rpcChannel, err := peerConnection.CreateDataChannel(rpc.Label, nil)
+			if err != nil {
+				panic(err)
+			}
+			serveRPC(rpcChannel)
+		}
+
+		// With -fragment, create a datachannel with label 'fragment', large
+		// messages are cut into fragments over it and reassembled by the
+		// answer process
+		if *withFragment {
+			fragmentChannel, err := peerConnection.CreateDataChannel(fragment.Label, nil)
+			if err != nil {
+				panic(err)
+			}
+			sendLarge(fragmentChannel)
+		}
+
+		// Register channel opening handling
+		dataChannel.OnOpen(func() {
+			if *sendFile != "" {
+				sendFileAndExit(dataChannel, *sendFile, quit)
+
+				return
+			}
+
+			fmt.Printf(
+				"Data channel '%s'-'%d' open. Random messages will now be sent to any connected DataChannels every 5 seconds\n",
+				dataChannel.Label(), dataChannel.ID(),
+			)
+
+			ticker := time.NewTicker(5 * time.Second)
+			defer ticker.Stop()
+			for range ticker.C {
+				message, sendTextErr := randutil.GenerateCryptoRandomString(
+					15, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
+				)
+				if sendTextErr != nil {
+					panic(sendTextErr)
+				}
+
+				// Send the message as text
+				fmt.Printf("Sending '%s'\n", message)
+				if sendTextErr = dataChannel.SendText(message); sendTextErr != nil {
+					panic(sendTextErr)
+				}
+			}
+		})
+
+		// Register text message handling
+		dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			fmt.Printf("Message from DataChannel '%s': '%s'\n", dataChannel.Label(), string(msg.Data))
+		})
+	}
+
+	// A lost connection is brought back with ICE restarts, sent to the answer
+	// process like the first offer. The data channel is kept meanwhile.
+	recovery := &icerecovery.Recovery{
+		Grace:       *iceGrace,
+		MaxRestarts: *iceRestarts,
+		Logf: func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		},
+		Restart: func() error {
+			if peerConnection.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+				// the last restart offer has not been answered, a new one
+				// would cross its answer
+				return nil
+			}
+
+			offer, err := peerConnection.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+			if err != nil {
+				return err
+			}
+
+			// The candidates of the new offer are of no use to the answer
+			// process before it has the offer
+			candidatesMux.Lock()
+			candidatesHeld = true
+			candidatesMux.Unlock()
+
+			if err = peerConnection.SetLocalDescription(offer); err != nil {
+				return err
+			}
+			if err = sendOffer(*answerAddr, offer); err != nil {
+				// Let the next attempt send a new offer
+				if rbErr := peerConnection.SetLocalDescription(
+					webrtc.SessionDescription{Type: webrtc.SDPTypeRollback},
+				); rbErr != nil {
+					fmt.Printf("cannot roll back ICE restart offer: %v\n", rbErr)
+				}
+
+				return err
+			}
+
+			return nil
+		},
+		GiveUp: func(reason string) {
+			fmt.Printf("Peer Connection did not come back, %s, exiting\n", reason)
+			quit(0)
+		},
 	}
 
 	// Set the handler for Peer connection state
@@ -132,52 +307,17 @@ func main() {
 	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		fmt.Printf("Peer Connection State has changed: %s\n", state.String())
 
-		if state == webrtc.PeerConnectionStateFailed {
-			// Wait until PeerConnection has had no network activity for 30 seconds or another failure.
-			// It may be reconnected using an ICE Restart.
-			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
-			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-			fmt.Println("Peer Connection has gone to failed exiting")
-			os.Exit(0)
-		}
+		// Disconnected and Failed are handled by recovery, the PeerConnection
+		// may come back from both with an ICE restart
+		recovery.OnConnectionStateChange(state)
 
 		if state == webrtc.PeerConnectionStateClosed {
 			// PeerConnection was explicitly closed. This usually happens from a DTLS CloseNotify
 			fmt.Println("Peer Connection has gone to closed exiting")
-			os.Exit(0)
+			quit(0)
 		}
 	})
 
-	// Register channel opening handling
-	dataChannel.OnOpen(func() {
-		fmt.Printf(
-			"Data channel '%s'-'%d' open. Random messages will now be sent to any connected DataChannels every 5 seconds\n",
-			dataChannel.Label(), dataChannel.ID(),
-		)
-
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
-		for range ticker.C {
-			message, sendTextErr := randutil.GenerateCryptoRandomString(
-				15, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ",
-			)
-			if sendTextErr != nil {
-				panic(sendTextErr)
-			}
-
-			// Send the message as text
-			fmt.Printf("Sending '%s'\n", message)
-			if sendTextErr = dataChannel.SendText(message); sendTextErr != nil {
-				panic(sendTextErr)
-			}
-		}
-	})
-
-	// Register text message handling
-	dataChannel.OnMessage(func(msg webrtc.DataChannelMessage) {
-		fmt.Printf("Message from DataChannel '%s': '%s'\n", dataChannel.Label(), string(msg.Data))
-	})
-
 	// Create an offer to send to the other process
 	offer, err := peerConnection.CreateOffer(nil)
 	if err != nil {
@@ -191,21 +331,36 @@ func main() {
 	}
 
 	// Send our offer to the HTTP server listening in the other process
-	payload, err := json.Marshal(offer)
-	if err != nil {
+	if err = sendOffer(*answerAddr, offer); err != nil {
 		panic(err)
 	}
-	resp, err := http.Post( //nolint:noctx
-		fmt.Sprintf("http://%s/sdp", *answerAddr),
-		"application/json; charset=utf-8",
-		bytes.NewReader(payload),
-	)
+
+	// Block until a callback ends the process
+	exitCode = <-exit
+}
+
+// sendFileAndExit sends path over dataChannel, then quits. A transfer cut
+// short by a lost connection resumes when the offer process is started again.
+func sendFileAndExit(dataChannel *webrtc.DataChannel, path string, quit func(code int)) {
+	fmt.Printf("Data channel '%s'-'%d' open. Sending %s\n", dataChannel.Label(), dataChannel.ID(), path)
+
+	err := filetransfer.Send(dataChannel, path, func(m filetransfer.Manifest, sent int64) {
+		fmt.Printf("Sent %d/%d bytes of %s (%.1f%%)\n", sent, m.Size, m.Name, percent(sent, m.Size))
+	})
 	if err != nil {
-		panic(err)
-	} else if err := resp.Body.Close(); err != nil {
-		panic(err)
+		fmt.Printf("Sending %s failed: %v\n", path, err)
+		quit(1)
+
+		return
+	}
+	fmt.Printf("%s received and verified exiting\n", path)
+	quit(0)
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 100
 	}
 
-	// Block forever
-	select {}
+	return float64(n) * 100 / float64(total)
 }
@@ -0,0 +1,105 @@
+// SPDX-FileCopyrightText: 2023 The Pion community <https://pion.ly>
+// SPDX-License-Identifier: MIT
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"pion-webrtc-example/pion-example/rpc"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// serveRPC serves the methods of the offer process over dataChannel, and
+// calls the methods of the answer process once it is open.
+func serveRPC(dataChannel *webrtc.DataChannel) {
+	peer := rpc.NewPeer(dataChannel)
+	peer.OnError(func(err error) {
+		fmt.Println(err)
+	})
+
+	peer.Handle("Hostname", func(context.Context, json.RawMessage) (interface{}, error) {
+		return os.Hostname()
+	})
+
+	dataChannel.OnOpen(func() {
+		fmt.Printf("Data channel '%s'-'%d' open. Calling the answer process\n", dataChannel.Label(), dataChannel.ID())
+		if err := callAnswer(peer); err != nil {
+			fmt.Printf("RPC failed: %v\n", err)
+		}
+	})
+}
+
+type echo struct {
+	Text string `json:"text"`
+}
+
+type countdown struct {
+	From     int           `json:"from"`
+	Interval time.Duration `json:"interval"`
+}
+
+type sleep struct {
+	Duration time.Duration `json:"duration"`
+}
+
+// callAnswer shows the kinds of calls: a plain one, a stream, one over its
+// deadline, one of a missing method and a stream canceled halfway.
+func callAnswer(peer *rpc.Peer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var reply echo
+	if err := peer.Call(ctx, "Echo", echo{Text: "hello from offer"}, &reply); err != nil {
+		return err
+	}
+	fmt.Printf("Echo: %q\n", reply.Text)
+
+	stream, err := peer.Stream(ctx, "Countdown", countdown{From: 3, Interval: 200 * time.Millisecond})
+	if err != nil {
+		return err
+	}
+	for {
+		var n int
+		if err := stream.Recv(&n); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		fmt.Printf("Countdown: %d\n", n)
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer shortCancel()
+	err = peer.Call(shortCtx, "Sleep", sleep{Duration: 2 * time.Second}, nil)
+	fmt.Printf("Sleep for 2s with a 500ms deadline: %v, deadline exceeded: %t\n", err, errors.Is(err, context.DeadlineExceeded))
+
+	err = peer.Call(ctx, "Missing", nil, nil)
+	var rpcErr *rpc.Error
+	if errors.As(err, &rpcErr) {
+		fmt.Printf("Missing: %v, not found: %t\n", err, rpcErr.Code == rpc.CodeNotFound)
+	}
+
+	stream, err = peer.Stream(ctx, "Countdown", countdown{From: 10, Interval: 200 * time.Millisecond})
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		var n int
+		if err := stream.Recv(&n); err != nil {
+			return err
+		}
+		fmt.Printf("Countdown: %d\n", n)
+	}
+	stream.Close()
+	fmt.Println("Countdown canceled")
+
+	return nil
+}
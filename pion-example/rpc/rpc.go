@@ -0,0 +1,573 @@
+// Package rpc calls functions of the other peer over a data channel. Both
+// ends are a Peer, which serves the methods registered with it and calls
+// the methods of the other end. A call carries its arguments and result as
+// JSON, its deadline, and may be canceled; a stream call gets any number of
+// results before the final reply. The results of a stream are flow
+// controlled: the callee sends at most StreamWindow of them ahead of the
+// caller, waiting for it to take them. Errors are returned as *Error, with
+// a code telling the kind of failure.
+//
+// Every frame is one text message on the data channel, so arguments and
+// results have to stay below the message size of the channel, 64 KiB
+// between pion peers. The channel must be ordered and reliable, which is
+// the default.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Label is the label of the data channels carrying calls.
+const Label = "rpc"
+
+// StreamWindow is the number of results a stream method may send before
+// the caller takes them.
+const StreamWindow = 32
+
+// error codes
+const (
+	CodeUnknown          = 1 // error of a handler without a code
+	CodeCanceled         = 2 // the caller canceled the call
+	CodeDeadlineExceeded = 3 // the deadline of the call passed
+	CodeNotFound         = 4 // no such method
+	CodeInvalidArgument  = 5 // the arguments do not decode
+	CodeInternal         = 6 // the handler panicked, or its result does not encode
+	CodeUnavailable      = 7 // the data channel is closed
+)
+
+// Error is the error of a call. Handlers return one to choose the code the
+// caller gets, other errors reach it with CodeUnknown.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Errorf returns an *Error with code.
+func Errorf(code int, format string, args ...interface{}) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc: %s (code %d)", e.Message, e.Code)
+}
+
+// Is matches the errors of package context to CodeCanceled and
+// CodeDeadlineExceeded, for errors.Is.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case context.Canceled:
+		return e.Code == CodeCanceled
+	case context.DeadlineExceeded:
+		return e.Code == CodeDeadlineExceeded
+	}
+	return false
+}
+
+// ErrClosed is returned by the calls over a closed data channel.
+var ErrClosed = &Error{Code: CodeUnavailable, Message: "data channel closed"}
+
+// fromContext returns the *Error for the error of a done context.
+func fromContext(err error) *Error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &Error{Code: CodeDeadlineExceeded, Message: err.Error()}
+	}
+	return &Error{Code: CodeCanceled, Message: err.Error()}
+}
+
+// Decode decodes the params of a call into v, for handlers. Its error
+// reaches the caller with CodeInvalidArgument.
+func Decode(params json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(params, v); err != nil {
+		return Errorf(CodeInvalidArgument, "decode params: %v", err)
+	}
+	return nil
+}
+
+// Handler serves a method, returning the result to encode as JSON.
+type Handler func(ctx context.Context, params json.RawMessage) (interface{}, error)
+
+// StreamHandler serves a stream method, calling send with every result.
+type StreamHandler func(ctx context.Context, params json.RawMessage, send func(v interface{}) error) error
+
+// types of the frames
+const (
+	typeCall   = "call"   // to the callee, Method, Timeout and the params in Data
+	typeCancel = "cancel" // to the callee
+	typeItem   = "item"   // to the caller, a result of a stream in Data
+	typeAck    = "ack"    // to the callee, Count results of a stream taken
+	typeReply  = "reply"  // to the caller, the result in Data or Error, the last frame of a call
+)
+
+type frame struct {
+	Type    string          `json:"type"`
+	ID      uint64          `json:"id"`
+	Method  string          `json:"method,omitempty"`
+	Timeout int64           `json:"timeout,omitempty"` // milliseconds, 0 for none
+	Count   int             `json:"count,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Peer is one end of the calls over a data channel.
+type Peer struct {
+	d *webrtc.DataChannel
+
+	wmu sync.Mutex // serializes the sends
+
+	mu       sync.Mutex
+	nextID   uint64
+	handlers map[string]Handler
+	streams  map[string]StreamHandler
+	calls    map[uint64]*call    // by id, our calls waiting for replies
+	serving  map[uint64]*serving // by id, the calls of the other end
+	onError  func(error)
+	closed   chan struct{}
+}
+
+// serving is a call of the other end being served.
+type serving struct {
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	window int           // results that may be sent before the next ack
+	acked  chan struct{} // signaled by acks
+}
+
+func (s *serving) ack(n int) {
+	s.mu.Lock()
+	s.window += n
+	s.mu.Unlock()
+	select {
+	case s.acked <- struct{}{}:
+	default:
+	}
+}
+
+// take waits until a result may be sent.
+func (s *serving) take(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		if s.window > 0 {
+			s.window--
+			s.mu.Unlock()
+			return nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.acked:
+		case <-ctx.Done():
+			return fromContext(ctx.Err())
+		}
+	}
+}
+
+// NewPeer makes a Peer of d. It takes over the OnMessage and OnClose
+// handlers of d. Calls may be made once d is open.
+func NewPeer(d *webrtc.DataChannel) *Peer {
+	p := &Peer{
+		d:        d,
+		handlers: make(map[string]Handler),
+		streams:  make(map[string]StreamHandler),
+		calls:    make(map[uint64]*call),
+		serving:  make(map[uint64]*serving),
+		closed:   make(chan struct{}),
+	}
+	d.OnMessage(p.receive)
+	d.OnClose(p.close)
+	return p
+}
+
+// Handle registers h for method.
+func (p *Peer) Handle(method string, h Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handlers[method] = h
+}
+
+// HandleStream registers h for the stream method method.
+func (p *Peer) HandleStream(method string, h StreamHandler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.streams[method] = h
+}
+
+// OnError sets the handler of the errors no call returns, like a reply or
+// a cancel that could not be sent.
+func (p *Peer) OnError(f func(err error)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onError = f
+}
+
+func (p *Peer) error(err error) {
+	p.mu.Lock()
+	f := p.onError
+	p.mu.Unlock()
+	if f != nil {
+		f(err)
+	}
+}
+
+// Done is closed once the data channel is.
+func (p *Peer) Done() <-chan struct{} {
+	return p.closed
+}
+
+func (p *Peer) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	select {
+	case <-p.closed:
+		return
+	default:
+	}
+	close(p.closed)
+	for _, s := range p.serving {
+		s.cancel()
+	}
+}
+
+func (p *Peer) send(f *frame) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	if err := p.d.SendText(string(b)); err != nil {
+		if errors.Is(err, io.ErrClosedPipe) {
+			return ErrClosed
+		}
+		return err
+	}
+	return nil
+}
+
+// receive handles a frame from the other end.
+func (p *Peer) receive(msg webrtc.DataChannelMessage) {
+	var f frame
+	if !msg.IsString || json.Unmarshal(msg.Data, &f) != nil {
+		return
+	}
+
+	switch f.Type {
+	case typeCall:
+		p.serve(&f)
+	case typeCancel, typeAck:
+		p.mu.Lock()
+		s := p.serving[f.ID]
+		p.mu.Unlock()
+		if s == nil {
+			return
+		}
+		if f.Type == typeCancel {
+			s.cancel()
+		} else {
+			s.ack(f.Count)
+		}
+	case typeItem, typeReply:
+		p.mu.Lock()
+		c := p.calls[f.ID]
+		if f.Type == typeReply {
+			delete(p.calls, f.ID)
+		}
+		p.mu.Unlock()
+		if c != nil {
+			c.push(&f)
+		}
+	}
+}
+
+// serve runs the handler of the call f.
+func (p *Peer) serve(f *frame) {
+	p.mu.Lock()
+	h := p.handlers[f.Method]
+	sh := p.streams[f.Method]
+	if h == nil && sh == nil {
+		p.mu.Unlock()
+		p.reply(f.ID, nil, Errorf(CodeNotFound, "no method %q", f.Method))
+		return
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if f.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), time.Duration(f.Timeout)*time.Millisecond)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	s := &serving{cancel: cancel, window: StreamWindow, acked: make(chan struct{}, 1)}
+	p.serving[f.ID] = s
+	p.mu.Unlock()
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			delete(p.serving, f.ID)
+			p.mu.Unlock()
+			cancel()
+		}()
+
+		var result interface{}
+		err := func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = Errorf(CodeInternal, "%s panicked: %v", f.Method, r)
+				}
+			}()
+			if h != nil {
+				result, err = h(ctx, f.Data)
+				return err
+			}
+			return sh(ctx, f.Data, func(v interface{}) error {
+				if err := ctx.Err(); err != nil {
+					return fromContext(err)
+				}
+				data, err := json.Marshal(v)
+				if err != nil {
+					return Errorf(CodeInternal, "encode result: %v", err)
+				}
+				if err := s.take(ctx); err != nil {
+					return err
+				}
+				return p.send(&frame{Type: typeItem, ID: f.ID, Data: data})
+			})
+		}()
+		p.reply(f.ID, result, err)
+	}()
+}
+
+// reply ends the call id with result, or with err.
+func (p *Peer) reply(id uint64, result interface{}, err error) {
+	f := &frame{Type: typeReply, ID: id}
+	if err != nil {
+		var e *Error
+		switch {
+		case errors.As(err, &e):
+		case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+			e = fromContext(err)
+		default:
+			e = &Error{Code: CodeUnknown, Message: err.Error()}
+		}
+		f.Error = e
+	} else if result != nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			f.Error = Errorf(CodeInternal, "encode result: %v", err)
+		}
+		f.Data = data
+	}
+	if err := p.send(f); err != nil && err != ErrClosed {
+		// the caller waits until its deadline
+		p.error(fmt.Errorf("rpc: cannot reply to call %d: %w", id, err))
+	}
+}
+
+// call is one of our calls, waiting for the frames of its results.
+type call struct {
+	p   *Peer
+	id  uint64
+	ctx context.Context
+
+	mu       sync.Mutex
+	items    []json.RawMessage
+	taken    int // results taken since the last ack
+	reply    *frame
+	canceled bool
+	notify   chan struct{}
+}
+
+func (c *call) push(f *frame) {
+	c.mu.Lock()
+	if f.Type == typeItem && len(c.items) >= StreamWindow {
+		// the other end ignores the window, end the call rather than
+		// buffer without bound
+		c.mu.Unlock()
+		c.cancel()
+		f = &frame{Type: typeReply, ID: c.id, Error: Errorf(CodeInternal, "more than %d results ahead", StreamWindow)}
+		c.mu.Lock()
+	}
+	if f.Type == typeItem {
+		c.items = append(c.items, f.Data)
+	} else {
+		c.reply = f
+	}
+	c.mu.Unlock()
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// start sends a call of method.
+func (p *Peer) start(ctx context.Context, method string, params interface{}) (*call, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fromContext(err)
+	}
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, Errorf(CodeInvalidArgument, "encode params: %v", err)
+	}
+
+	f := &frame{Type: typeCall, Method: method, Data: data}
+	if deadline, ok := ctx.Deadline(); ok {
+		// sent relative, the clocks of the peers may differ
+		f.Timeout = time.Until(deadline).Milliseconds()
+		if f.Timeout <= 0 {
+			return nil, fromContext(context.DeadlineExceeded)
+		}
+	}
+
+	p.mu.Lock()
+	p.nextID++
+	f.ID = p.nextID
+	c := &call{p: p, id: f.ID, ctx: ctx, notify: make(chan struct{}, 1)}
+	p.calls[f.ID] = c
+	p.mu.Unlock()
+
+	if err := p.send(f); err != nil {
+		c.forget()
+		return nil, err
+	}
+	return c, nil
+}
+
+// forget stops waiting for the call.
+func (c *call) forget() {
+	c.p.mu.Lock()
+	delete(c.p.calls, c.id)
+	c.p.mu.Unlock()
+}
+
+// cancel tells the other end to stop serving the call, unless it is over.
+func (c *call) cancel() {
+	c.forget()
+	c.mu.Lock()
+	over := c.reply != nil || c.canceled
+	c.canceled = true
+	c.mu.Unlock()
+	if over {
+		return
+	}
+	if err := c.p.send(&frame{Type: typeCancel, ID: c.id}); err != nil && err != ErrClosed {
+		c.p.error(fmt.Errorf("rpc: cannot cancel call %d: %w", c.id, err))
+	}
+}
+
+// ack lets the other end send n more results.
+func (c *call) ack(n int) {
+	if err := c.p.send(&frame{Type: typeAck, ID: c.id, Count: n}); err != nil && err != ErrClosed {
+		c.p.error(fmt.Errorf("rpc: cannot ack call %d: %w", c.id, err))
+	}
+}
+
+// next returns the next result of the call, or io.EOF after the last one.
+func (c *call) next() (json.RawMessage, error) {
+	for {
+		c.mu.Lock()
+		if len(c.items) > 0 {
+			item := c.items[0]
+			c.items = c.items[1:]
+			c.taken++
+			ack := 0
+			if c.taken >= StreamWindow/2 && c.reply == nil {
+				ack, c.taken = c.taken, 0
+			}
+			c.mu.Unlock()
+			if ack > 0 {
+				c.ack(ack)
+			}
+			return item, nil
+		}
+		reply := c.reply
+		c.mu.Unlock()
+
+		if reply != nil {
+			if reply.Error != nil {
+				return nil, reply.Error
+			}
+			return reply.Data, io.EOF
+		}
+
+		select {
+		case <-c.notify:
+		case <-c.ctx.Done():
+			c.cancel()
+			return nil, fromContext(c.ctx.Err())
+		case <-c.p.closed:
+			c.forget()
+			return nil, ErrClosed
+		}
+	}
+}
+
+// Call calls method of the other end with params and decodes its result
+// into result, which may be nil. The call is canceled, on both ends, when
+// ctx is done, and its deadline is the deadline of ctx.
+func (p *Peer) Call(ctx context.Context, method string, params, result interface{}) error {
+	c, err := p.start(ctx, method, params)
+	if err != nil {
+		return err
+	}
+
+	for {
+		data, err := c.next()
+		if err == nil {
+			// results of a stream method are skipped
+			continue
+		}
+		if err != io.EOF {
+			return err
+		}
+		if result == nil || len(data) == 0 {
+			return nil
+		}
+		if err := json.Unmarshal(data, result); err != nil {
+			return Errorf(CodeInvalidArgument, "decode result: %v", err)
+		}
+		return nil
+	}
+}
+
+// Stream is a call of a stream method.
+type Stream struct {
+	c *call
+}
+
+// Stream calls the stream method method of the other end with params. The
+// call is canceled when ctx is done, or by Close.
+func (p *Peer) Stream(ctx context.Context, method string, params interface{}) (*Stream, error) {
+	c, err := p.start(ctx, method, params)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{c: c}, nil
+}
+
+// Recv decodes the next result into v. It returns io.EOF once the stream
+// is over, or the error that ended it.
+func (s *Stream) Recv(v interface{}) error {
+	data, err := s.c.next()
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return Errorf(CodeInvalidArgument, "decode result: %v", err)
+	}
+	return nil
+}
+
+// Close cancels the call unless it is over.
+func (s *Stream) Close() {
+	s.c.cancel()
+}
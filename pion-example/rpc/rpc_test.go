@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pion-webrtc-example/pion-example/internal/dctest"
+)
+
+// newPair returns two Peers over an open data channel between two
+// PeerConnections of this process.
+func newPair(t *testing.T) (*Peer, *Peer) {
+	t.Helper()
+	local, remote := dctest.Pair(t, nil, Label)
+	return NewPeer(local), NewPeer(remote)
+}
+
+func TestStreamWindow(t *testing.T) {
+	caller, callee := newPair(t)
+	const total = 4 * StreamWindow
+	var sent atomic.Int32
+	callee.HandleStream("Count", func(ctx context.Context, _ json.RawMessage, send func(v interface{}) error) error {
+		for i := 0; i < total; i++ {
+			if err := send(i); err != nil {
+				return err
+			}
+			sent.Add(1)
+		}
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	stream, err := caller.Stream(ctx, "Count", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing taken, the callee stops at the window
+	time.Sleep(200 * time.Millisecond)
+	if n := sent.Load(); n != StreamWindow {
+		t.Fatalf("%d results sent before any was taken, want %d", n, StreamWindow)
+	}
+
+	for i := 0; ; i++ {
+		var n int
+		err := stream.Recv(&n)
+		if errors.Is(err, io.EOF) {
+			if i != total {
+				t.Fatalf("stream over after %d results, want %d", i, total)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != i {
+			t.Fatalf("got result %d, want %d", n, i)
+		}
+	}
+}
+
+func TestCallAndCancel(t *testing.T) {
+	caller, callee := newPair(t)
+	callee.Handle("Echo", func(_ context.Context, params json.RawMessage) (interface{}, error) {
+		var s string
+		if err := Decode(params, &s); err != nil {
+			return nil, err
+		}
+		return s, nil
+	})
+	canceled := make(chan struct{})
+	callee.Handle("Block", func(ctx context.Context, _ json.RawMessage) (interface{}, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, ctx.Err()
+	})
+
+	var got string
+	if err := caller.Call(context.Background(), "Echo", "hello", &got); err != nil || got != "hello" {
+		t.Fatalf("Echo = %q, %v", got, err)
+	}
+	var e *Error
+	if err := caller.Call(context.Background(), "Missing", nil, nil); !errors.As(err, &e) || e.Code != CodeNotFound {
+		t.Fatalf("call of a missing method = %v, want CodeNotFound", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := caller.Call(ctx, "Block", nil, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Block = %v, want DeadlineExceeded", err)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not canceled")
+	}
+}
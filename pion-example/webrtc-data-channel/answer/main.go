@@ -1,303 +1,372 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
-	"net/url"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/bigwhite/webrtc/filetransfer"
+	"github.com/bigwhite/webrtc/signaling/client"
 	"github.com/bigwhite/webrtc/signaling/proto"
-	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 )
 
-func signalCandidate(wc *websocket.Conn, source, target string, c *webrtc.ICECandidate) error {
-	payload := []byte(c.ToJSON().Candidate)
+var signalingAddr *string
+var id *string
+var maxSessions *int
+var timeout *time.Duration
+var codecs *string
+var iceGrace *time.Duration
+var iceRestarts *int
+var recvDir *string
+
+// version is advertised to the offer peers, set it with
+// -ldflags "-X main.version=..."
+var version = "dev"
+
+// Prepare the configuration
+var config = webrtc.Configuration{
+	ICEServers: []webrtc.ICEServer{
+		{
+			//URLs: []string{"stun:stun.l.google.com:19302"},
+			URLs: []string{"stun:74.125.137.127:19302"},
+		},
+	},
+}
 
-	var req = proto.Request{
-		SourceID: source,
-		TargetID: target,
-		Body:     payload,
-	}
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+	signalingAddr = flag.String("signaling-address", "localhost:18080", "address that the signaling server is hosted on.")
+	id = flag.String("id", "answer-peer-1", "unique id of the answer peer")
+	timeout = flag.Duration("timeout", 5*time.Second, "how long to wait for the response to a signaling request")
+	iceGrace = flag.Duration("ice-grace", 5*time.Second, "how long a disconnected or restarted connection gets to come back")
+	iceRestarts = flag.Int("ice-restarts", 3, "ICE restarts of the offer peer to wait for before hanging up")
+	codecs = flag.String("codecs", strings.Join(proto.Codecs(), ","), "signaling codecs offered to the server, preferred first")
+	recvDir = flag.String("recv-dir", "", "directory to save the files sent by the offer peers into, files are refused if empty")
+	maxSessions = flag.Int("max-sessions", 16, "max number of offer peers served at the same time, 0 for no limit")
+	flag.Parse()
 
-	reqData, err := req.ToJSON()
+	// communicate with the signaling server
+	log.Printf("answer: connecting to %s", *signalingAddr)
+	cl, err := client.Dial(*signalingAddr, client.AnswerPath)
 	if err != nil {
-		return err
+		log.Fatalf("answer: dial %s error: %v", *signalingAddr, err)
 	}
+	cl.Timeout = *timeout
+	cl.Codecs = strings.Split(*codecs, ",")
+	cl.Capabilities = proto.Capabilities{
+		Labels:  []string{"data"},
+		Version: version,
+	}
+	if *recvDir != "" {
+		cl.Capabilities.Labels = append(cl.Capabilities.Labels, filetransfer.Label)
+	}
+	defer cl.Close()
+
+	sessions := newSessionTable(cl)
+	defer sessions.closeAll("shutting down", true)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		log.Println("answer: interrupted")
+		sessions.closeAll("shutting down", true)
+		cl.Close()
+	}()
 
-	var message = proto.Message{
-		Cmd:     proto.CmdCandidate,
-		Payload: reqData,
+	if err := cl.Register(*id); err != nil {
+		log.Fatalln("answer: register error:", err)
 	}
+	log.Println("answer: registered as", *id)
 
-	messageData, err := message.ToJSON()
-	if err != nil {
-		return err
+	// answer event loop
+	for e := range cl.Events() {
+		switch e.Type {
+		case client.EventOffer:
+			log.Printf("answer: recv offer message from %s\n", e.Source)
+
+			sess, err := sessions.open(e.Source)
+			if err != nil {
+				log.Printf("answer: refuse offer from %s: %v\n", e.Source, err)
+				// tell the offer peer
+				go sendBye(cl, e.Source, err.Error())
+				continue
+			}
+
+			// handle offer message
+			err = sess.handleOffer(e.SDP)
+			if err != nil {
+				log.Printf("answer: handle offer message from %s error: %v\n", e.Source, err)
+				go sess.close("bad offer", true)
+			}
+		case client.EventBye:
+			if sess := sessions.find(e.Source); sess != nil {
+				// closing the PeerConnection takes a while
+				go sess.close(e.Source+" hung up", false)
+			}
+		case client.EventCandidate:
+			log.Printf("answer: recv candidate message from %s\n", e.Source)
+
+			sess := sessions.find(e.Source)
+			if sess == nil {
+				log.Printf("answer: no session with %s for candidate\n", e.Source)
+				continue
+			}
+			if e.Candidate.Candidate == "" {
+				log.Printf("answer: end of candidates from %s\n", e.Source)
+			}
+
+			// an empty candidate marks the end of candidates for AddICECandidate too
+			err = sess.candidates.Add(sess.pc, e.Candidate)
+			if err != nil {
+				log.Printf("answer: handle candidate message from %s error: %v\n", e.Source, err)
+			}
+		case client.EventReconnected:
+			// the signaling server told the offer peers that we left
+			sessions.closeAll("signaling connection lost", false)
+		}
 	}
+}
 
-	wcMu.Lock()
-	defer wcMu.Unlock()
-	return wc.WriteMessage(websocket.BinaryMessage, messageData)
+// sendBye tells target that its session is over. reason is optional.
+func sendBye(cl *client.Client, target, reason string) {
+	if err := cl.SendBye(target, reason); err != nil {
+		log.Printf("answer: send bye to %s error: %v\n", target, err)
+	}
 }
 
-var signalingAddr *string
-var id *string
-var target string
-var wcMu sync.Mutex // sync the access for websocket.Conn
+// session is the PeerConnection with one offer peer.
+type session struct {
+	cl         *client.Client
+	source     string // id of the offer peer
+	pc         *webrtc.PeerConnection
+	sessions   *sessionTable
+	candidates client.CandidateBuffer // remote candidates
 
-func main() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
-	signalingAddr = flag.String("signaling-address", "localhost:18080", "address that the signaling server is hosted on.")
-	id = flag.String("id", "answer-peer-1", "unique id of the answer peer")
-	flag.Parse()
+	closeOnce sync.Once
+}
 
-	var wc *websocket.Conn
-	var err error
+// sessionTable holds the sessions by the id of their offer peer.
+type sessionTable struct {
+	cl *client.Client
+	mu sync.Mutex
+	m  map[string]*session
+}
 
-	var candidatesMux sync.Mutex
-	pendingCandidates := make([]*webrtc.ICECandidate, 0)
+func newSessionTable(cl *client.Client) *sessionTable {
+	return &sessionTable{cl: cl, m: make(map[string]*session)}
+}
 
-	// Prepare the configuration
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				//URLs: []string{"stun:stun.l.google.com:19302"},
-				URLs: []string{"stun:74.125.137.127:19302"},
-			},
-		},
+func (st *sessionTable) find(source string) *session {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.m[source]
+}
+
+// open returns the session with source, creating it unless -max-sessions
+// are open already.
+func (st *sessionTable) open(source string) (*session, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if sess, ok := st.m[source]; ok {
+		return sess, nil
+	}
+	if *maxSessions > 0 && len(st.m) >= *maxSessions {
+		return nil, fmt.Errorf("too many sessions (%d)", len(st.m))
+	}
+
+	sess, err := newSession(st, source)
+	if err != nil {
+		return nil, err
 	}
+	st.m[source] = sess
+	log.Printf("answer: open session with %s (%d open)\n", source, len(st.m))
+	return sess, nil
+}
 
+func (st *sessionTable) remove(sess *session) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.m[sess.source] == sess {
+		delete(st.m, sess.source)
+	}
+}
+
+// closeAll hangs up every session, sending byes if bye is set.
+func (st *sessionTable) closeAll(reason string, bye bool) {
+	st.mu.Lock()
+	all := make([]*session, 0, len(st.m))
+	for _, sess := range st.m {
+		all = append(all, sess)
+	}
+	st.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, sess := range all {
+		wg.Add(1)
+		go func(sess *session) {
+			defer wg.Done()
+			sess.close(reason, bye)
+		}(sess)
+	}
+	wg.Wait()
+}
+
+func newSession(st *sessionTable, source string) (*session, error) {
 	// Create a new RTCPeerConnection
 	peerConnection, err := webrtc.NewPeerConnection(config)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	log.Printf("answer: NewPeerConnection for %s ok\n", source)
+
+	sess := &session{
+		cl:       st.cl,
+		source:   source,
+		pc:       peerConnection,
+		sessions: st,
 	}
-	defer func() {
-		if err := peerConnection.Close(); err != nil {
-			log.Printf("answer: cannot close peerConnection: %v\n", err)
-		}
-	}()
-	log.Println("answer: NewPeerConnection ok")
 
 	// When an ICE candidate is available send to the other Pion instance
 	// the other Pion instance will add this candidate by calling AddICECandidate
 	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
-			return
+			log.Printf("answer: candidate gathering for %s complete\n", source)
+		} else {
+			log.Printf("answer: invoke peerConnection.OnICECandidate for %s: %s\n", source, c)
 		}
-		log.Printf("answer: invoke peerConnection.OnICECandidate: %s\n", c.Address)
-
-		candidatesMux.Lock()
-		defer candidatesMux.Unlock()
 
-		desc := peerConnection.RemoteDescription()
-		if desc == nil {
-			pendingCandidates = append(pendingCandidates, c)
-		} else if onICECandidateErr := signalCandidate(wc, *id, target, c); onICECandidateErr != nil {
-			panic(onICECandidateErr)
+		if onICECandidateErr := sess.cl.SendCandidate(source, c); onICECandidateErr != nil {
+			log.Printf("answer: signal candidate %s error: %v\n", c, onICECandidateErr)
 		}
 	})
 
+	// the offer peer restarts ICE when the connection is lost, its restart
+	// offers are handled like the first one. One more round is waited for
+	// than it tries, since it starts after us.
+	recovery := &client.Recovery{
+		Grace:       *iceGrace,
+		MaxRestarts: *iceRestarts + 1,
+		Logf:        client.Logf,
+		GiveUp: func(reason string) {
+			go sess.close(reason, true)
+		},
+	}
+
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		log.Printf("answer: Peer Connection State has changed: %s\n", s.String())
-
-		if s == webrtc.PeerConnectionStateFailed {
-			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
-			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
-			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-			log.Println("answer: Peer Connection has gone to failed exiting")
-			os.Exit(0)
-		}
+		log.Printf("answer: Peer Connection State with %s has changed: %s\n", source, s.String())
+
+		// Disconnected and Failed are handled by recovery
+		recovery.OnConnectionStateChange(s)
 
 		if s == webrtc.PeerConnectionStateClosed {
 			// PeerConnection was explicitly closed. This usually happens from a DTLS CloseNotify
-			log.Println("answer: Peer Connection has gone to closed exiting")
-			os.Exit(0)
+			go sess.close("Peer Connection has gone to closed", true)
 		}
 	})
 
+	// files are received over the data channels labeled 'file', the part
+	// of a file received before the session was lost is kept in -recv-dir
+	// for the offer peer to resume
+	receiver := &filetransfer.Receiver{
+		Dir: *recvDir,
+		Progress: func(m filetransfer.Manifest, received int64) {
+			log.Printf("answer: received %d/%d bytes of %s from %s (%.1f%%)\n", received, m.Size, m.Name, source, percent(received, m.Size))
+		},
+		Done: func(m filetransfer.Manifest, path string, err error) {
+			if err != nil {
+				log.Printf("answer: receive %s from %s error: %v\n", m.Name, source, err)
+				return
+			}
+			log.Printf("answer: saved %s from %s, sha256 %s verified\n", path, source, m.SHA256)
+		},
+	}
+
 	// Register data channel creation handling
 	peerConnection.OnDataChannel(func(d *webrtc.DataChannel) {
-		log.Printf("answer: New DataChannel %s %d\n", d.Label(), d.ID())
+		log.Printf("answer: New DataChannel %s %d from %s\n", d.Label(), d.ID(), source)
+
+		if d.Label() == filetransfer.Label {
+			if *recvDir == "" {
+				log.Printf("answer: refuse file from %s, run with -recv-dir to receive files\n", source)
+				if err := d.Close(); err != nil {
+					log.Printf("answer: cannot close DataChannel of %s: %v\n", source, err)
+				}
+				return
+			}
+			receiver.Receive(d)
+			return
+		}
 
 		// Register channel opening handling
 		d.OnOpen(func() {
-			log.Printf("answer: Data channel '%s'-'%d' open. Random messages will now be sent to any connected DataChannels every 5 seconds\n", d.Label(), d.ID())
+			log.Printf("answer: Data channel '%s'-'%d' with %s open. Random messages will now be sent to any connected DataChannels every 5 seconds\n", d.Label(), d.ID(), source)
 
 			for range time.NewTicker(5 * time.Second).C {
 				message := fmt.Sprintf("answer-%d", rand.Int31()) //signal.RandSeq(15)
-				log.Printf("answer: Sending '%s'\n", message)
+				log.Printf("answer: Sending '%s' to %s\n", message, source)
 
 				// Send the message as text
 				sendTextErr := d.SendText(message)
 				if sendTextErr != nil {
-					panic(sendTextErr)
+					log.Printf("answer: stop sending to %s: %v\n", source, sendTextErr)
+					return
 				}
 			}
 		})
 
 		// Register text message handling
 		d.OnMessage(func(msg webrtc.DataChannelMessage) {
-			log.Printf("answer: message from DataChannel '%s': '%s'\n", d.Label(), string(msg.Data))
+			log.Printf("answer: message from DataChannel '%s' of %s: '%s'\n", d.Label(), source, string(msg.Data))
 		})
 	})
 
-	// communicate with the signaling server
-	u := url.URL{Scheme: "ws", Host: *signalingAddr, Path: "/register"}
-	log.Printf("answer: connecting to %s", u.String())
-
-	wc, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Fatalf("answer: dial %s error: %v", u.String(), err)
-	}
-	defer wc.Close()
-
-	// send register message
-	var req = proto.Request{
-		SourceID: *id,
-	}
-
-	var am = proto.Message{
-		Cmd: proto.CmdInit,
-	}
-
-	payload, err := req.ToJSON()
-	if err != nil {
-		log.Fatalf("answer: request payload marshal error: %v", err)
-	}
-	am.Payload = payload
-
-	message, err := am.ToJSON()
-	if err != nil {
-		log.Fatalf("answer: message marshal error: %v", err)
-	}
+	return sess, nil
+}
 
-	wcMu.Lock()
-	err = wc.WriteMessage(websocket.BinaryMessage, message)
-	if err != nil {
-		wcMu.Unlock()
-		log.Fatalln("answer: write message error:", err)
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 100
 	}
-	wcMu.Unlock()
-
-	// answer event loop
-	for {
-		// read message from signaling
-		_, data, err := wc.ReadMessage()
-		if err != nil {
-			log.Println("answer: read message error:", err)
-			return
-		}
-
-		var message proto.Message
-		err = message.FromJSON(data)
-		if err != nil {
-			log.Println("answer: message unmarshal error:", err)
-			return
-		}
+	return float64(n) * 100 / float64(total)
+}
 
-		var req proto.Request
-		err = req.FromJSON(message.Payload)
-		if err != nil {
-			log.Println("answer: unmarshal request error:", err)
-			return
+// close ends the session: the offer peer is sent a bye unless it has hung
+// up itself, then the PeerConnection is closed. Only the first call has an
+// effect.
+func (sess *session) close(reason string, bye bool) {
+	sess.closeOnce.Do(func() {
+		log.Printf("answer: hang up %s: %s\n", sess.source, reason)
+		sess.sessions.remove(sess)
+		if bye {
+			sendBye(sess.cl, sess.source, "")
 		}
-
-		switch message.Cmd {
-		case proto.CmdOffer:
-			if req.TargetID != *id {
-				log.Printf("answer: the target id[%s] of offer request is not me", req.TargetID)
-				continue
-			}
-
-			log.Printf("answer: recv offer message from %s\n", req.SourceID)
-			target = req.SourceID
-
-			// return response
-			err = returnResp(wc, proto.CmdOfferResp, &proto.Response{
-				Code: 0,
-				Msg:  "ok",
-			})
-
-			// handle offer message
-			err = handleOffer(wc, peerConnection, &req)
-			if err != nil {
-				log.Println("answer: handle offer message error:", err)
-				return
-			}
-		case proto.CmdCandidate:
-			if req.TargetID != *id {
-				log.Printf("answer: the target id[%s] of candidate request is not me", req.TargetID)
-				continue
-			}
-			log.Printf("answer: recv candidate message from %s\n", req.SourceID)
-
-			// return response
-			err = returnResp(wc, proto.CmdCandidateResp, &proto.Response{
-				Code: 0,
-				Msg:  "ok",
-			})
-
-			// handle candidate message
-			err = handleCandidate(wc, peerConnection, &req)
-			if err != nil {
-				log.Println("answer: handle candidate message error:", err)
-				return
-			}
-
-		case proto.CmdInitResp, proto.CmdCandidateResp, proto.CmdAnswerResp:
-			// get response
-			resp := proto.Response{}
-			err = resp.FromJSON(message.Payload)
-			if err != nil {
-				log.Fatalln("answer: unmarshal resp message error:", err)
-			}
-
-			log.Printf("answer: recv resp[%d]: %#v\n", message.Cmd, resp)
+		if err := sess.pc.Close(); err != nil {
+			log.Printf("answer: cannot close peerConnection with %s: %v\n", sess.source, err)
 		}
-	}
-}
-
-func returnResp(c *websocket.Conn, cmd int, resp *proto.Response) error {
-	b, err := resp.ToJSON()
-	if err != nil {
-		return err
-	}
-
-	var message = proto.Message{
-		Cmd:     cmd,
-		Payload: b,
-	}
-
-	data, err := message.ToJSON()
-	if err != nil {
-		return err
-	}
-
-	wcMu.Lock()
-	defer wcMu.Unlock()
-	return c.WriteMessage(websocket.BinaryMessage, data)
+	})
 }
 
-func handleOffer(c *websocket.Conn, peerConnection *webrtc.PeerConnection, req *proto.Request) error {
-	sdp := webrtc.SessionDescription{}
-	if err := json.NewDecoder(bytes.NewReader(req.Body)).Decode(&sdp); err != nil {
-		return err
-	}
+// handleOffer answers the offer sdp.
+func (sess *session) handleOffer(sdp webrtc.SessionDescription) error {
+	peerConnection := sess.pc
 
 	if err := peerConnection.SetRemoteDescription(sdp); err != nil {
 		log.Println("answer: set remote description error:", err)
 		return err
 	}
+	if err := sess.candidates.Flush(peerConnection); err != nil {
+		return err
+	}
 
 	// Create an answer to send to the other process
 	answer, err := peerConnection.CreateAnswer(nil)
@@ -306,68 +375,21 @@ func handleOffer(c *websocket.Conn, peerConnection *webrtc.PeerConnection, req *
 		return err
 	}
 
-	// Send our answer to the signaling server
-	payload, err := json.Marshal(answer)
-	if err != nil {
+	// Sets the LocalDescription, and starts our UDP listeners. The
+	// candidates gathered meanwhile are held by the offer peer until it has
+	// the answer.
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		log.Println("answer: set local desc error:", err)
 		return err
 	}
+	log.Println("answer: set local desc")
 
-	var answerReq = proto.Request{
-		SourceID: req.TargetID,
-		TargetID: req.SourceID,
-		Body:     payload,
-	}
-
-	answerReqData, err := answerReq.ToJSON()
-	if err != nil {
-		return err
-	}
-
-	var message = proto.Message{
-		Cmd:     proto.CmdAnswer,
-		Payload: answerReqData,
-	}
-
-	data, err := message.ToJSON()
-	if err != nil {
-		return err
-	}
-
-	wcMu.Lock()
-	err = c.WriteMessage(websocket.BinaryMessage, data)
-	if err != nil {
-		wcMu.Unlock()
-		log.Println("answer: write answer error: ", err)
-		return err
-	}
-	wcMu.Unlock()
-
-	log.Println("answer: send sdp answer")
-
-	go func() {
-		//time.Sleep(5 * time.Second)
-		// Sets the LocalDescription, and starts our UDP listeners
-		//
-		// trigger communication with ice
-		err = peerConnection.SetLocalDescription(answer)
-		log.Println("answer: set local desc")
-		if err != nil {
-			log.Println("answer: set local desc error:", err)
-			//return err
-		}
-	}()
-
-	return nil
-}
-
-func handleCandidate(c *websocket.Conn, peerConnection *webrtc.PeerConnection, req *proto.Request) error {
-	candidate, candidateErr := io.ReadAll(bytes.NewReader(req.Body))
-	if candidateErr != nil {
-		panic(candidateErr)
-	}
-	if candidateErr := peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: string(candidate)}); candidateErr != nil {
-		return candidateErr
+	// Send our answer to the signaling server
+	if err := sess.cl.SendAnswer(sess.source, answer); err != nil {
+		log.Printf("answer: send answer to %s error: %v\n", sess.source, err)
+		go sess.close("answer not delivered", false)
+		return nil
 	}
-
+	log.Printf("answer: send sdp answer to %s\n", sess.source)
 	return nil
 }
@@ -0,0 +1,445 @@
+// Package filetransfer moves a file over a data channel. The sender opens
+// with a manifest of the file (name, size and SHA-256), the receiver answers
+// with the offset to resume from, then the file follows in binary chunks and
+// the receiver reports whether the SHA-256 matched. A partially received
+// file is kept, so a transfer over a new data channel, e.g. after a
+// reconnection, resumes where the last one stopped.
+//
+// This module builds on its own, so the package is a copy of the
+// filetransfer package of the pion-example programs; keep them in step.
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Label is the label of the data channels carrying files.
+const Label = "file"
+
+// ChunkSize is the size of the binary messages. It is below the message
+// size every data channel implementation accepts.
+const ChunkSize = 16 << 10
+
+// flow control of the sender: sending waits once maxBufferedAmount bytes
+// are queued, until the queue drains below bufferedAmountLowThreshold
+const (
+	bufferedAmountLowThreshold = 256 << 10
+	maxBufferedAmount          = 1 << 20
+)
+
+// progressInterval is how often progress is reported.
+const progressInterval = time.Second
+
+// ErrClosed ends a transfer whose data channel closes before the receiver
+// has verified the file.
+var ErrClosed = errors.New("filetransfer: data channel closed")
+
+// Manifest describes the file being sent.
+type Manifest struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"` // hex
+}
+
+// types of the control messages, sent as text
+const (
+	typeManifest = "manifest" // to the receiver, before the chunks
+	typeResume   = "resume"   // to the sender, with the offset to send from
+	typeDone     = "done"     // to the sender, with an error unless verified
+)
+
+type message struct {
+	Type     string    `json:"type"`
+	Manifest *Manifest `json:"manifest,omitempty"`
+	Offset   int64     `json:"offset"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func sendMessage(d *webrtc.DataChannel, m message) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return closedErr(d.SendText(string(b)))
+}
+
+// closedErr turns the error of sending over a closed data channel into
+// ErrClosed.
+func closedErr(err error) error {
+	if errors.Is(err, io.ErrClosedPipe) {
+		return ErrClosed
+	}
+	return err
+}
+
+// NewManifest hashes the file at path.
+func NewManifest(path string) (*Manifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{
+		Name:   filepath.Base(path),
+		Size:   n,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// reporter calls fn at most every progressInterval, and always once done.
+type reporter struct {
+	fn   func(m Manifest, n int64)
+	m    Manifest
+	last time.Time
+}
+
+func (p *reporter) report(n int64) {
+	if p.fn == nil {
+		return
+	}
+	if now := time.Now(); n == p.m.Size || now.Sub(p.last) >= progressInterval {
+		p.last = now
+		p.fn(p.m, n)
+	}
+}
+
+// Send sends the file at path over d, which must be open, and returns once
+// the receiver has verified it. progress, which may be nil, is called with
+// the bytes sent so far. Send takes over the OnMessage, OnClose and
+// OnBufferedAmountLow handlers of d.
+func Send(d *webrtc.DataChannel, path string, progress func(m Manifest, sent int64)) error {
+	m, err := NewManifest(path)
+	if err != nil {
+		return err
+	}
+
+	replies := make(chan message, 1)
+	closed := make(chan struct{})
+	more := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var reply message
+		if !msg.IsString || json.Unmarshal(msg.Data, &reply) != nil {
+			return
+		}
+		select {
+		case replies <- reply:
+		case <-closed:
+		case <-stop:
+		}
+	})
+	d.OnClose(func() {
+		close(closed)
+	})
+	d.SetBufferedAmountLowThreshold(bufferedAmountLowThreshold)
+	d.OnBufferedAmountLow(func() {
+		select {
+		case more <- struct{}{}:
+		default:
+		}
+	})
+
+	wait := func() (message, error) {
+		select {
+		case reply := <-replies:
+			if reply.Type == typeDone && reply.Error != "" {
+				return reply, fmt.Errorf("filetransfer: %s", reply.Error)
+			}
+			return reply, nil
+		case <-closed:
+			return message{}, ErrClosed
+		}
+	}
+
+	if err := sendMessage(d, message{Type: typeManifest, Manifest: m}); err != nil {
+		return err
+	}
+	reply, err := wait()
+	if err != nil {
+		return err
+	}
+	if reply.Type != typeResume || reply.Offset < 0 || reply.Offset > m.Size {
+		return fmt.Errorf("filetransfer: unexpected reply %q at offset %d", reply.Type, reply.Offset)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Seek(reply.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	p := reporter{fn: progress, m: *m}
+	sent := reply.Offset
+	p.report(sent)
+	buf := make([]byte, ChunkSize)
+	for sent < m.Size {
+		n := int64(len(buf))
+		if rest := m.Size - sent; rest < n {
+			n = rest
+		}
+		if _, err := io.ReadFull(f, buf[:n]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("filetransfer: %s changed while sending", path)
+		} else if err != nil {
+			return err
+		}
+
+		for d.BufferedAmount() > maxBufferedAmount {
+			select {
+			case <-more:
+			case <-closed:
+				return ErrClosed
+			}
+		}
+		if err := d.Send(buf[:n]); err != nil {
+			return closedErr(err)
+		}
+		sent += n
+		p.report(sent)
+	}
+
+	reply, err = wait()
+	if err != nil {
+		return err
+	}
+	if reply.Type != typeDone {
+		return fmt.Errorf("filetransfer: unexpected reply %q", reply.Type)
+	}
+	return nil
+}
+
+// Receiver saves the files sent over data channels into Dir. A file is
+// received into a .part file next to it, which is renamed once its SHA-256
+// has been verified. An existing file is never overwritten, the received
+// one gets a new name instead.
+type Receiver struct {
+	Dir string
+
+	// Progress is called with the bytes received so far, starting with the
+	// offset the transfer resumes from. It may be nil.
+	Progress func(m Manifest, received int64)
+	// Done is called once a transfer is over, with the path the file was
+	// saved to, or with the error that ended it. It may be nil.
+	Done func(m Manifest, path string, err error)
+}
+
+// receiving is a transfer in progress over one data channel.
+type receiving struct {
+	m        Manifest
+	part     string
+	f        *os.File
+	received int64
+	progress reporter
+}
+
+// Receive receives the files sent over d, one after the other. It takes
+// over the OnMessage and OnClose handlers of d.
+func (r *Receiver) Receive(d *webrtc.DataChannel) {
+	// messages are delivered one at a time, in order, mu guards cur
+	// against OnClose
+	var mu sync.Mutex
+	var cur *receiving
+
+	// end finishes the current transfer, telling the sender unless the
+	// data channel is closed
+	end := func(path string, err error, reply bool) {
+		if cur.f != nil {
+			cur.f.Close()
+		}
+		if r.Done != nil {
+			r.Done(cur.m, path, err)
+		}
+		if reply {
+			done := message{Type: typeDone}
+			if err != nil {
+				done.Error = err.Error()
+			}
+			// the sender gets ErrClosed if the reply is lost
+			_ = sendMessage(d, done)
+		}
+		cur = nil
+	}
+
+	d.OnMessage(func(msg webrtc.DataChannelMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !msg.IsString {
+			if cur == nil {
+				return
+			}
+			if err := cur.write(msg.Data); err != nil {
+				end("", err, true)
+				return
+			}
+			if cur.received == cur.m.Size {
+				path, err := cur.finish(r.Dir)
+				end(path, err, true)
+			}
+			return
+		}
+
+		var m message
+		if err := json.Unmarshal(msg.Data, &m); err != nil || m.Type != typeManifest || m.Manifest == nil {
+			return
+		}
+		if cur != nil {
+			end("", errors.New("filetransfer: interrupted by a new file"), false)
+		}
+		cur = &receiving{m: *m.Manifest}
+		if err := cur.open(r.Dir); err != nil {
+			end("", err, true)
+			return
+		}
+		cur.progress = reporter{fn: r.Progress, m: cur.m}
+		cur.progress.report(cur.received)
+		if err := sendMessage(d, message{Type: typeResume, Offset: cur.received}); err != nil {
+			end("", err, false)
+			return
+		}
+		if cur.received == cur.m.Size {
+			// complete before, but not verified
+			path, err := cur.finish(r.Dir)
+			end(path, err, true)
+		}
+	})
+	d.OnClose(func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if cur != nil {
+			end("", ErrClosed, false)
+		}
+	})
+}
+
+// open opens the .part file of the manifest, keeping what it holds already.
+func (rc *receiving) open(dir string) error {
+	name := rc.m.Name
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return fmt.Errorf("filetransfer: invalid file name %q", name)
+	}
+	if rc.m.Size < 0 || !validSHA256(rc.m.SHA256) {
+		return fmt.Errorf("filetransfer: invalid manifest for %q", name)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	// the hash in the name keeps apart the parts of different files
+	// sent under the same name
+	rc.part = filepath.Join(dir, fmt.Sprintf("%s.%s.part", name, rc.m.SHA256[:12]))
+	f, err := os.OpenFile(rc.part, os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	rc.f = f
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	rc.received = fi.Size()
+	if rc.received > rc.m.Size {
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		rc.received = 0
+	}
+	_, err = f.Seek(rc.received, io.SeekStart)
+	return err
+}
+
+// validSHA256 tells whether s is a SHA-256 in lowercase hex, as NewManifest
+// writes it. Part of it goes into the name of the .part file.
+func validSHA256(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size && s == strings.ToLower(s)
+}
+
+func (rc *receiving) write(b []byte) error {
+	if rc.received+int64(len(b)) > rc.m.Size {
+		return fmt.Errorf("filetransfer: more than the %d bytes of %q", rc.m.Size, rc.m.Name)
+	}
+	if _, err := rc.f.Write(b); err != nil {
+		return err
+	}
+	rc.received += int64(len(b))
+	rc.progress.report(rc.received)
+	return nil
+}
+
+// finish verifies the SHA-256 of the complete .part file and renames it.
+// A file that does not match is removed, to be sent again from the start.
+func (rc *receiving) finish(dir string) (string, error) {
+	if err := rc.f.Close(); err != nil {
+		return "", err
+	}
+	rc.f = nil
+
+	f, err := os.Open(rc.part)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != rc.m.SHA256 {
+		os.Remove(rc.part)
+		return "", fmt.Errorf("filetransfer: sha256 mismatch for %q: got %s, want %s", rc.m.Name, sum, rc.m.SHA256)
+	}
+
+	path, err := freePath(dir, rc.m.Name)
+	if err != nil {
+		return "", err
+	}
+	if err := os.Rename(rc.part, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// maxRenames is how many names freePath tries.
+const maxRenames = 100
+
+// freePath returns the path of name in dir, or of "name-N.ext" with the
+// lowest N if a file exists there already, so received files never
+// overwrite other files.
+func freePath(dir, name string) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 0; i < maxRenames; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		path := filepath.Join(dir, candidate)
+		if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+			return path, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("filetransfer: %q exists already, as do %d renamed copies", name, maxRenames-1)
+}
@@ -1,69 +1,67 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
-	"net/url"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/bigwhite/webrtc/filetransfer"
+	"github.com/bigwhite/webrtc/signaling/client"
 	"github.com/bigwhite/webrtc/signaling/proto"
-	"github.com/gorilla/websocket"
 	"github.com/pion/webrtc/v4"
 )
 
-func signalCandidate(wc *websocket.Conn, source, target string, c *webrtc.ICECandidate) error {
-	payload := []byte(c.ToJSON().Candidate)
-
-	var req = proto.Request{
-		SourceID: source,
-		TargetID: target,
-		Body:     payload,
-	}
-
-	reqData, err := req.ToJSON()
-	if err != nil {
-		return err
-	}
-
-	var message = proto.Message{
-		Cmd:     proto.CmdCandidate,
-		Payload: reqData,
-	}
-
-	messageData, err := message.ToJSON()
-	if err != nil {
-		return err
-	}
-
-	wcMu.Lock()
-	defer wcMu.Unlock()
-	return wc.WriteMessage(websocket.BinaryMessage, messageData)
-}
-
 var signalingAddr *string
 var id *string
 var target *string
-var wcMu sync.Mutex // sync the access for websocket.Conn
+var list *bool
+var timeout *time.Duration
+var codecs *string
+var iceGrace *time.Duration
+var iceRestarts *int
+var sendFile *string
+var remoteCandidates client.CandidateBuffer
 
 func main() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
 	signalingAddr = flag.String("signaling-address", "localhost:18080", "address that the signaling server is hosted on.")
 	id = flag.String("id", "offer-peer-1", "unique id of the offer peer")
-	target = flag.String("target", "", "target id of the other peer")
+	target = flag.String("target", "", "target id of the other peer, the least loaded answer peer accepting our data channel if empty")
+	list = flag.Bool("list", false, "print the registered answer peers and exit")
+	timeout = flag.Duration("timeout", 5*time.Second, "how long to wait for the response to a signaling request")
+	iceGrace = flag.Duration("ice-grace", 5*time.Second, "how long a disconnected or restarted connection gets to come back")
+	iceRestarts = flag.Int("ice-restarts", 3, "ICE restarts to try before hanging up")
+	sendFile = flag.String("send", "", "file to send to the answer peer instead of random messages, hanging up once it is verified")
+	codecs = flag.String("codecs", strings.Join(proto.Codecs(), ","), "signaling codecs offered to the server, preferred first")
 	flag.Parse()
 
-	var wc *websocket.Conn
-	var err error
+	// communicate with the signaling server
+	log.Printf("offer: connecting to %s", *signalingAddr)
+	cl, err := client.Dial(*signalingAddr, client.OfferPath)
+	if err != nil {
+		log.Fatalf("offer: dial %s error: %v", *signalingAddr, err)
+	}
+	cl.Timeout = *timeout
+	cl.Codecs = strings.Split(*codecs, ",")
+	defer cl.Close()
 
-	var candidatesMux sync.Mutex
-	pendingCandidates := make([]*webrtc.ICECandidate, 0)
+	if *list {
+		infos, err := cl.List(proto.Query{})
+		if err != nil {
+			log.Fatalln("offer: list answer peers error:", err)
+		}
+		for _, info := range infos {
+			fmt.Printf("%s\tsessions=%d\tlabels=%v\tmedia=%v\tversion=%s\n", info.ID, info.Sessions,
+				info.Capabilities.Labels, info.Capabilities.Media, info.Capabilities.Version)
+		}
+		return
+	}
 
 	// Prepare the configuration
 	config := webrtc.Configuration{
@@ -91,49 +89,112 @@ func main() {
 	// the other Pion instance will add this candidate by calling AddICECandidate
 	peerConnection.OnICECandidate(func(c *webrtc.ICECandidate) {
 		if c == nil {
-			return
+			log.Printf("offer: candidate gathering complete\n")
+		} else {
+			log.Printf("offer: invoke peerConnection.OnICECandidate: %s\n", c)
 		}
-		log.Printf("offer: invoke peerConnection.OnICECandidate: %#v\n", *c)
-
-		candidatesMux.Lock()
-		defer candidatesMux.Unlock()
 
-		desc := peerConnection.RemoteDescription()
-		if desc == nil {
-			pendingCandidates = append(pendingCandidates, c)
-		} else if onICECandidateErr := signalCandidate(wc, *id, *target, c); onICECandidateErr != nil {
-			panic(onICECandidateErr)
+		if onICECandidateErr := cl.SendCandidate(*target, c); onICECandidateErr != nil {
+			log.Printf("offer: signal candidate %s error: %v\n", c, onICECandidateErr)
 		}
 	})
 
-	dataChannel, err := peerConnection.CreateDataChannel("data", nil)
+	// files go over their own data channel, which only answer peers run
+	// with -recv-dir accept
+	label := "data"
+	if *sendFile != "" {
+		label = filetransfer.Label
+	}
+	dataChannel, err := peerConnection.CreateDataChannel(label, nil)
 	if err != nil {
 		panic(err)
 	}
-	log.Printf("offer: create new channel\n")
+	log.Printf("offer: create new channel '%s'\n", label)
+
+	// hangup ends the session: the answer peer is sent a bye unless it has
+	// hung up itself, then the signaling client is closed, which stops the
+	// event loop and closes peerConnection
+	var hangupOnce sync.Once
+	hangup := func(reason string, sendBye bool) {
+		hangupOnce.Do(func() {
+			log.Printf("offer: hang up: %s\n", reason)
+			if sendBye {
+				if err := cl.SendBye(*target, ""); err != nil {
+					log.Println("offer: send bye error:", err)
+				}
+			}
+			cl.Close()
+		})
+	}
+
+	// a lost connection is brought back with ICE restarts, the answer
+	// peer keeps its end of the session meanwhile
+	recovery := &client.Recovery{
+		Grace:       *iceGrace,
+		MaxRestarts: *iceRestarts,
+		Logf:        client.Logf,
+		Restart: func() error {
+			if peerConnection.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+				// the answer peer gets the last restart offer once it is
+				// back, a new one would cross its answer
+				log.Println("offer: ICE restart offer not answered yet")
+				return nil
+			}
+
+			offer, err := peerConnection.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+			if err != nil {
+				return err
+			}
+			// the candidates of the new offer are of no use to the answer
+			// peer before it has the offer
+			cl.HoldCandidates(*target)
+			if err := peerConnection.SetLocalDescription(offer); err != nil {
+				return err
+			}
+			if err := cl.SendOffer(*target, offer); err != nil {
+				// let the next attempt send a new offer
+				if rbErr := peerConnection.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); rbErr != nil {
+					log.Println("offer: rollback ICE restart offer error:", rbErr)
+				}
+				return err
+			}
+			return nil
+		},
+		GiveUp: func(reason string) {
+			go hangup(reason, true)
+		},
+	}
 
 	// Set the handler for Peer connection state
 	// This will notify you when the peer has connected/disconnected
 	peerConnection.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
 		log.Printf("offer: Peer Connection State has changed: %s\n", s.String())
 
-		if s == webrtc.PeerConnectionStateFailed {
-			// Wait until PeerConnection has had no network activity for 30 seconds or another failure. It may be reconnected using an ICE Restart.
-			// Use webrtc.PeerConnectionStateDisconnected if you are interested in detecting faster timeout.
-			// Note that the PeerConnection may come back from PeerConnectionStateDisconnected.
-			log.Println("offer: Peer Connection has gone to failed exiting")
-			os.Exit(0)
-		}
+		// Disconnected and Failed are handled by recovery
+		recovery.OnConnectionStateChange(s)
 
 		if s == webrtc.PeerConnectionStateClosed {
 			// PeerConnection was explicitly closed. This usually happens from a DTLS CloseNotify
-			log.Println("offer: Peer Connection has gone to closed exiting")
-			os.Exit(0)
+			go hangup("Peer Connection has gone to closed", true)
 		}
 	})
 
 	// Register channel opening handling
 	dataChannel.OnOpen(func() {
+		if *sendFile != "" {
+			// a transfer cut short resumes when the file is sent again
+			log.Printf("offer: Data channel '%s'-'%d' open. Sending %s\n", dataChannel.Label(), dataChannel.ID(), *sendFile)
+			err := filetransfer.Send(dataChannel, *sendFile, func(m filetransfer.Manifest, sent int64) {
+				log.Printf("offer: sent %d/%d bytes of %s (%.1f%%)\n", sent, m.Size, m.Name, percent(sent, m.Size))
+			})
+			if err != nil {
+				hangup(fmt.Sprintf("sending %s failed: %v", *sendFile, err), true)
+				return
+			}
+			hangup(*sendFile+" received and verified", true)
+			return
+		}
+
 		log.Printf("offer: Data channel '%s'-'%d' open. Random messages will now be sent to any connected DataChannels every 5 seconds\n", dataChannel.Label(), dataChannel.ID())
 
 		for range time.NewTicker(5 * time.Second).C {
@@ -144,7 +205,8 @@ func main() {
 			// Send the message as text
 			sendTextErr := dataChannel.SendText(message)
 			if sendTextErr != nil {
-				panic(sendTextErr)
+				log.Printf("offer: stop sending: %v\n", sendTextErr)
+				return
 			}
 		}
 	})
@@ -154,15 +216,12 @@ func main() {
 		log.Printf("offer: Message from DataChannel '%s': '%s'\n", dataChannel.Label(), string(msg.Data))
 	})
 
-	// communicate with the signaling server
-	u := url.URL{Scheme: "ws", Host: *signalingAddr, Path: "/offer"}
-	log.Printf("offer: connecting to %s", u.String())
-
-	wc, _, err = websocket.DefaultDialer.Dial(u.String(), nil)
-	if err != nil {
-		log.Fatalf("offer: dial %s error: %v", u.String(), err)
-	}
-	defer wc.Close()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		hangup("interrupted", true)
+	}()
 
 	// Create an offer to send to the other process
 	offer, err := peerConnection.CreateOffer(nil)
@@ -171,176 +230,90 @@ func main() {
 	}
 	log.Printf("offer: create offer\n")
 
-	sdp, err := json.Marshal(offer)
-	if err != nil {
-		panic(err)
-	}
-
-	// send offer to signaling server
-	var req = proto.Request{
-		SourceID: *id,
-		TargetID: *target,
-		Body:     sdp,
+	if err := cl.Register(*id); err != nil {
+		log.Fatalln("offer: register error:", err)
 	}
-
-	var am = proto.Message{
-		Cmd: proto.CmdOffer,
-	}
-
-	payload, err := req.ToJSON()
-	if err != nil {
-		log.Fatalf("offer: request payload marshal error: %v", err)
+	if *target == "" {
+		infos, err := cl.List(proto.Query{Label: dataChannel.Label()})
+		if err != nil {
+			log.Fatalln("offer: list answer peers error:", err)
+		}
+		if len(infos) == 0 {
+			log.Fatalf("offer: no answer peer accepts data channel '%s'", dataChannel.Label())
+		}
+		*target = infos[0].ID
+		log.Printf("offer: picked answer peer %s with %d sessions\n", *target, infos[0].Sessions)
 	}
-	am.Payload = payload
 
-	message, err := am.ToJSON()
-	if err != nil {
-		log.Fatalf("offer: message marshal error: %v", err)
+	// Sets the LocalDescription, and starts our UDP listeners
+	// Note: this will start the gathering of ICE candidates, which are held
+	// back until the answer peer has answered
+	if err := peerConnection.SetLocalDescription(offer); err != nil {
+		panic(err)
 	}
+	log.Printf("offer: set local desc\n")
 
-	wcMu.Lock()
-	err = wc.WriteMessage(websocket.BinaryMessage, message)
-	if err != nil {
-		wcMu.Unlock()
-		log.Fatalln("offer: write message error:", err)
+	if err := cl.SendOffer(*target, offer); err != nil {
+		log.Fatalln("offer: send offer error:", err)
 	}
-	wcMu.Unlock()
+	log.Println("offer: offer accepted by signaling")
 
 	// offer event loop
-	for {
-		// read message from signaling
-		_, data, err := wc.ReadMessage()
-		if err != nil {
-			log.Println("offer: read message error:", err)
-			return
+	for e := range cl.Events() {
+		if e.Type != client.EventReconnected && e.Source != *target {
+			log.Printf("offer: ignore request from %s", e.Source)
+			continue
 		}
 
-		var message proto.Message
-		err = message.FromJSON(data)
-		if err != nil {
-			log.Println("offer: message unmarshal error:", err)
-			return
-		}
-
-		switch message.Cmd {
-		case proto.CmdAnswer:
-			var req proto.Request
-			err = req.FromJSON(message.Payload)
-			if err != nil {
-				log.Println("offer: unmarshal request error:", err)
-				return
-			}
-			if req.TargetID != *id {
-				log.Printf("offer: the target id[%s] of answer request is not me", req.TargetID)
-				continue
-			}
-
-			log.Printf("offer: recv answer(sdp) message from %s\n", req.SourceID)
-
-			// return response
-			err = returnResp(wc, proto.CmdAnswerResp, &proto.Response{
-				Code: 0,
-				Msg:  "ok",
-			})
+		switch e.Type {
+		case client.EventAnswer:
+			log.Printf("offer: recv answer(sdp) message from %s\n", e.Source)
 
 			// handle answer message
-			err = handleAnswer(wc, peerConnection, &req, offer)
+			err = handleAnswer(peerConnection, e.SDP)
 			if err != nil {
 				log.Println("offer: handle answer message error:", err)
 				return
 			}
-		case proto.CmdCandidate:
-			var req proto.Request
-			err = req.FromJSON(message.Payload)
-			if err != nil {
-				log.Println("offer: unmarshal request error:", err)
-				return
+		case client.EventBye:
+			reason := e.Source + " hung up"
+			if e.Reason != "" {
+				reason += ": " + e.Reason
 			}
-			if req.TargetID != *id {
-				log.Printf("offer: the target id[%s] of candidate request is not me", req.TargetID)
-				continue
+			hangup(reason, false)
+		case client.EventCandidate:
+			log.Printf("offer: recv candidate message from %s\n", e.Source)
+			if e.Candidate.Candidate == "" {
+				log.Printf("offer: end of candidates from %s\n", e.Source)
 			}
-			log.Printf("offer: recv candidate message from %s\n", req.SourceID)
 
-			// return response
-			err = returnResp(wc, proto.CmdCandidateResp, &proto.Response{
-				Code: 0,
-				Msg:  "ok",
-			})
-
-			// handle candidate message
-			err = handleCandidate(wc, peerConnection, &req)
+			// an empty candidate marks the end of candidates for AddICECandidate too
+			err = remoteCandidates.Add(peerConnection, e.Candidate)
 			if err != nil {
 				log.Println("offer: handle candidate message error:", err)
 				return
 			}
-
-		case proto.CmdCandidateResp, proto.CmdOfferResp:
-			// get response
-			resp := proto.Response{}
-			err = resp.FromJSON(message.Payload)
-			if err != nil {
-				log.Fatalln("offer: unmarshal resp message error:", err)
-			}
-
-			log.Printf("offer: recv resp[%d]: %#v\n", message.Cmd, resp)
+		case client.EventReconnected:
+			// the signaling server told the answer peer that we left
+			hangup("signaling connection lost", false)
 		}
 	}
-
-	// Block forever
-	select {}
 }
 
-func handleAnswer(c *websocket.Conn, peerConnection *webrtc.PeerConnection, req *proto.Request, offer webrtc.SessionDescription) error {
-	sdp := webrtc.SessionDescription{}
-	if err := json.NewDecoder(bytes.NewReader(req.Body)).Decode(&sdp); err != nil {
-		return err
-	}
-
-	// Sets the LocalDescription, and starts our UDP listeners
-	// Note: this will start the gathering of ICE candidates
-	if err := peerConnection.SetLocalDescription(offer); err != nil {
-		return err
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 100
 	}
-	log.Printf("offer: set local desc\n")
+	return float64(n) * 100 / float64(total)
+}
 
+// handleAnswer applies the answer to our offer, the first one or an ICE
+// restart.
+func handleAnswer(peerConnection *webrtc.PeerConnection, sdp webrtc.SessionDescription) error {
 	if err := peerConnection.SetRemoteDescription(sdp); err != nil {
 		return err
 	}
 	log.Printf("offer: set remote desc\n")
 
-	return nil
-}
-
-func handleCandidate(c *websocket.Conn, peerConnection *webrtc.PeerConnection, req *proto.Request) error {
-	candidate, candidateErr := io.ReadAll(bytes.NewReader(req.Body))
-	if candidateErr != nil {
-		panic(candidateErr)
-	}
-	if candidateErr := peerConnection.AddICECandidate(webrtc.ICECandidateInit{Candidate: string(candidate)}); candidateErr != nil {
-		return candidateErr
-	}
-
-	return nil
-}
-
-func returnResp(c *websocket.Conn, cmd int, resp *proto.Response) error {
-	b, err := resp.ToJSON()
-	if err != nil {
-		return err
-	}
-
-	var message = proto.Message{
-		Cmd:     cmd,
-		Payload: b,
-	}
-
-	data, err := message.ToJSON()
-	if err != nil {
-		return err
-	}
-
-	wcMu.Lock()
-	defer wcMu.Unlock()
-	return c.WriteMessage(websocket.BinaryMessage, data)
+	return remoteCandidates.Flush(peerConnection)
 }
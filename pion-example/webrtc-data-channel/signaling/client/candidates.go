@@ -0,0 +1,105 @@
+package client
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// gate holds back our candidates for one target until the offer/answer
+// exchange with it is done, since it cannot add them before.
+type gate struct {
+	mu      sync.Mutex
+	ready   bool
+	pending []*webrtc.ICECandidate
+}
+
+func (c *Client) gate(target string) *gate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g, ok := c.gates[target]
+	if !ok {
+		g = &gate{}
+		c.gates[target] = g
+	}
+	return g
+}
+
+// dropGate forgets target, whose session is over.
+func (c *Client) dropGate(target string) {
+	c.mu.Lock()
+	delete(c.gates, target)
+	c.mu.Unlock()
+}
+
+// HoldCandidates holds back the candidates for target until the next
+// offer/answer exchange with it is done. It is called before setting the
+// local description of an ICE restart offer, whose candidates the target
+// cannot use before it has the offer.
+func (c *Client) HoldCandidates(target string) {
+	g := c.gate(target)
+	g.mu.Lock()
+	g.ready = false
+	g.mu.Unlock()
+}
+
+func (g *gate) send(c *Client, target string, cand *webrtc.ICECandidate) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.ready {
+		g.pending = append(g.pending, cand)
+		return nil
+	}
+	return c.sendCandidate(target, cand)
+}
+
+// open sends the held back candidates, and the later ones as they come.
+func (g *gate) open(c *Client, target string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.ready {
+		return
+	}
+	g.ready = true
+	for _, cand := range g.pending {
+		if err := c.sendCandidate(target, cand); err != nil {
+			log.Printf("client: signal candidate %s error: %v\n", cand, err)
+		}
+	}
+	g.pending = nil
+}
+
+// CandidateBuffer holds the candidates of the remote peer that arrive before
+// the remote description is set, since AddICECandidate fails until then.
+type CandidateBuffer struct {
+	mu      sync.Mutex
+	ready   bool
+	pending []webrtc.ICECandidateInit
+}
+
+// Add adds c to pc, or holds it until Flush.
+func (b *CandidateBuffer) Add(pc *webrtc.PeerConnection, c webrtc.ICECandidateInit) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.ready {
+		b.pending = append(b.pending, c)
+		return nil
+	}
+	return pc.AddICECandidate(c)
+}
+
+// Flush adds the buffered candidates. It must be called once the remote
+// description is set.
+func (b *CandidateBuffer) Flush(pc *webrtc.PeerConnection) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.ready = true
+	for _, c := range b.pending {
+		if err := pc.AddICECandidate(c); err != nil {
+			return err
+		}
+	}
+	b.pending = nil
+	return nil
+}
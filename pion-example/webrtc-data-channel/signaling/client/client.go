@@ -0,0 +1,514 @@
+// Package client is a peer of the signaling server. It registers an id,
+// sends offers, answers, candidates and byes to other peers, and delivers
+// the requests of other peers as events. When the connection drops it
+// reconnects with backoff and registers again.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/bigwhite/webrtc/signaling/proto"
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// paths of the signaling server, by the role of the peer
+const (
+	AnswerPath = "/register"
+	OfferPath  = "/offer"
+)
+
+// reconnect backoff
+const (
+	minBackoff = 500 * time.Millisecond
+	maxBackoff = 30 * time.Second
+)
+
+var (
+	// ErrClosed is returned by requests on a closed Client.
+	ErrClosed = errors.New("client: closed")
+	// ErrDisconnected is returned by requests while the Client reconnects.
+	ErrDisconnected = errors.New("client: disconnected")
+	// ErrNotRegistered is returned by requests sent before Register.
+	ErrNotRegistered = errors.New("client: not registered")
+)
+
+type EventType int
+
+const (
+	EventOffer EventType = iota + 1
+	EventAnswer
+	EventCandidate
+	EventBye
+	// EventReconnected follows a dropped connection, once the Client has
+	// registered again. The sessions over the old connection are over: the
+	// server has sent a bye to their peers, or lost them when restarting.
+	EventReconnected
+)
+
+// Event is a request from another peer.
+type Event struct {
+	Type   EventType
+	Source string
+
+	SDP       webrtc.SessionDescription // EventOffer, EventAnswer
+	Candidate webrtc.ICECandidateInit   // EventCandidate, empty at the end of candidates
+	Reason    string                    // EventBye, optional
+}
+
+// Client is a connection to the signaling server. Requests may be sent from
+// any goroutine, including the one reading Events.
+type Client struct {
+	url  string
+	txns *proto.Transactions
+
+	// Timeout is how long a request waits for its response. It must be set
+	// before the first request.
+	Timeout time.Duration
+
+	// Capabilities are advertised by answer peers when registering. They
+	// must be set before Register.
+	Capabilities proto.Capabilities
+
+	// Codecs are offered to the server when registering, preferred first.
+	// They default to proto.Codecs() and must be set before Register.
+	Codecs []string
+
+	mu     sync.Mutex
+	wc     *websocket.Conn // nil while reconnecting
+	codec  proto.Codec     // negotiated over wc
+	id     string
+	closed bool
+	gates  map[string]*gate // by target
+	wmu    sync.Mutex       // serializes the writes to wc
+
+	// inbound requests wait in queue until Events is read, so that a slow
+	// reader never holds up the responses to its own requests
+	qmu    sync.Mutex
+	queue  []Event
+	wake   chan struct{}
+	events chan Event
+	done   chan struct{}
+}
+
+// Dial connects to the signaling server at addr, on AnswerPath or OfferPath.
+func Dial(addr, path string) (*Client, error) {
+	u := url.URL{Scheme: "ws", Host: addr, Path: path}
+	wc, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		url:     u.String(),
+		txns:    proto.NewTransactions(),
+		Timeout: 5 * time.Second,
+		Codecs:  proto.Codecs(),
+		wc:      wc,
+		gates:   make(map[string]*gate),
+		wake:    make(chan struct{}, 1),
+		events:  make(chan Event),
+		done:    make(chan struct{}),
+	}
+	go c.run(wc)
+	go c.pump()
+	return c, nil
+}
+
+// Events returns the requests of other peers. It is closed by Close.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Close stops reconnecting and closes the connection. Events not read yet
+// are dropped.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.wc != nil {
+		return c.wc.Close()
+	}
+	return nil
+}
+
+// Register registers id with the server. It is registered again after
+// every reconnect.
+func (c *Client) Register(id string) error {
+	c.mu.Lock()
+	c.id = id
+	c.mu.Unlock()
+	return c.register(id)
+}
+
+func (c *Client) register(id string) error {
+	body, err := c.Capabilities.ToJSON()
+	if err != nil {
+		return err
+	}
+	resp, err := c.request(proto.CmdInit, &proto.Request{SourceID: id, Body: body, Codecs: c.Codecs})
+	if err != nil {
+		return err
+	}
+
+	// servers that predate codec negotiation do not pick one
+	codec := proto.JSON
+	if resp.Codec != "" {
+		if codec, err = proto.ParseCodec(resp.Codec); err != nil {
+			return err
+		}
+	}
+	c.mu.Lock()
+	c.codec = codec
+	c.mu.Unlock()
+	log.Println("client: using codec", codec)
+	return nil
+}
+
+// List returns the registered answer peers matching q, the least loaded
+// first.
+func (c *Client) List(q proto.Query) ([]proto.PeerInfo, error) {
+	body, err := q.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	var infos []proto.PeerInfo
+	if err := c.query(proto.CmdList, "", body, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// Lookup returns the answer peer id. A peer that is not registered is
+// reported as a *proto.ResponseError with proto.CodeNotFound.
+func (c *Client) Lookup(id string) (*proto.PeerInfo, error) {
+	var info proto.PeerInfo
+	if err := c.query(proto.CmdLookup, id, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (c *Client) query(cmd int, target string, body []byte, result interface{}) error {
+	c.mu.Lock()
+	id := c.id
+	c.mu.Unlock()
+	resp, err := c.request(cmd, &proto.Request{SourceID: id, TargetID: target, Body: body})
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.Body, result)
+}
+
+// SendOffer sends offer to target.
+func (c *Client) SendOffer(target string, offer webrtc.SessionDescription) error {
+	return c.sendSDP(proto.CmdOffer, target, offer)
+}
+
+// SendAnswer sends answer to target. Candidates for target are sent from
+// then on.
+func (c *Client) SendAnswer(target string, answer webrtc.SessionDescription) error {
+	if err := c.sendSDP(proto.CmdAnswer, target, answer); err != nil {
+		return err
+	}
+	c.gate(target).open(c, target)
+	return nil
+}
+
+func (c *Client) sendSDP(cmd int, target string, sdp webrtc.SessionDescription) error {
+	body, err := json.Marshal(sdp)
+	if err != nil {
+		return err
+	}
+	return c.send(cmd, target, body)
+}
+
+// SendCandidate sends cand to target, a nil cand telling that all
+// candidates have been sent. Candidates are held back until target has our
+// offer and we have its answer, or it has our answer.
+func (c *Client) SendCandidate(target string, cand *webrtc.ICECandidate) error {
+	return c.gate(target).send(c, target, cand)
+}
+
+func (c *Client) sendCandidate(target string, cand *webrtc.ICECandidate) error {
+	candidate := proto.Candidate{EndOfCandidates: true}
+	if cand != nil {
+		init := cand.ToJSON()
+		candidate = proto.Candidate{
+			Candidate:        init.Candidate,
+			SDPMid:           init.SDPMid,
+			SDPMLineIndex:    init.SDPMLineIndex,
+			UsernameFragment: init.UsernameFragment,
+		}
+	}
+	body, err := candidate.ToJSON()
+	if err != nil {
+		return err
+	}
+	return c.send(proto.CmdCandidate, target, body)
+}
+
+// SendBye ends the session with target. reason is optional.
+func (c *Client) SendBye(target, reason string) error {
+	c.dropGate(target)
+	return c.send(proto.CmdBye, target, []byte(reason))
+}
+
+func (c *Client) send(cmd int, target string, body []byte) error {
+	c.mu.Lock()
+	id := c.id
+	c.mu.Unlock()
+	if id == "" {
+		return ErrNotRegistered
+	}
+	_, err := c.request(cmd, &proto.Request{SourceID: id, TargetID: target, Body: body})
+	return err
+}
+
+// request sends req as a cmd message and waits for the matching response.
+func (c *Client) request(cmd int, req *proto.Request) (*proto.Response, error) {
+	message := proto.Message{Cmd: cmd}
+	return c.txns.Do(&message, c.Timeout, func(m *proto.Message) error {
+		return c.write(func(codec proto.Codec) ([]byte, error) {
+			return codec.EncodeRequest(m.Cmd, m.Txn, req)
+		})
+	})
+}
+
+// write sends the message returned by encode for the codec in use.
+func (c *Client) write(encode func(proto.Codec) ([]byte, error)) error {
+	c.mu.Lock()
+	wc, codec, closed := c.wc, c.codec, c.closed
+	c.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	if wc == nil {
+		return ErrDisconnected
+	}
+
+	data, err := encode(codec)
+	if err != nil {
+		return err
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return wc.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// run reads wc and every connection replacing it until Close.
+func (c *Client) run(wc *websocket.Conn) {
+	for {
+		err := c.read(wc)
+
+		c.mu.Lock()
+		closed := c.closed
+		if c.wc == wc {
+			c.wc = nil
+		}
+		c.mu.Unlock()
+		wc.Close()
+		if closed {
+			return
+		}
+
+		log.Println("client: connection lost:", err)
+		if wc = c.reconnect(); wc == nil {
+			return
+		}
+		go c.reregister(wc)
+	}
+}
+
+// reconnect dials the server again until it succeeds or the Client is
+// closed, in which case it returns nil.
+func (c *Client) reconnect() *websocket.Conn {
+	backoff := minBackoff
+	for {
+		// spread the reconnects of the peers of a restarted server
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(wait):
+		}
+
+		wc, _, err := websocket.DefaultDialer.Dial(c.url, nil)
+		if err == nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if c.closed {
+				wc.Close()
+				return nil
+			}
+			c.wc = wc
+			c.codec = proto.JSON // until registered again
+			log.Println("client: reconnected to", c.url)
+			return wc
+		}
+		log.Printf("client: reconnect to %s error: %v\n", c.url, err)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// reregister registers the id again over the new connection wc. The
+// response is read by run, so it is called from its own goroutine.
+func (c *Client) reregister(wc *websocket.Conn) {
+	c.mu.Lock()
+	id := c.id
+	// the sessions over the old connection are over
+	c.gates = make(map[string]*gate)
+	c.mu.Unlock()
+
+	if id != "" {
+		if err := c.register(id); err != nil {
+			log.Println("client: register again error:", err)
+			wc.Close() // reconnect once more
+			return
+		}
+	}
+	c.emit(Event{Type: EventReconnected})
+}
+
+func (c *Client) read(wc *websocket.Conn) error {
+	for {
+		_, data, err := wc.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		message, err := proto.Decode(data)
+		if err != nil {
+			return err
+		}
+
+		switch message.Cmd {
+		case proto.CmdOffer, proto.CmdAnswer, proto.CmdCandidate, proto.CmdBye:
+			req, err := message.Request()
+			if err != nil {
+				return err
+			}
+			c.respond(message.Cmd+100, message.Txn)
+			c.handle(message.Cmd, req)
+
+		case proto.CmdInitResp, proto.CmdOfferResp, proto.CmdAnswerResp, proto.CmdCandidateResp, proto.CmdByeResp,
+			proto.CmdListResp, proto.CmdLookupResp:
+			// hand the response to the request waiting for it
+			if !c.txns.Resolve(message) {
+				log.Printf("client: recv resp[%d] for unknown txn %d\n", message.Cmd, message.Txn)
+			}
+		default:
+			log.Println("client: unsupport cmd:", message.Cmd)
+		}
+	}
+}
+
+// handle turns the request req into an event.
+func (c *Client) handle(cmd int, req *proto.Request) {
+	c.mu.Lock()
+	id := c.id
+	c.mu.Unlock()
+	if req.TargetID != id {
+		log.Printf("client: the target id[%s] of request[%d] is not me\n", req.TargetID, cmd)
+		return
+	}
+
+	e := Event{Source: req.SourceID}
+	switch cmd {
+	case proto.CmdOffer, proto.CmdAnswer:
+		e.Type = EventOffer
+		if cmd == proto.CmdAnswer {
+			e.Type = EventAnswer
+		}
+		if err := json.Unmarshal(req.Body, &e.SDP); err != nil {
+			log.Printf("client: unmarshal sdp from %s error: %v\n", req.SourceID, err)
+			return
+		}
+		if cmd == proto.CmdAnswer {
+			// candidates wait for responses read by run
+			go c.gate(req.SourceID).open(c, req.SourceID)
+		}
+	case proto.CmdCandidate:
+		var candidate proto.Candidate
+		if err := candidate.FromJSON(req.Body); err != nil {
+			log.Printf("client: unmarshal candidate from %s error: %v\n", req.SourceID, err)
+			return
+		}
+		e.Type = EventCandidate
+		e.Candidate = webrtc.ICECandidateInit{
+			Candidate:        candidate.Candidate,
+			SDPMid:           candidate.SDPMid,
+			SDPMLineIndex:    candidate.SDPMLineIndex,
+			UsernameFragment: candidate.UsernameFragment,
+		}
+	case proto.CmdBye:
+		c.dropGate(req.SourceID)
+		e.Type = EventBye
+		e.Reason = string(req.Body)
+	}
+	c.emit(e)
+}
+
+// respond acknowledges the request txn.
+func (c *Client) respond(cmd int, txn uint64) {
+	resp := proto.Response{Code: proto.CodeOK, Msg: "ok"}
+	err := c.write(func(codec proto.Codec) ([]byte, error) {
+		return codec.EncodeResponse(cmd, txn, &resp)
+	})
+	if err != nil {
+		log.Printf("client: send resp[%d] error: %v\n", cmd, err)
+	}
+}
+
+func (c *Client) emit(e Event) {
+	c.qmu.Lock()
+	c.queue = append(c.queue, e)
+	c.qmu.Unlock()
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pump moves the queued events to the Events channel.
+func (c *Client) pump() {
+	defer close(c.events)
+	for {
+		c.qmu.Lock()
+		queue := c.queue
+		c.queue = nil
+		c.qmu.Unlock()
+
+		if len(queue) == 0 {
+			select {
+			case <-c.wake:
+			case <-c.done:
+				return
+			}
+			continue
+		}
+		for _, e := range queue {
+			select {
+			case c.events <- e:
+			case <-c.done:
+				return
+			}
+		}
+	}
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
 
 	"github.com/bigwhite/webrtc/signaling/proto"
@@ -15,12 +17,14 @@ var addr = flag.String("addr", "0.0.0.0:18080", "signaling service address")
 var upgrader = websocket.Upgrader{} // use default options
 
 func offer(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil) // *websocket.Conn
+	wc, err := upgrader.Upgrade(w, r, nil) // *websocket.Conn
 	if err != nil {
 		log.Print("signaling: websocket upgrade error:", err)
 		return
 	}
+	c := &conn{Conn: wc}
 	defer c.Close()
+	defer offerPeerLeft(c)
 
 	err = offerPeerEventLoop(c, w)
 	if err != nil {
@@ -30,34 +34,50 @@ func offer(w http.ResponseWriter, r *http.Request) {
 	log.Println("signaling: offerPeerEventLoop exit")
 }
 
-func offerPeerEventLoop(c *websocket.Conn, w http.ResponseWriter) (err error) {
-	var mt int
+func offerPeerEventLoop(c *conn, w http.ResponseWriter) (err error) {
 	var message []byte
 
 	for {
-		mt, message, err = c.ReadMessage()
+		_, message, err = c.ReadMessage()
 		if err != nil {
 			log.Println("signaling: read message from offer peer error:", err)
 			return
 		}
 
-		// unmarshal offer Message
-		var om proto.Message
-		err = om.FromJSON(message)
+		// unmarshal offer Message, in any codec
+		var om *proto.Message
+		om, err = proto.Decode(message)
 		if err != nil {
 			log.Println("signaling: unmarshal message from offer peer error:", err)
 			return
 		}
 
 		switch om.Cmd {
-		case proto.CmdOffer, proto.CmdCandidate:
+		case proto.CmdInit:
+			// register the offer peer before its first request, so that it
+			// can be reached again after reconnecting
+			req, err := om.Request()
+			if err != nil {
+				log.Println("signaling: unmarshal request from offer peer error:", err)
+				return err
+			}
+			p := peerOffer{
+				peer: peer{
+					id:   req.SourceID,
+					conn: c,
+				},
+				targetID: req.TargetID,
+			}
+			pOffers.addPeer(&p)
+			log.Println("signaling: add offer peer: ", req.SourceID)
+			returnInitResp(c, om.Txn, req)
+		case proto.CmdOffer, proto.CmdCandidate, proto.CmdBye:
 			// recv a request message from offer peer
 			// foward it to answer peer after responsing
-			var req proto.Request
-			err = req.FromJSON(om.Payload)
+			req, err := om.Request()
 			if err != nil {
 				log.Println("signaling: unmarshal request from offer peer error:", err)
-				return
+				return err
 			}
 			log.Printf("signaling: recv request[%d] from offer peer", om.Cmd)
 
@@ -65,14 +85,14 @@ func offerPeerEventLoop(c *websocket.Conn, w http.ResponseWriter) (err error) {
 			pa, err := pAnswers.findPeer(req.TargetID)
 			if err != nil {
 				// response to offer peer
-				rsp.Code = 1
+				rsp.Code = proto.CodeNotFound
 				rsp.Msg = err.Error()
-				returnResp(c, om.Cmd+100, &rsp)
+				returnResp(c, om.Cmd+100, om.Txn, &rsp)
 				continue
 			}
 
 			rsp.Msg = "ok"
-			returnResp(c, om.Cmd+100, &rsp)
+			returnResp(c, om.Cmd+100, om.Txn, &rsp)
 			log.Println("signaling: send offer resp ok")
 
 			// store offer peer into pOffers
@@ -87,113 +107,121 @@ func offerPeerEventLoop(c *websocket.Conn, w http.ResponseWriter) (err error) {
 			log.Println("signaling: add offer peer: ", req.SourceID)
 
 			// forward request to answer peer
-			err = pa.conn.WriteMessage(mt, message)
+			err = pa.conn.sendRequest(om.Cmd, om.Txn, req)
 			if err != nil {
 				log.Println("signaling: forward request to answer peer error:", err)
 				return err
 			}
 			log.Printf("signaling: forward request[%d] to answer peer ok", om.Cmd)
+
+			if om.Cmd == proto.CmdBye {
+				// the session is over, the offer peer has to send a new
+				// offer to start another one
+				pOffers.removePeer(req.SourceID, c)
+				log.Println("signaling: remove offer peer: ", req.SourceID)
+			}
+		case proto.CmdList, proto.CmdLookup:
+			req, err := om.Request()
+			if err != nil {
+				log.Println("signaling: unmarshal request from offer peer error:", err)
+				return err
+			}
+			returnQuery(c, om, req)
 		case proto.CmdAnswerResp:
 			log.Println("signaling: recv answer response from offer peer")
 		case proto.CmdCandidateResp:
 			log.Println("signaling: recv candidate response from offer peer")
+		case proto.CmdByeResp:
+			log.Println("signaling: recv bye response from offer peer")
 		default:
 			log.Println("signaling: unsupport cmd:", om.Cmd)
 		}
 	}
 }
 
-func answerPeerEventLoop(c *websocket.Conn, w http.ResponseWriter) (err error) {
-	var mt int
+func answerPeerEventLoop(c *conn, w http.ResponseWriter) (err error) {
 	var message []byte
 
 	for {
-		mt, message, err = c.ReadMessage()
+		_, message, err = c.ReadMessage()
 		if err != nil {
 			log.Println("signaling: read message from answer peer error:", err)
 			return
 		}
 
-		var am proto.Message
-		err = am.FromJSON(message)
+		var am *proto.Message
+		am, err = proto.Decode(message)
 		if err != nil {
 			log.Println("signaling: unmarshal message from answer peer error:", err)
 			return
 		}
 
-		var req proto.Request
-		err = req.FromJSON(am.Payload)
-		if err != nil {
-			log.Println("signaling: unmarshal request from answer peer error:", err)
-			return
-		}
-
 		var rsp proto.Response
-		var rspData []byte
+		var req = &proto.Request{}
+		if am.Cmd < 100 {
+			req, err = am.Request()
+			if err != nil {
+				log.Println("signaling: unmarshal request from answer peer error:", err)
+				return
+			}
+		}
 
 		switch am.Cmd {
 		case proto.CmdInit:
+			var caps proto.Capabilities
+			if err := caps.FromJSON(req.Body); err != nil {
+				log.Printf("signaling: unmarshal capabilities of answer peer[%s] error: %v", req.SourceID, err)
+				returnResp(c, proto.CmdInitResp, am.Txn, &proto.Response{Code: proto.CodeBadRequest, Msg: err.Error()})
+				continue
+			}
+
 			// store the answer peer into answerMap
 			p := peerAnswer{
 				peer: peer{
 					id:   req.SourceID,
 					conn: c,
 				},
+				caps: caps,
 			}
-			rsp.Code = 0
-			rsp.Msg = "ok"
 			pAnswers.addPeer(&p)
-			log.Println("signaling: add answer peer:", p.id)
-			rspData, err = rsp.ToJSON()
-			if err != nil {
-				log.Println("signaling: marshal init response error:", err)
-				return
-			}
-
-			var message = proto.Message{
-				Cmd:     proto.CmdInitResp,
-				Payload: rspData,
-			}
-			var messageData []byte
-			messageData, err = message.ToJSON()
-			if err != nil {
-				log.Println("signaling: marshal init response message error:", err)
-				return
-			}
-
-			err = c.WriteMessage(mt, messageData)
+			log.Printf("signaling: add answer peer: %s %+v", p.id, caps)
+			err = returnInitResp(c, am.Txn, req)
 			if err != nil {
 				log.Println("signaling: write response message to answer peer error:", err)
 				return
 			}
 
-		case proto.CmdAnswer, proto.CmdCandidate:
+		case proto.CmdAnswer, proto.CmdCandidate, proto.CmdBye:
 			log.Printf("signaling: recv request[%d] from answer peer", am.Cmd)
 			// recv answer or candidate from answer peer
 			// foward to offer peer after responsing
 			po, err := pOffers.findPeer(req.TargetID)
 			if err != nil {
 				log.Printf("signaling: not find the target offer[%s]", req.TargetID)
-				rsp.Code = 1
+				rsp.Code = proto.CodeNotFound
 				rsp.Msg = err.Error()
-				returnResp(c, am.Cmd+100, &rsp)
+				returnResp(c, am.Cmd+100, am.Txn, &rsp)
 				continue
 			}
 			rsp.Msg = "ok"
-			rsp.Code = 0
-			returnResp(c, am.Cmd+100, &rsp)
+			rsp.Code = proto.CodeOK
+			returnResp(c, am.Cmd+100, am.Txn, &rsp)
 
 			// forward message to offer peer
-			err = po.conn.WriteMessage(mt, message)
+			err = po.conn.sendRequest(am.Cmd, am.Txn, req)
 			if err != nil {
 				log.Printf("signaling: forward request[%d] to offer peer error: %v", am.Cmd, err)
 				return err
 			}
 			log.Printf("signaling: forward request[%d] to offer peer[%s] ok", am.Cmd, po.id)
+		case proto.CmdList, proto.CmdLookup:
+			returnQuery(c, am, req)
 		case proto.CmdOfferResp:
 			log.Println("signaling: recv offer response from answer peer")
 		case proto.CmdCandidateResp:
 			log.Println("signaling: recv candidate response from answer peer")
+		case proto.CmdByeResp:
+			log.Println("signaling: recv bye response from answer peer")
 		default:
 			log.Println("signaling: unsupport cmd:", am.Cmd)
 		}
@@ -202,12 +230,14 @@ func answerPeerEventLoop(c *websocket.Conn, w http.ResponseWriter) (err error) {
 
 // in a standalone goroutine
 func register(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil) // *websocket.Conn
+	wc, err := upgrader.Upgrade(w, r, nil) // *websocket.Conn
 	if err != nil {
 		log.Print("signaling: websocket upgrade error:", err)
 		return
 	}
+	c := &conn{Conn: wc}
 	defer c.Close()
+	defer answerPeerLeft(c)
 
 	err = answerPeerEventLoop(c, w)
 	if err != nil {
@@ -217,9 +247,39 @@ func register(w http.ResponseWriter, r *http.Request) {
 	log.Println("signaling: answerPeerEventLoop exit")
 }
 
+// conn serializes the writes to a websocket.Conn, which is written by the
+// event loop of its own peer and by the loops forwarding to that peer.
+// Messages are encoded with the codec negotiated by the peer, so peers with
+// different codecs reach each other.
+type conn struct {
+	*websocket.Conn
+	mu    sync.Mutex
+	codec proto.Codec
+}
+
+func (c *conn) sendRequest(cmd int, txn uint64, req *proto.Request) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := c.codec.EncodeRequest(cmd, txn, req)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.BinaryMessage, data)
+}
+
+func (c *conn) sendResponse(cmd int, txn uint64, resp *proto.Response) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := c.codec.EncodeResponse(cmd, txn, resp)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(websocket.BinaryMessage, data)
+}
+
 type peer struct {
 	id   string // unique id for identifying peer
-	conn *websocket.Conn
+	conn *conn
 }
 
 type peerOffer struct {
@@ -229,6 +289,7 @@ type peerOffer struct {
 
 type peerAnswer struct {
 	peer
+	caps proto.Capabilities // what it serves, from its init request
 }
 
 type peerOffers struct {
@@ -257,6 +318,57 @@ func (prs *peerOffers) findPeer(id string) (*peerOffer, error) {
 	return nil, os.ErrNotExist
 }
 
+// removePeer removes id if it is still registered over c.
+func (prs *peerOffers) removePeer(id string, c *conn) {
+	prs.Lock()
+	defer prs.Unlock()
+	if p, ok := prs.m[id]; ok && p.conn == c {
+		delete(prs.m, id)
+	}
+}
+
+// removeConn removes and returns the peers registered over c.
+func (prs *peerOffers) removeConn(c *conn) []*peerOffer {
+	prs.Lock()
+	defer prs.Unlock()
+	var removed []*peerOffer
+	for id, p := range prs.m {
+		if p.conn == c {
+			delete(prs.m, id)
+			removed = append(removed, p)
+		}
+	}
+	return removed
+}
+
+// findByTarget returns the offer peers connecting to the answer peer id.
+func (prs *peerOffers) findByTarget(id string) []*peerOffer {
+	prs.Lock()
+	defer prs.Unlock()
+	var found []*peerOffer
+	for _, p := range prs.m {
+		if p.targetID == id {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+// removeByTarget removes and returns the offer peers connecting to the
+// answer peer id.
+func (prs *peerOffers) removeByTarget(id string) []*peerOffer {
+	prs.Lock()
+	defer prs.Unlock()
+	var removed []*peerOffer
+	for poID, p := range prs.m {
+		if p.targetID == id {
+			delete(prs.m, poID)
+			removed = append(removed, p)
+		}
+	}
+	return removed
+}
+
 var pAnswers = peerAnswers{
 	m: make(map[string]*peerAnswer),
 }
@@ -283,6 +395,124 @@ func (prs *peerAnswers) findPeer(id string) (*peerAnswer, error) {
 	return nil, os.ErrNotExist
 }
 
+// list returns the peers with label and media kind, the least loaded
+// first.
+func (prs *peerAnswers) list(q proto.Query) []proto.PeerInfo {
+	prs.Lock()
+	infos := make([]proto.PeerInfo, 0, len(prs.m))
+	for _, p := range prs.m {
+		if p.caps.Has(q.Label, q.Media) {
+			infos = append(infos, proto.PeerInfo{ID: p.id, Capabilities: p.caps})
+		}
+	}
+	prs.Unlock()
+
+	for i := range infos {
+		infos[i].Sessions = len(pOffers.findByTarget(infos[i].ID))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Sessions != infos[j].Sessions {
+			return infos[i].Sessions < infos[j].Sessions
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// removeConn removes and returns the peers registered over c.
+func (prs *peerAnswers) removeConn(c *conn) []*peerAnswer {
+	prs.Lock()
+	defer prs.Unlock()
+	var removed []*peerAnswer
+	for id, p := range prs.m {
+		if p.conn == c {
+			delete(prs.m, id)
+			removed = append(removed, p)
+		}
+	}
+	return removed
+}
+
+// returnQuery answers the list or lookup request m.
+func returnQuery(c *conn, m *proto.Message, req *proto.Request) {
+	var rsp proto.Response
+	var result interface{}
+
+	switch m.Cmd {
+	case proto.CmdList:
+		var q proto.Query
+		if err := q.FromJSON(req.Body); err != nil {
+			rsp.Code = proto.CodeBadRequest
+			rsp.Msg = err.Error()
+			returnResp(c, m.Cmd+100, m.Txn, &rsp)
+			return
+		}
+		result = pAnswers.list(q)
+	case proto.CmdLookup:
+		pa, err := pAnswers.findPeer(req.TargetID)
+		if err != nil {
+			rsp.Code = proto.CodeNotFound
+			rsp.Msg = err.Error()
+			returnResp(c, m.Cmd+100, m.Txn, &rsp)
+			return
+		}
+		result = proto.PeerInfo{
+			ID:           pa.id,
+			Capabilities: pa.caps,
+			Sessions:     len(pOffers.findByTarget(pa.id)),
+		}
+	}
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		log.Println("signaling: marshal query result error:", err)
+		return
+	}
+	rsp.Msg = "ok"
+	rsp.Body = body
+	returnResp(c, m.Cmd+100, m.Txn, &rsp)
+	log.Printf("signaling: answer request[%d] from %s", m.Cmd, req.SourceID)
+}
+
+// offerPeerLeft unregisters the offer peers of the closed c and tells
+// their answer peers.
+func offerPeerLeft(c *conn) {
+	for _, po := range pOffers.removeConn(c) {
+		log.Println("signaling: remove offer peer:", po.id)
+		pa, err := pAnswers.findPeer(po.targetID)
+		if err != nil {
+			continue
+		}
+		if err := sendBye(pa.conn, po.id, pa.id); err != nil {
+			log.Printf("signaling: send bye to answer peer[%s] error: %v", pa.id, err)
+		}
+	}
+}
+
+// answerPeerLeft unregisters the answer peers of the closed c, and the
+// offer peers connecting to them, which are told. Those have to send a new
+// offer to start another session.
+func answerPeerLeft(c *conn) {
+	for _, pa := range pAnswers.removeConn(c) {
+		log.Println("signaling: remove answer peer:", pa.id)
+		for _, po := range pOffers.removeByTarget(pa.id) {
+			log.Println("signaling: remove offer peer:", po.id)
+			if err := sendBye(po.conn, pa.id, po.id); err != nil {
+				log.Printf("signaling: send bye to offer peer[%s] error: %v", po.id, err)
+			}
+		}
+	}
+}
+
+// sendBye tells target that source has gone.
+func sendBye(c *conn, source, target string) error {
+	var req = proto.Request{
+		SourceID: source,
+		TargetID: target,
+	}
+	return c.sendRequest(proto.CmdBye, 0, &req)
+}
+
 func main() {
 	flag.Parse()
 	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
@@ -291,21 +521,30 @@ func main() {
 	log.Fatal(http.ListenAndServe(*addr, nil))
 }
 
-func returnResp(c *websocket.Conn, cmd int, resp *proto.Response) error {
-	b, err := resp.ToJSON()
-	if err != nil {
-		return err
-	}
+// returnResp sends resp as the response to the request txn.
+func returnResp(c *conn, cmd int, txn uint64, resp *proto.Response) error {
+	return c.sendResponse(cmd, txn, resp)
+}
 
-	var message = proto.Message{
-		Cmd:     cmd,
-		Payload: b,
+// returnInitResp accepts the init request txn. The codec picked among the
+// ones offered by req is used for c once the response is sent.
+func returnInitResp(c *conn, txn uint64, req *proto.Request) error {
+	rsp := proto.Response{Code: proto.CodeOK, Msg: "ok"}
+	if len(req.Codecs) == 0 {
+		// the peer predates codec negotiation
+		return returnResp(c, proto.CmdInitResp, txn, &rsp)
 	}
 
-	data, err := message.ToJSON()
+	codec := proto.Negotiate(req.Codecs)
+	rsp.Codec = codec.String()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, err := c.codec.EncodeResponse(proto.CmdInitResp, txn, &rsp)
 	if err != nil {
 		return err
 	}
-
+	c.codec = codec
+	log.Printf("signaling: peer[%s] uses codec %s", req.SourceID, codec)
 	return c.WriteMessage(websocket.BinaryMessage, data)
 }
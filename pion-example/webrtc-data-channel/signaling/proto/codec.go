@@ -0,0 +1,265 @@
+package proto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Codec is the wire encoding of a Message and of its payload. Peers start
+// with JSON and offer the codecs they support in the Codecs of their
+// CmdInit request; the Codec of the response is used from then on, in both
+// directions. Decode recognizes either, so peers that never negotiate keep
+// working through the signaling server.
+type Codec int
+
+const (
+	JSON Codec = iota
+	// Binary is a length-prefixed encoding that carries the bytes fields
+	// as they are, where JSON base64-encodes the payload and again the body
+	// in it. Its first byte is BinaryVersion.
+	Binary
+)
+
+// BinaryVersion is the schema version of the Binary codec.
+const BinaryVersion = 1
+
+var errBinaryTruncated = errors.New("proto: truncated binary message")
+
+func (c Codec) String() string {
+	switch c {
+	case JSON:
+		return "json"
+	case Binary:
+		return fmt.Sprintf("binary/%d", BinaryVersion)
+	}
+	return fmt.Sprintf("codec(%d)", int(c))
+}
+
+// ParseCodec returns the codec named name, as returned by String.
+func ParseCodec(name string) (Codec, error) {
+	for _, c := range []Codec{JSON, Binary} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return JSON, fmt.Errorf("proto: unknown codec %q", name)
+}
+
+// Codecs returns the names of the supported codecs, preferred first.
+func Codecs() []string {
+	return []string{Binary.String(), JSON.String()}
+}
+
+// Negotiate returns the first supported codec of names, or JSON.
+func Negotiate(names []string) Codec {
+	for _, name := range names {
+		if c, err := ParseCodec(name); err == nil {
+			return c
+		}
+	}
+	return JSON
+}
+
+// EncodeRequest encodes a cmd message with txn carrying req.
+func (c Codec) EncodeRequest(cmd int, txn uint64, req *Request) ([]byte, error) {
+	var payload []byte
+	var err error
+	switch c {
+	case JSON:
+		payload, err = req.ToJSON()
+	case Binary:
+		payload = req.appendBinary(nil)
+	default:
+		err = fmt.Errorf("proto: unknown codec %d", int(c))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.encode(cmd, txn, payload)
+}
+
+// EncodeResponse encodes a cmd message with txn carrying resp.
+func (c Codec) EncodeResponse(cmd int, txn uint64, resp *Response) ([]byte, error) {
+	var payload []byte
+	var err error
+	switch c {
+	case JSON:
+		payload, err = resp.ToJSON()
+	case Binary:
+		payload = resp.appendBinary(nil)
+	default:
+		err = fmt.Errorf("proto: unknown codec %d", int(c))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.encode(cmd, txn, payload)
+}
+
+func (c Codec) encode(cmd int, txn uint64, payload []byte) ([]byte, error) {
+	if c == JSON {
+		return Message{Cmd: cmd, Txn: txn, Payload: payload}.ToJSON()
+	}
+	if cmd < 0 {
+		return nil, fmt.Errorf("proto: invalid cmd %d", cmd)
+	}
+	b := []byte{BinaryVersion}
+	b = binary.AppendUvarint(b, uint64(cmd))
+	b = binary.AppendUvarint(b, txn)
+	return appendBytes(b, payload), nil
+}
+
+// Decode decodes a message in either codec. The Codec of the message tells
+// which.
+func Decode(data []byte) (*Message, error) {
+	if len(data) == 0 {
+		return nil, errors.New("proto: empty message")
+	}
+	switch data[0] {
+	case '{', ' ', '\t', '\r', '\n':
+		var m Message
+		if err := m.FromJSON(data); err != nil {
+			return nil, err
+		}
+		return &m, nil
+	case BinaryVersion:
+		r := binaryReader{b: data[1:]}
+		cmd := r.uvarint()
+		m := Message{
+			Txn:     r.uvarint(),
+			Payload: r.bytes(),
+			Codec:   Binary,
+		}
+		if err := r.end(); err != nil {
+			return nil, err
+		}
+		if cmd > uint64(maxCmd) {
+			return nil, fmt.Errorf("proto: invalid cmd %d", cmd)
+		}
+		m.Cmd = int(cmd)
+		return &m, nil
+	}
+	return nil, fmt.Errorf("proto: unsupported binary version %d", data[0])
+}
+
+const maxCmd = int(^uint32(0) >> 1)
+
+// Request decodes the payload of m as a Request.
+func (m *Message) Request() (*Request, error) {
+	var req Request
+	if m.Codec == JSON {
+		return &req, req.FromJSON(m.Payload)
+	}
+	r := binaryReader{b: m.Payload}
+	req.SourceID = string(r.bytes())
+	req.TargetID = string(r.bytes())
+	req.Body = r.bytes()
+	if n := r.uvarint(); n <= uint64(len(r.b)) {
+		for i := uint64(0); i < n; i++ {
+			req.Codecs = append(req.Codecs, string(r.bytes()))
+		}
+	} else {
+		r.err = errBinaryTruncated
+	}
+	return &req, r.end()
+}
+
+// Response decodes the payload of m as a Response.
+func (m *Message) Response() (*Response, error) {
+	var resp Response
+	if m.Codec == JSON {
+		return &resp, resp.FromJSON(m.Payload)
+	}
+	r := binaryReader{b: m.Payload}
+	code := r.varint()
+	resp.Msg = string(r.bytes())
+	resp.Body = r.bytes()
+	resp.Codec = string(r.bytes())
+	if code < -int64(maxCmd)-1 || code > int64(maxCmd) {
+		r.err = fmt.Errorf("proto: invalid code %d", code)
+	}
+	resp.Code = int(code)
+	return &resp, r.end()
+}
+
+func (m *Request) appendBinary(b []byte) []byte {
+	b = appendBytes(b, []byte(m.SourceID))
+	b = appendBytes(b, []byte(m.TargetID))
+	b = appendBytes(b, m.Body)
+	b = binary.AppendUvarint(b, uint64(len(m.Codecs)))
+	for _, name := range m.Codecs {
+		b = appendBytes(b, []byte(name))
+	}
+	return b
+}
+
+func (m *Response) appendBinary(b []byte) []byte {
+	b = binary.AppendVarint(b, int64(m.Code))
+	b = appendBytes(b, []byte(m.Msg))
+	b = appendBytes(b, m.Body)
+	return appendBytes(b, []byte(m.Codec))
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// binaryReader reads the fields of a Binary message, keeping the first
+// error.
+type binaryReader struct {
+	b   []byte
+	err error
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *binaryReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *binaryReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.b)) {
+		r.err = errBinaryTruncated
+		return nil
+	}
+	v := r.b[:n:n]
+	r.b = r.b[n:]
+	if n == 0 {
+		return nil
+	}
+	return v
+}
+
+// end reports the first error, or trailing bytes.
+func (r *binaryReader) end() error {
+	if r.err == nil && len(r.b) > 0 {
+		r.err = errors.New("proto: trailing bytes in binary message")
+	}
+	return r.err
+}
@@ -0,0 +1,208 @@
+package proto
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var codecs = []Codec{JSON, Binary}
+
+// normalize makes empty slices nil, as either codec may decode them as
+// both.
+func normalize(v interface{}) interface{} {
+	switch m := v.(type) {
+	case *Request:
+		r := *m
+		if len(r.Body) == 0 {
+			r.Body = nil
+		}
+		if len(r.Codecs) == 0 {
+			r.Codecs = nil
+		}
+		return r
+	case *Response:
+		r := *m
+		if len(r.Body) == 0 {
+			r.Body = nil
+		}
+		return r
+	}
+	return v
+}
+
+func TestRequestRoundTrip(t *testing.T) {
+	for _, c := range codecs {
+		for _, req := range []*Request{
+			{},
+			{SourceID: "offer-1", TargetID: "answer-1", Body: []byte(`{"type":"offer","sdp":"v=0\r\n"}`)},
+			{SourceID: "answer-1", Body: []byte{0, 1, 2, 0xff}, Codecs: Codecs()},
+			{SourceID: "ünïcode", TargetID: "\x00", Codecs: []string{""}},
+		} {
+			b, err := c.EncodeRequest(CmdInit, 42, req)
+			if err != nil {
+				t.Fatalf("%s: encode %+v: %v", c, req, err)
+			}
+			m, err := Decode(b)
+			if err != nil {
+				t.Fatalf("%s: decode %+v: %v", c, req, err)
+			}
+			if m.Cmd != CmdInit || m.Txn != 42 || m.Codec != c {
+				t.Fatalf("%s: got cmd %d txn %d codec %s", c, m.Cmd, m.Txn, m.Codec)
+			}
+			got, err := m.Request()
+			if err != nil {
+				t.Fatalf("%s: request of %+v: %v", c, req, err)
+			}
+			if !reflect.DeepEqual(normalize(got), normalize(req)) {
+				t.Fatalf("%s: got %+v, want %+v", c, got, req)
+			}
+		}
+	}
+}
+
+func TestResponseRoundTrip(t *testing.T) {
+	for _, c := range codecs {
+		for _, resp := range []*Response{
+			{},
+			{Code: CodeNotFound, Msg: "no such peer"},
+			{Code: -1, Body: []byte(`[{"id":"answer-1"}]`), Codec: Binary.String()},
+			{Code: maxCmd, Msg: "\xff", Body: []byte{0}},
+		} {
+			b, err := c.EncodeResponse(CmdLookupResp, 0, resp)
+			if err != nil {
+				t.Fatalf("%s: encode %+v: %v", c, resp, err)
+			}
+			m, err := Decode(b)
+			if err != nil {
+				t.Fatalf("%s: decode %+v: %v", c, resp, err)
+			}
+			if m.Cmd != CmdLookupResp || m.Txn != 0 || m.Codec != c {
+				t.Fatalf("%s: got cmd %d txn %d codec %s", c, m.Cmd, m.Txn, m.Codec)
+			}
+			got, err := m.Response()
+			if err != nil {
+				t.Fatalf("%s: response of %+v: %v", c, resp, err)
+			}
+			if c == JSON {
+				// JSON replaces invalid UTF-8
+				resp.Msg = string([]rune(resp.Msg))
+			}
+			if !reflect.DeepEqual(normalize(got), normalize(resp)) {
+				t.Fatalf("%s: got %+v, want %+v", c, got, resp)
+			}
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	for _, c := range codecs {
+		for _, m := range []Message{
+			{Cmd: CmdCandidate},
+			{Cmd: CmdBye, Txn: 1<<64 - 1, Payload: []byte("bye")},
+			{Cmd: maxCmd, Txn: 7, Payload: []byte{1, 0, 0xff}},
+		} {
+			b, err := c.encode(m.Cmd, m.Txn, m.Payload)
+			if err != nil {
+				t.Fatalf("%s: encode %+v: %v", c, m, err)
+			}
+			got, err := Decode(b)
+			if err != nil {
+				t.Fatalf("%s: decode %+v: %v", c, m, err)
+			}
+			if got.Cmd != m.Cmd || got.Txn != m.Txn || !bytes.Equal(got.Payload, m.Payload) || got.Codec != c {
+				t.Fatalf("%s: got %+v, want %+v", c, got, m)
+			}
+		}
+	}
+
+	if _, err := Binary.encode(-1, 0, nil); err == nil {
+		t.Fatal("binary encoded a negative cmd")
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	valid, err := Binary.EncodeRequest(CmdOffer, 3, &Request{SourceID: "a", Body: []byte("sdp")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range [][]byte{
+		nil,
+		{BinaryVersion + 1},
+		{BinaryVersion},
+		valid[:len(valid)-1],
+		append(append([]byte{}, valid...), 0),
+		[]byte(`{"command":`),
+	} {
+		if m, err := Decode(b); err == nil {
+			if _, err := m.Request(); err == nil {
+				t.Errorf("decoded %q", b)
+			}
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, c := range codecs {
+		b, _ := c.EncodeRequest(CmdInit, 1, &Request{SourceID: "a", TargetID: "b", Body: []byte("x"), Codecs: Codecs()})
+		f.Add(b)
+		b, _ = c.EncodeResponse(CmdInitResp, 1, &Response{Code: CodeBadRequest, Msg: "m", Body: []byte("y"), Codec: "json"})
+		f.Add(b)
+	}
+	f.Add([]byte(`{"command":1,"payload":null}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := Decode(data)
+		if err != nil {
+			return
+		}
+
+		b, err := m.Codec.encode(m.Cmd, m.Txn, m.Payload)
+		if err != nil {
+			t.Fatalf("encode %+v: %v", m, err)
+		}
+		again, err := Decode(b)
+		if err != nil {
+			t.Fatalf("decode of re-encoded %+v: %v", m, err)
+		}
+		if again.Cmd != m.Cmd || again.Txn != m.Txn || !bytes.Equal(again.Payload, m.Payload) || again.Codec != m.Codec {
+			t.Fatalf("got %+v, want %+v", again, m)
+		}
+
+		if req, err := m.Request(); err == nil {
+			b, err := m.Codec.EncodeRequest(m.Cmd, m.Txn, req)
+			if err != nil {
+				t.Fatalf("encode %+v: %v", req, err)
+			}
+			again, err := Decode(b)
+			if err != nil {
+				t.Fatalf("decode of re-encoded %+v: %v", req, err)
+			}
+			got, err := again.Request()
+			if err != nil {
+				t.Fatalf("request of re-encoded %+v: %v", req, err)
+			}
+			if !reflect.DeepEqual(normalize(got), normalize(req)) {
+				t.Fatalf("got %+v, want %+v", got, req)
+			}
+		}
+
+		if resp, err := m.Response(); err == nil {
+			b, err := m.Codec.EncodeResponse(m.Cmd, m.Txn, resp)
+			if err != nil {
+				t.Fatalf("encode %+v: %v", resp, err)
+			}
+			again, err := Decode(b)
+			if err != nil {
+				t.Fatalf("decode of re-encoded %+v: %v", resp, err)
+			}
+			got, err := again.Response()
+			if err != nil {
+				t.Fatalf("response of re-encoded %+v: %v", resp, err)
+			}
+			if !reflect.DeepEqual(normalize(got), normalize(resp)) {
+				t.Fatalf("got %+v, want %+v", got, resp)
+			}
+		}
+	})
+}
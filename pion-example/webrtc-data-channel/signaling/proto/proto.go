@@ -3,7 +3,8 @@ package proto
 import "encoding/json"
 
 const (
-	// originated from answer peer
+	// originated from answer peer, or from offer peer registering before
+	// its first offer
 	CmdInit = iota + 1
 	CmdAnswer
 
@@ -12,6 +13,18 @@ const (
 
 	// from both peer
 	CmdCandidate
+
+	// from both peer, hang up the session with the target. Also sent by
+	// the signaling server, on behalf of the source, when the source
+	// disconnects.
+	CmdBye
+
+	// from both peer, ask the signaling server about the registered
+	// answer peers. The body of a list request is an optional Query; a
+	// lookup request names the answer peer in TargetID. The response body
+	// is a []PeerInfo or a PeerInfo.
+	CmdList
+	CmdLookup
 )
 
 const (
@@ -19,11 +32,26 @@ const (
 	CmdAnswerResp
 	CmdOfferResp
 	CmdCandidateResp
+	CmdByeResp
+	CmdListResp
+	CmdLookupResp
+)
+
+// response codes
+const (
+	CodeOK         = 0
+	CodeNotFound   = 1 // the target peer is not registered
+	CodeBadRequest = 2 // the request body cannot be parsed
 )
 
 type Message struct {
-	Cmd     int    `json:"command"`
+	Cmd int `json:"command"`
+	// Txn identifies a request; its response carries the same Txn.
+	// 0 means the sender does not wait for the response.
+	Txn     uint64 `json:"txn,omitempty"`
 	Payload []byte `json:"payload"` // carry all kinds of request and response
+
+	Codec Codec `json:"-"` // the encoding of Payload, set by Decode
 }
 
 func (m Message) ToJSON() ([]byte, error) {
@@ -38,7 +66,10 @@ func (m *Message) FromJSON(data []byte) error {
 type Request struct {
 	SourceID string `json:"source"`
 	TargetID string `json:"target"`
-	Body     []byte `json:"body"` // carry register, offer, answer, candidate
+	Body     []byte `json:"body"` // carry register, offer, answer, candidate, or the optional reason of a bye
+
+	// Codecs are offered by a CmdInit request, preferred first.
+	Codecs []string `json:"codecs,omitempty"`
 }
 
 func (m Request) ToJSON() ([]byte, error) {
@@ -53,6 +84,10 @@ func (m *Request) FromJSON(data []byte) error {
 type Response struct {
 	Code int    `json:"code"`
 	Msg  string `json:"msg"`
+	Body []byte `json:"body,omitempty"` // carry the result of list, lookup
+
+	// Codec is picked by the response to CmdInit among the offered ones.
+	Codec string `json:"codec,omitempty"`
 }
 
 func (m Response) ToJSON() ([]byte, error) {
@@ -62,3 +97,92 @@ func (m Response) ToJSON() ([]byte, error) {
 func (m *Response) FromJSON(data []byte) error {
 	return json.Unmarshal(data, m)
 }
+
+// Candidate is the body of a CmdCandidate request. The fields match
+// webrtc.ICECandidateInit. Peers that predate it send the bare candidate
+// string as the body instead.
+type Candidate struct {
+	Candidate        string  `json:"candidate"`
+	SDPMid           *string `json:"sdpMid,omitempty"`
+	SDPMLineIndex    *uint16 `json:"sdpMLineIndex,omitempty"`
+	UsernameFragment *string `json:"usernameFragment,omitempty"`
+
+	// EndOfCandidates is set, with an empty Candidate, once the source has
+	// gathered all of its candidates.
+	EndOfCandidates bool `json:"endOfCandidates,omitempty"`
+}
+
+func (m Candidate) ToJSON() ([]byte, error) {
+	return json.Marshal(&m)
+}
+
+// FromJSON also accepts the bare candidate string of older peers.
+func (m *Candidate) FromJSON(data []byte) error {
+	if len(data) == 0 || data[0] != '{' {
+		*m = Candidate{Candidate: string(data)}
+		return nil
+	}
+	return json.Unmarshal(data, m)
+}
+
+// Capabilities is the optional body of a CmdInit request from an answer
+// peer, telling what it serves.
+type Capabilities struct {
+	Labels  []string `json:"labels,omitempty"` // data channel labels it accepts
+	Media   []string `json:"media,omitempty"`  // media kinds, e.g. "audio", "video"
+	Version string   `json:"version,omitempty"`
+}
+
+func (m Capabilities) ToJSON() ([]byte, error) {
+	return json.Marshal(&m)
+}
+
+// FromJSON accepts the empty body of peers registering without
+// capabilities.
+func (m *Capabilities) FromJSON(data []byte) error {
+	if len(data) == 0 {
+		*m = Capabilities{}
+		return nil
+	}
+	return json.Unmarshal(data, m)
+}
+
+// Has reports whether label, and kind, are supported. Empty arguments
+// match anything.
+func (m Capabilities) Has(label, kind string) bool {
+	return (label == "" || contains(m.Labels, label)) && (kind == "" || contains(m.Media, kind))
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Query is the body of a CmdList request. Empty fields match any peer.
+type Query struct {
+	Label string `json:"label,omitempty"`
+	Media string `json:"media,omitempty"`
+}
+
+func (m Query) ToJSON() ([]byte, error) {
+	return json.Marshal(&m)
+}
+
+func (m *Query) FromJSON(data []byte) error {
+	if len(data) == 0 {
+		*m = Query{}
+		return nil
+	}
+	return json.Unmarshal(data, m)
+}
+
+// PeerInfo describes a registered answer peer.
+type PeerInfo struct {
+	ID           string       `json:"id"`
+	Capabilities Capabilities `json:"capabilities"`
+	Sessions     int          `json:"sessions"` // offer peers connecting to it
+}
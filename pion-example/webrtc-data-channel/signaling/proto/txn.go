@@ -0,0 +1,91 @@
+package proto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is returned by Transactions.Do when no response arrives in time.
+var ErrTimeout = errors.New("proto: response timeout")
+
+// ResponseError is a response with a non-zero code.
+type ResponseError struct {
+	Cmd  int // the response command
+	Txn  uint64
+	Code int
+	Msg  string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("proto: resp[%d] txn %d: code %d: %s", e.Cmd, e.Txn, e.Code, e.Msg)
+}
+
+// Transactions pairs responses with the requests they answer, so a peer
+// with several requests in flight knows which one failed.
+type Transactions struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]chan *Message
+}
+
+func NewTransactions() *Transactions {
+	return &Transactions{pending: make(map[uint64]chan *Message)}
+}
+
+// Do gives m a new Txn, sends it with send and waits up to timeout for the
+// response passed to Resolve. A response with a non-zero code is returned
+// as a *ResponseError. Do must not be called from the goroutine that reads
+// the responses.
+func (t *Transactions) Do(m *Message, timeout time.Duration, send func(*Message) error) (*Response, error) {
+	ch := make(chan *Message, 1)
+	t.mu.Lock()
+	t.next++
+	m.Txn = t.next
+	t.pending[m.Txn] = ch
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, m.Txn)
+		t.mu.Unlock()
+	}()
+
+	if err := send(m); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case rm := <-ch:
+		resp, err := rm.Response()
+		if err != nil {
+			return nil, err
+		}
+		if resp.Code != CodeOK {
+			return resp, &ResponseError{Cmd: rm.Cmd, Txn: rm.Txn, Code: resp.Code, Msg: resp.Msg}
+		}
+		return resp, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: cmd %d txn %d", ErrTimeout, m.Cmd, m.Txn)
+	}
+}
+
+// Resolve hands the response message m to the Do waiting for it. It reports
+// false if no request is waiting for m, e.g. because it timed out.
+func (t *Transactions) Resolve(m *Message) bool {
+	t.mu.Lock()
+	ch, ok := t.pending[m.Txn]
+	t.mu.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- m:
+	default:
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"pion-webrtc-example/signaling/auth"
+)
+
+// duplicatePolicy decides what happens when an id that is already connected
+// logs in again.
+type duplicatePolicy int
+
+const (
+	// kickOld closes the existing session in favour of the new one.
+	kickOld duplicatePolicy = iota
+	// rejectNew refuses the new connection while the old one is alive.
+	rejectNew
+)
+
+func parseDuplicatePolicy(s string) (duplicatePolicy, error) {
+	switch s {
+	case "kick":
+		return kickOld, nil
+	case "reject":
+		return rejectNew, nil
+	}
+	return 0, fmt.Errorf("unknown duplicate policy %q", s)
+}
+
+func (p duplicatePolicy) String() string {
+	switch p {
+	case kickOld:
+		return "kick"
+	case rejectNew:
+		return "reject"
+	}
+	return "unknown"
+}
+
+var (
+	errDuplicateID  = errors.New("id already connected")
+	errMissingToken = errors.New("missing access token")
+	errWrongSubject = errors.New("token subject does not match id")
+)
+
+// authKey is the HMAC key access tokens are verified with. Authentication is
+// disabled when it is empty.
+var authKey []byte
+
+func loadAuthKey(key, file string) ([]byte, error) {
+	if file == "" {
+		return []byte(key), nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSpace(string(b))), nil
+}
+
+// tokenFromRequest returns the bearer token of r. Browsers cannot set headers
+// on a websocket upgrade, so ?token= is accepted as well.
+func tokenFromRequest(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authenticate verifies that r carries a valid token for id. It returns nil
+// claims when authentication is disabled.
+func authenticate(r *http.Request, id string) (*auth.Claims, error) {
+	claims, err := verifyRequest(r)
+	if err != nil || claims == nil {
+		return nil, err
+	}
+	if claims.Subject != id {
+		return nil, errWrongSubject
+	}
+	return claims, nil
+}
+
+// verifyRequest verifies the token of r, whatever its subject. It returns
+// nil claims when authentication is disabled.
+func verifyRequest(r *http.Request) (*auth.Claims, error) {
+	if len(authKey) == 0 {
+		return nil, nil
+	}
+
+	token := tokenFromRequest(r)
+	if token == "" {
+		return nil, errMissingToken
+	}
+	return auth.Verify(token, authKey, time.Now())
+}
@@ -0,0 +1,128 @@
+// Package auth issues and validates the access tokens of the signaling relay.
+//
+// Tokens are compact JWTs signed with HMAC-SHA256 (alg HS256). The subject is
+// the peer id the holder may register as, and targets lists the ids it may
+// send messages to as path.Match patterns.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed = errors.New("auth: malformed token")
+	ErrSignature = errors.New("auth: invalid signature")
+	ErrExpired   = errors.New("auth: token expired")
+	ErrNotYet    = errors.New("auth: token not valid yet")
+	ErrNoSubject = errors.New("auth: token has no subject")
+)
+
+// Claims is the payload of an access token.
+type Claims struct {
+	Subject   string   `json:"sub"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	Targets   []string `json:"targets,omitempty"`
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign encodes c as a JWT signed with key.
+func Sign(c Claims, key []byte) (string, error) {
+	if c.Subject == "" {
+		return "", ErrNoSubject
+	}
+
+	h, err := json.Marshal(header{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	p, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(p)
+	return signingInput + "." + encoding.EncodeToString(sign(signingInput, key)), nil
+}
+
+// Verify checks the signature and validity period of token and returns its claims.
+func Verify(token string, key []byte, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+
+	hb, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var h header
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return nil, ErrMalformed
+	}
+	if h.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported alg %q", ErrMalformed, h.Alg)
+	}
+
+	sig, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !hmac.Equal(sig, sign(parts[0]+"."+parts[1], key)) {
+		return nil, ErrSignature
+	}
+
+	pb, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	var c Claims
+	if err := json.Unmarshal(pb, &c); err != nil {
+		return nil, ErrMalformed
+	}
+	if c.Subject == "" {
+		return nil, ErrNoSubject
+	}
+	if c.ExpiresAt != 0 && now.Unix() >= c.ExpiresAt {
+		return nil, ErrExpired
+	}
+	if c.NotBefore != 0 && now.Unix() < c.NotBefore {
+		return nil, ErrNotYet
+	}
+	return &c, nil
+}
+
+// CanReach reports whether the holder may send messages to id. A token
+// without targets may reach anyone.
+func (c *Claims) CanReach(id string) bool {
+	if len(c.Targets) == 0 {
+		return true
+	}
+	for _, pattern := range c.Targets {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func sign(signingInput string, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var key = []byte("secret")
+
+// forge returns a token with header h and payload p, signed with key.
+func forge(h, p string, key []byte) string {
+	input := encoding.EncodeToString([]byte(h)) + "." + encoding.EncodeToString([]byte(p))
+	return input + "." + encoding.EncodeToString(sign(input, key))
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid, err := Sign(Claims{Subject: "alice", ExpiresAt: now.Unix() + 60, NotBefore: now.Unix() - 60}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"valid", valid, nil},
+		{"other key", forge(`{"alg":"HS256","typ":"JWT"}`, `{"sub":"alice"}`, []byte("other")), ErrSignature},
+		{"tampered payload", parts[0] + "." + encoding.EncodeToString([]byte(`{"sub":"mallory"}`)) + "." + parts[2], ErrSignature},
+		{"no signature", parts[0] + "." + parts[1] + ".", ErrSignature},
+		{"alg none", forge(`{"alg":"none","typ":"JWT"}`, `{"sub":"alice"}`, key), ErrMalformed},
+		{"alg none unsigned", encoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", ErrMalformed},
+		{"alg HS512", forge(`{"alg":"HS512","typ":"JWT"}`, `{"sub":"alice"}`, key), ErrMalformed},
+		{"alg RS256", forge(`{"alg":"RS256","typ":"JWT"}`, `{"sub":"alice"}`, key), ErrMalformed},
+		{"expired", forge(`{"alg":"HS256"}`, `{"sub":"alice","exp":1700000000}`, key), ErrExpired},
+		{"not valid yet", forge(`{"alg":"HS256"}`, `{"sub":"alice","nbf":1700000001}`, key), ErrNotYet},
+		{"no subject", forge(`{"alg":"HS256"}`, `{"exp":1800000000}`, key), ErrNoSubject},
+		{"two parts", parts[0] + "." + parts[1], ErrMalformed},
+		{"bad base64", "!." + parts[1] + "." + parts[2], ErrMalformed},
+		{"payload not JSON", forge(`{"alg":"HS256"}`, `alice`, key), ErrMalformed},
+	} {
+		c, err := Verify(tc.token, key, now)
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: Verify = %v, want %v", tc.name, err, tc.want)
+			continue
+		}
+		if err == nil && c.Subject != "alice" {
+			t.Errorf("%s: subject %q", tc.name, c.Subject)
+		}
+	}
+}
+
+func TestSignWithoutSubject(t *testing.T) {
+	if _, err := Sign(Claims{}, key); !errors.Is(err, ErrNoSubject) {
+		t.Fatalf("Sign = %v, want ErrNoSubject", err)
+	}
+}
+
+func TestCanReach(t *testing.T) {
+	for _, tc := range []struct {
+		targets []string
+		id      string
+		want    bool
+	}{
+		{nil, "anyone", true},
+		{[]string{"bob"}, "bob", true},
+		{[]string{"bob"}, "bobby", false},
+		{[]string{"room-*"}, "room-1", true},
+		{[]string{"room-*"}, "room-1/x", false},
+		{[]string{"room-*"}, "lobby", false},
+		{[]string{"bob", "room-?"}, "room-2", true},
+		{[]string{"["}, "[", false}, // bad pattern matches nothing
+	} {
+		c := &Claims{Subject: "alice", Targets: tc.targets}
+		if got := c.CanReach(tc.id); got != tc.want {
+			t.Errorf("targets %q CanReach(%q) = %t, want %t", tc.targets, tc.id, got, tc.want)
+		}
+	}
+}
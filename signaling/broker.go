@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"pion-webrtc-example/signaling/recording"
+)
+
+const (
+	brokerRelay = "relay" // deliver Data to client To
+	brokerKick  = "kick"  // client To logged in on another node
+	brokerFlush = "flush" // client To connected to node From, send it the messages stored for it
+)
+
+// errNodeUnreachable is returned by Publish when no node receives the
+// message.
+var errNodeUnreachable = errors.New("node not subscribed")
+
+// brokerMessage is sent between relay nodes.
+type brokerMessage struct {
+	Kind string          `json:"kind"`
+	From string          `json:"from,omitempty"`
+	To   string          `json:"to"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// broker tracks which relay node owns each client id and carries messages
+// between nodes, so several replicas can serve one id namespace.
+type broker interface {
+	// Claim records that node owns id and returns the previous owner, if any.
+	Claim(id, node string) (prev string, err error)
+	// Release forgets id if it is still owned by node.
+	Release(id, node string) error
+	// Owner returns the node owning id, or errClientNotFound.
+	Owner(id string) (string, error)
+	// Publish sends m to node. It returns errNodeUnreachable if node is
+	// not subscribed, e.g. because it crashed.
+	Publish(node string, m brokerMessage) error
+	// Broadcast sends m to every node, the sender included.
+	Broadcast(m brokerMessage) error
+	// Subscribe starts delivering messages addressed to node, or to every
+	// node, to handler.
+	Subscribe(node string, handler func(brokerMessage)) error
+	// Ping checks that the broker is reachable.
+	Ping() error
+	Close() error
+}
+
+func newBroker(kind, redisAddr, redisPassword string) (broker, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "local":
+		return newLocalBroker(), nil
+	case "redis":
+		return newRedisBroker(redisAddr, redisPassword), nil
+	}
+	return nil, fmt.Errorf("unknown broker %q", kind)
+}
+
+// attachBroker connects r to b as node and starts handling messages from
+// other nodes.
+func (r *registry) attachBroker(b broker, node string) error {
+	r.broker = b
+	r.node = node
+	return b.Subscribe(node, r.handleBrokerMessage)
+}
+
+// claim announces that this node now owns c. If another node owned the id
+// before, it is told to drop its session.
+func (r *registry) claim(c *client) {
+	prev, err := r.broker.Claim(c.id, r.node)
+	if err != nil {
+		log.Printf("Failed to claim client %s in broker: %v", c.id, err)
+		return
+	}
+	// the messages stored for c while it was offline may be on any node
+	if err := r.broker.Broadcast(brokerMessage{Kind: brokerFlush, From: r.node, To: c.id}); err != nil {
+		log.Printf("Failed to ask other nodes for the mailbox of client %s: %v", c.id, err)
+	}
+	if prev != "" && prev != r.node {
+		log.Printf("Client %s moved from node %s", c.id, prev)
+		err := r.broker.Publish(prev, brokerMessage{Kind: brokerKick, To: c.id})
+		if err != nil && !errors.Is(err, errNodeUnreachable) {
+			log.Printf("Failed to kick client %s on node %s: %v", c.id, prev, err)
+		}
+	}
+}
+
+func (r *registry) release(c *client) {
+	if err := r.broker.Release(c.id, r.node); err != nil {
+		log.Printf("Failed to release client %s in broker: %v", c.id, err)
+	}
+}
+
+// forward hands data to the node owning id. It reports false if no other
+// node owns id.
+func (r *registry) forward(from, id string, data []byte) (bool, error) {
+	node, err := r.broker.Owner(id)
+	if err == errClientNotFound || (err == nil && node == r.node) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	m := brokerMessage{Kind: brokerRelay, From: from, To: id, Data: data}
+	if err := r.broker.Publish(node, m); errors.Is(err, errNodeUnreachable) {
+		// the node is gone without releasing its clients, id is offline
+		log.Printf("Node %s owning client %s is unreachable, dropping its claim", node, id)
+		if err := r.broker.Release(id, node); err != nil {
+			log.Printf("Failed to release client %s in broker: %v", id, err)
+		}
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	log.Printf("Client %s is on node %s, message forwarded", id, node)
+	return true, nil
+}
+
+// handleBrokerMessage delivers a message published to this node.
+func (r *registry) handleBrokerMessage(m brokerMessage) {
+	c, ok := r.lookup(m.To)
+	switch m.Kind {
+	case brokerRelay:
+		if !ok {
+			log.Printf("Client %s not found for message from %s", m.To, m.From)
+			record(recording.Out, m.From, m.To, codeNotFound, m.Data)
+			return
+		}
+		if allowed, reason := r.mirrorCall(m); !allowed {
+			record(recording.Out, m.From, m.To, reason, m.Data)
+			return
+		}
+		result := "relayed"
+		if stored, err := r.deliver(c, m.From, m.Data); err != nil {
+			log.Printf("Failed to send message to client %s: %v", m.To, err)
+			result = dropSendFailed
+		} else if stored {
+			result = "queued"
+		}
+		record(recording.Out, m.From, m.To, result, m.Data)
+	case brokerFlush:
+		if m.From != r.node && r.mailbox != nil {
+			r.forwardMailbox(m.To)
+		}
+	case brokerKick:
+		if ok {
+			log.Printf("Client %s logged in on another node, closing", m.To)
+			c.evict(closeReplaced, "replaced by a login on another node")
+		}
+	default:
+		log.Printf("Unsupported broker message kind %q", m.Kind)
+	}
+}
+
+// localBroker is an in-process broker. Every node in the process that shares
+// it sees the same ownership table. With -broker local the relay runs as a
+// single node with it, tests run several registries on one.
+type localBroker struct {
+	mu     sync.RWMutex
+	owners map[string]string
+	inbox  map[string]chan brokerMessage
+}
+
+func newLocalBroker() *localBroker {
+	return &localBroker{
+		owners: make(map[string]string),
+		inbox:  make(map[string]chan brokerMessage),
+	}
+}
+
+func (b *localBroker) Claim(id, node string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev := b.owners[id]
+	b.owners[id] = node
+	return prev, nil
+}
+
+func (b *localBroker) Release(id, node string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.owners[id] == node {
+		delete(b.owners, id)
+	}
+	return nil
+}
+
+func (b *localBroker) Owner(id string) (string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	node, ok := b.owners[id]
+	if !ok {
+		return "", errClientNotFound
+	}
+	return node, nil
+}
+
+func (b *localBroker) Publish(node string, m brokerMessage) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	ch, ok := b.inbox[node]
+	if !ok {
+		return errNodeUnreachable
+	}
+	select {
+	case ch <- m:
+		return nil
+	default:
+		return fmt.Errorf("inbox of node %s is full", node)
+	}
+}
+
+func (b *localBroker) Broadcast(m brokerMessage) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for node, ch := range b.inbox {
+		select {
+		case ch <- m:
+		default:
+			return fmt.Errorf("inbox of node %s is full", node)
+		}
+	}
+	return nil
+}
+
+// Subscribe delivers messages for node in publish order on a dedicated
+// goroutine, so a handler never runs on the publisher's stack.
+func (b *localBroker) Subscribe(node string, handler func(brokerMessage)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.inbox[node]; ok {
+		return fmt.Errorf("node %s already subscribed", node)
+	}
+	ch := make(chan brokerMessage, 256)
+	b.inbox[node] = ch
+	go func() {
+		for m := range ch {
+			handler(m)
+		}
+	}()
+	return nil
+}
+
+func (b *localBroker) Ping() error {
+	return nil
+}
+
+func (b *localBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for node, ch := range b.inbox {
+		close(ch)
+		delete(b.inbox, node)
+	}
+	return nil
+}
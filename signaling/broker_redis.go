@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisOwnerKey     = "signaling:owners" // hash of client id -> node
+	redisNodeChannel  = "signaling:node:"  // pub/sub channel prefix, one per node
+	redisAllChannel   = "signaling:all"    // pub/sub channel of every node
+	redisDialTimeout  = 5 * time.Second
+	redisCmdTimeout   = 2 * time.Second // per command, a hung server must not stall the relay
+	redisRetryBackoff = time.Second
+)
+
+// claimScript stores the new owner and returns the previous one atomically.
+const claimScript = `local prev = redis.call("HGET", KEYS[1], ARGV[1]) redis.call("HSET", KEYS[1], ARGV[1], ARGV[2]) return prev`
+
+// releaseScript deletes the owner entry only if it still names the
+// releasing node, so a late disconnect cannot erase a newer login elsewhere.
+const releaseScript = `if redis.call("HGET", KEYS[1], ARGV[1]) == ARGV[2] then return redis.call("HDEL", KEYS[1], ARGV[1]) end return 0`
+
+// redisBroker shares ownership and messages between relay nodes through a
+// Redis-protocol server. It speaks RESP directly, so any compatible server
+// (Redis, KeyDB, a local stand-in) works.
+type redisBroker struct {
+	addr     string
+	password string
+	timeout  time.Duration // of each command
+
+	mu   sync.Mutex // guards conn, one command at a time
+	conn *respConn
+
+	subMu sync.Mutex
+	sub   *respConn // subscription connection
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newRedisBroker(addr, password string) *redisBroker {
+	return &redisBroker{
+		addr:     addr,
+		password: password,
+		timeout:  redisCmdTimeout,
+		closed:   make(chan struct{}),
+	}
+}
+
+// do runs one command, dialing or redialing the command connection as
+// needed.
+func (b *redisBroker) do(args ...string) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.conn == nil {
+		c, err := dialRESP(b.addr, b.password, b.timeout)
+		if err != nil {
+			return nil, err
+		}
+		b.conn = c
+	}
+
+	b.conn.SetDeadline(time.Now().Add(b.timeout))
+	reply, err := b.conn.do(args...)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		// the connection is in an unknown state, start over next time
+		b.conn.Close()
+		b.conn = nil
+	}
+	return reply, err
+}
+
+func (b *redisBroker) Claim(id, node string) (string, error) {
+	prev, err := b.do("EVAL", claimScript, "1", redisOwnerKey, id, node)
+	if err != nil {
+		return "", err
+	}
+	s, _ := prev.(string)
+	return s, nil
+}
+
+func (b *redisBroker) Release(id, node string) error {
+	_, err := b.do("EVAL", releaseScript, "1", redisOwnerKey, id, node)
+	return err
+}
+
+func (b *redisBroker) Owner(id string) (string, error) {
+	reply, err := b.do("HGET", redisOwnerKey, id)
+	if err != nil {
+		return "", err
+	}
+	node, ok := reply.(string)
+	if !ok {
+		return "", errClientNotFound
+	}
+	return node, nil
+}
+
+func (b *redisBroker) Publish(node string, m brokerMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	reply, err := b.do("PUBLISH", redisNodeChannel+node, string(data))
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return errNodeUnreachable
+	}
+	return nil
+}
+
+func (b *redisBroker) Broadcast(m brokerMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = b.do("PUBLISH", redisAllChannel, string(data))
+	return err
+}
+
+// Subscribe listens on the channels of node and of every node on a
+// dedicated connection and resubscribes after connection loss until the
+// broker is closed.
+func (b *redisBroker) Subscribe(node string, handler func(brokerMessage)) error {
+	c, err := b.subscribe(node)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			b.receive(c, handler)
+			select {
+			case <-b.closed:
+				return
+			case <-time.After(redisRetryBackoff):
+			}
+			var err error
+			if c, err = b.subscribe(node); err != nil {
+				log.Printf("Failed to resubscribe to broker: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (b *redisBroker) subscribe(node string) (*respConn, error) {
+	c, err := dialRESP(b.addr, b.password, b.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(b.timeout))
+	// the confirmation of the second channel is skipped by receive
+	if _, err := c.do("SUBSCRIBE", redisNodeChannel+node, redisAllChannel); err != nil {
+		c.Close()
+		return nil, err
+	}
+	// pushes may be far apart
+	c.SetDeadline(time.Time{})
+
+	b.subMu.Lock()
+	defer b.subMu.Unlock()
+	select {
+	case <-b.closed:
+		c.Close()
+		return nil, errors.New("redis: broker closed")
+	default:
+	}
+	b.sub = c
+	return c, nil
+}
+
+// receive hands pushed messages to handler until c fails.
+func (b *redisBroker) receive(c *respConn, handler func(brokerMessage)) {
+	if c == nil {
+		return
+	}
+	defer c.Close()
+
+	for {
+		reply, err := c.read()
+		if err != nil {
+			select {
+			case <-b.closed:
+			default:
+				log.Printf("Broker subscription lost: %v", err)
+			}
+			return
+		}
+
+		// ["message", channel, payload]
+		push, ok := reply.([]interface{})
+		if !ok || len(push) != 3 || push[0] != "message" {
+			continue
+		}
+		payload, _ := push[2].(string)
+		var m brokerMessage
+		if err := json.Unmarshal([]byte(payload), &m); err != nil {
+			log.Printf("Failed to parse broker message: %v", err)
+			continue
+		}
+		handler(m)
+	}
+}
+
+func (b *redisBroker) Ping() error {
+	_, err := b.do("PING")
+	return err
+}
+
+func (b *redisBroker) Close() error {
+	b.once.Do(func() { close(b.closed) })
+
+	b.subMu.Lock()
+	if b.sub != nil {
+		b.sub.Close()
+		b.sub = nil
+	}
+	b.subMu.Unlock()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		err := b.conn.Close()
+		b.conn = nil
+		return err
+	}
+	return nil
+}
+
+// redisError is an error reply sent by the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// respConn is a minimal RESP2 client connection.
+type respConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// dialRESP connects to addr and authenticates within timeout.
+func dialRESP(addr, password string, timeout time.Duration) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{Conn: conn, r: bufio.NewReader(conn)}
+	if password != "" {
+		c.SetDeadline(time.Now().Add(timeout))
+		if _, err := c.do("AUTH", password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do writes a command as an array of bulk strings and reads one reply.
+func (c *respConn) do(args ...string) (interface{}, error) {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, a...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// read parses one reply. Bulk strings become string, nil bulk strings and
+// arrays become nil, integers become int64 and arrays become []interface{}.
+func (c *respConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
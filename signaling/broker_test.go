@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"pion-webrtc-example/signaling/recording"
+)
+
+// fakeRedis is an in-process stand-in for a Redis server, supporting the
+// commands of redisBroker. EVAL only runs claimScript and releaseScript.
+type fakeRedis struct {
+	ln net.Listener
+
+	mu     sync.Mutex
+	hashes map[string]map[string]string
+	subs   map[string][]*fakeRedisConn // by channel
+}
+
+type fakeRedisConn struct {
+	net.Conn
+	mu sync.Mutex // serializes the writes, pushes come from publishers
+}
+
+func (c *fakeRedisConn) reply(v interface{}) {
+	var buf []byte
+	buf = appendRESP(buf, v)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Write(buf)
+}
+
+func appendRESP(buf []byte, v interface{}) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(buf, "$-1\r\n"...)
+	case redisError:
+		return append(buf, "-"+string(v)+"\r\n"...)
+	case int:
+		return append(buf, ":"+strconv.Itoa(v)+"\r\n"...)
+	case string:
+		return append(buf, "$"+strconv.Itoa(len(v))+"\r\n"+v+"\r\n"...)
+	case []interface{}:
+		buf = append(buf, "*"+strconv.Itoa(len(v))+"\r\n"...)
+		for _, item := range v {
+			buf = appendRESP(buf, item)
+		}
+		return buf
+	}
+	panic(fmt.Sprintf("unsupported reply %T", v))
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeRedis{
+		ln:     ln,
+		hashes: make(map[string]map[string]string),
+		subs:   make(map[string][]*fakeRedisConn),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(&fakeRedisConn{Conn: conn})
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) addr() string { return s.ln.Addr().String() }
+
+func (s *fakeRedis) serve(c *fakeRedisConn) {
+	defer c.Close()
+	r := &respConn{Conn: c.Conn, r: bufio.NewReader(c.Conn)}
+	for {
+		req, err := r.read()
+		if err != nil {
+			s.unsubscribe(c)
+			return
+		}
+		items, _ := req.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		if len(args) == 0 {
+			c.reply(redisError("ERR empty command"))
+			continue
+		}
+		c.reply(s.run(c, args))
+	}
+}
+
+func (s *fakeRedis) run(c *fakeRedisConn, args []string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case args[0] == "PING":
+		// a simple string for Redis, respConn reads both as string
+		return "PONG"
+	case args[0] == "HGET" && len(args) == 3:
+		return s.hget(args[1], args[2])
+	case args[0] == "EVAL" && len(args) == 6 && args[1] == claimScript:
+		prev := s.hget(args[3], args[4])
+		s.hset(args[3], args[4], args[5])
+		return prev
+	case args[0] == "EVAL" && len(args) == 6 && args[1] == releaseScript:
+		if s.hget(args[3], args[4]) == args[5] {
+			delete(s.hashes[args[3]], args[4])
+			return 1
+		}
+		return 0
+	case args[0] == "PUBLISH" && len(args) == 3:
+		subs := s.subs[args[1]]
+		for _, sub := range subs {
+			sub.reply([]interface{}{"message", args[1], args[2]})
+		}
+		return len(subs)
+	case args[0] == "SUBSCRIBE" && len(args) >= 2:
+		// one confirmation per channel
+		for i, channel := range args[1:] {
+			s.subs[channel] = append(s.subs[channel], c)
+			if i < len(args)-2 {
+				c.reply([]interface{}{"subscribe", channel, i + 1})
+			}
+		}
+		return []interface{}{"subscribe", args[len(args)-1], len(args) - 1}
+	}
+	return redisError("ERR unsupported command")
+}
+
+func (s *fakeRedis) hget(key, field string) interface{} {
+	if v, ok := s.hashes[key][field]; ok {
+		return v
+	}
+	return nil
+}
+
+func (s *fakeRedis) hset(key, field, value string) {
+	if s.hashes[key] == nil {
+		s.hashes[key] = make(map[string]string)
+	}
+	s.hashes[key][field] = value
+}
+
+func (s *fakeRedis) unsubscribe(c *fakeRedisConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for channel, subs := range s.subs {
+		for i, sub := range subs {
+			if sub == c {
+				s.subs[channel] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+func TestRedisBrokerOwnership(t *testing.T) {
+	b := newRedisBroker(newFakeRedis(t).addr(), "")
+	defer b.Close()
+
+	if prev, err := b.Claim("a", "node1"); err != nil || prev != "" {
+		t.Fatalf("first Claim = %q, %v", prev, err)
+	}
+	if node, err := b.Owner("a"); err != nil || node != "node1" {
+		t.Fatalf("Owner = %q, %v", node, err)
+	}
+	if prev, err := b.Claim("a", "node2"); err != nil || prev != "node1" {
+		t.Fatalf("second Claim = %q, %v, want node1", prev, err)
+	}
+
+	// a late release of the previous owner keeps the new one
+	if err := b.Release("a", "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if node, err := b.Owner("a"); err != nil || node != "node2" {
+		t.Fatalf("Owner after stale Release = %q, %v", node, err)
+	}
+	if err := b.Release("a", "node2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Owner("a"); err != errClientNotFound {
+		t.Fatalf("Owner after Release = %v, want errClientNotFound", err)
+	}
+	if err := b.Ping(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisBrokerPublish(t *testing.T) {
+	b := newRedisBroker(newFakeRedis(t).addr(), "")
+	defer b.Close()
+
+	received := make(chan brokerMessage, 1)
+	if err := b.Subscribe("node1", func(m brokerMessage) { received <- m }); err != nil {
+		t.Fatal(err)
+	}
+	sent := brokerMessage{Kind: brokerRelay, From: "a", To: "b", Data: []byte(`{"type":"offer"}`)}
+	if err := b.Publish("node1", sent); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-received:
+		if m.Kind != sent.Kind || m.From != sent.From || m.To != sent.To || string(m.Data) != string(sent.Data) {
+			t.Fatalf("got %+v, want %+v", m, sent)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	if err := b.Publish("node2", sent); !errors.Is(err, errNodeUnreachable) {
+		t.Fatalf("Publish to a node without subscribers = %v, want errNodeUnreachable", err)
+	}
+}
+
+func TestRedisBrokerTimeout(t *testing.T) {
+	// a server that accepts and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	b := newRedisBroker(ln.Addr().String(), "")
+	b.timeout = 100 * time.Millisecond
+	defer b.Close()
+
+	start := time.Now()
+	var ne net.Error
+	if err := b.Ping(); !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("Ping of a hung server = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Ping took %s", d)
+	}
+}
+
+func TestForwardBetweenNodes(t *testing.T) {
+	b := newLocalBroker()
+	defer b.Close()
+	node1, node2 := newRegistry(4, dropOldest), newRegistry(4, dropOldest)
+	if err := node1.attachBroker(b, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node2.attachBroker(b, "node2"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "record.jsonl")
+	w, err := recording.NewWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = w
+	defer func() {
+		recorder = nil
+		w.Close()
+	}()
+
+	c, _, err := node1.register(nil, peerInfo{ID: "a"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node1.unregister(c)
+	if _, err := node2.relay("b", "a", []byte(`"hello"`)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-c.send:
+		if string(data) != `"hello"` {
+			t.Fatalf("got %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not forwarded")
+	}
+
+	// the node delivering the message records it, right after queueing it
+	var entries []recording.Entry
+	for deadline := time.Now().Add(5 * time.Second); len(entries) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := recording.Read(bytes.NewReader(data), func(e recording.Entry) error {
+			entries = append(entries, e)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(entries) != 1 || entries[0].Direction != recording.Out || entries[0].From != "b" || entries[0].To != "a" || entries[0].Result != "relayed" {
+		t.Fatalf("recorded %+v, want b to a relayed", entries)
+	}
+}
+
+func TestForwardToCrashedNode(t *testing.T) {
+	b := newRedisBroker(newFakeRedis(t).addr(), "")
+	defer b.Close()
+	r := newRegistry(4, dropOldest)
+	if err := r.attachBroker(b, "node1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// node2 claimed a and crashed, it never released nor subscribes
+	if _, err := b.Claim("a", "node2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.relay("b", "a", []byte(`"hello"`)); err != errClientNotFound {
+		t.Fatalf("relay to a client of a crashed node = %v, want errClientNotFound", err)
+	}
+	if _, err := b.Owner("a"); err != errClientNotFound {
+		t.Fatalf("stale owner kept: %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+// call-control message kinds
+const (
+	kindInvite  = "invite"
+	kindRinging = "ringing"
+	kindAccept  = "accept"
+	kindDecline = "decline"
+	kindBusy    = "busy"
+	kindCancel  = "cancel"
+	kindHangup  = "hangup"
+	kindTimeout = "timeout" // sent by the relay only
+)
+
+// codeCallState rejects a message that does not fit the call between its
+// sender and target.
+const codeCallState = "call-state"
+
+type callState int
+
+const (
+	callInviting callState = iota // invite sent, callee not heard from yet
+	callRinging                   // callee is alerting its user
+	callAccepted                  // media may be negotiated
+)
+
+func (s callState) String() string {
+	switch s {
+	case callInviting:
+		return "inviting"
+	case callRinging:
+		return "ringing"
+	case callAccepted:
+		return "accepted"
+	}
+	return "unknown"
+}
+
+// call is a 1:1 call session tracked by the relay.
+type call struct {
+	caller string
+	callee string
+	state  callState
+	timer  *time.Timer // ends an unanswered invite
+}
+
+// peer returns the other participant of c.
+func (c *call) peer(id string) string {
+	if id == c.caller {
+		return c.callee
+	}
+	return c.caller
+}
+
+// callTable holds the calls of the clients. A client takes part in at most
+// one call at a time.
+type callTable struct {
+	timeout time.Duration // for unanswered invites, 0 for none
+	require bool          // envelope offers, answers and candidates need an accepted call
+
+	// onTimeout is called without the lock held for an invite that timed out.
+	onTimeout func(*call)
+
+	mu    sync.Mutex
+	calls map[string]*call // by caller and by callee
+}
+
+func newCallTable() *callTable {
+	return &callTable{calls: make(map[string]*call)}
+}
+
+// apply checks that from may send a message of kind to to and moves the call
+// between them to its next state. busy is set if an invite was refused
+// because to is in another call. Messages of other kinds pass unchecked.
+func (t *callTable) apply(from, to, kind string) (busy bool, err *relayError) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.calls[from]
+	between := c != nil && c.peer(from) == to
+	bad := func(format string, args ...interface{}) (bool, *relayError) {
+		return false, newRelayError(codeCallState, format, args...)
+	}
+
+	switch kind {
+	case kindInvite:
+		if c != nil {
+			return bad("already in a call with %s", c.peer(from))
+		}
+		if from == to {
+			return bad("cannot call yourself")
+		}
+		if t.calls[to] != nil {
+			return true, nil
+		}
+		c = &call{caller: from, callee: to, state: callInviting}
+		if t.timeout > 0 {
+			c.timer = time.AfterFunc(t.timeout, func() { t.expire(c) })
+		}
+		t.calls[from] = c
+		t.calls[to] = c
+	case kindRinging, kindAccept, kindDecline, kindBusy:
+		if !between || c.callee != from || c.state == callAccepted {
+			return bad("no call from %s to answer", to)
+		}
+		switch kind {
+		case kindRinging:
+			c.state = callRinging
+		case kindAccept:
+			c.state = callAccepted
+			c.stopTimer()
+		default:
+			t.remove(c)
+		}
+	case kindCancel:
+		if !between || c.caller != from || c.state == callAccepted {
+			return bad("no pending call to %s to cancel", to)
+		}
+		t.remove(c)
+	case kindHangup:
+		if !between || c.state != callAccepted {
+			return bad("no accepted call with %s to hang up", to)
+		}
+		t.remove(c)
+	case kindOffer, kindAnswer, kindCandidate:
+		if t.require && (!between || c.state != callAccepted) {
+			return bad("%s needs an accepted call with %s", kind, to)
+		}
+	case kindTimeout:
+		return false, newRelayError(codeUnknownType, "%s is sent by the relay only", kind)
+	}
+	return false, nil
+}
+
+// checksLegacy reports whether a legacy message of kind goes through the
+// call table. Legacy clients predate call control, but their offers,
+// answers and candidates still need an accepted call when one is required.
+func (t *callTable) checksLegacy(kind string) bool {
+	return t.require && (kind == kindOffer || kind == kindAnswer || kind == kindCandidate)
+}
+
+// abort ends the pending call from from to to, after its invite could not be
+// delivered.
+func (t *callTable) abort(from, to string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if c := t.calls[from]; c != nil && c.caller == from && c.callee == to && c.state != callAccepted {
+		t.remove(c)
+	}
+}
+
+// leave ends the call of id, if any, and returns it.
+func (t *callTable) leave(id string) *call {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c := t.calls[id]
+	if c != nil {
+		t.remove(c)
+	}
+	return c
+}
+
+// expire ends c if it is still unanswered.
+func (t *callTable) expire(c *call) {
+	t.mu.Lock()
+	if t.calls[c.caller] != c || c.state == callAccepted {
+		t.mu.Unlock()
+		return
+	}
+	t.remove(c)
+	t.mu.Unlock()
+
+	if t.onTimeout != nil {
+		t.onTimeout(c)
+	}
+}
+
+// remove must be called with t.mu held.
+func (t *callTable) remove(c *call) {
+	c.stopTimer()
+	if t.calls[c.caller] == c {
+		delete(t.calls, c.caller)
+	}
+	if t.calls[c.callee] == c {
+		delete(t.calls, c.callee)
+	}
+}
+
+func (c *call) stopTimer() {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// callNotice builds a call-control envelope the relay sends on behalf of
+// from.
+func callNotice(kind, from, to, txn string) []byte {
+	data, err := json.Marshal(envelope{V: envelopeVersion, Type: kind, From: from, To: to, Txn: txn})
+	if err != nil {
+		log.Printf("Failed to marshal %s notice: %v", kind, err)
+	}
+	return data
+}
+
+// admitCall applies msg from c to the call table. It reports whether msg may
+// be relayed; if not, c has been answered and reason tells why.
+func (r *registry) admitCall(c *client, msg *routedMessage) (ok bool, reason string) {
+	if msg.Legacy && !r.calls.checksLegacy(msg.Type) {
+		return true, ""
+	}
+	busy, err := r.calls.apply(c.id, msg.To, msg.Type)
+	if err != nil {
+		log.Printf("Client %s sent %s out of call state: %v", c.id, msg.Type, err)
+		err.Txn = msg.Txn
+		c.sendError(err)
+		return false, dropCallState
+	}
+	if busy {
+		log.Printf("Client %s is busy, refusing invite from %s", msg.To, c.id)
+		if err := c.enqueue(callNotice(kindBusy, msg.To, c.id, msg.Txn)); err != nil {
+			log.Printf("Failed to send busy to client %s: %v", c.id, err)
+		}
+		return false, dropBusy
+	}
+	return true, ""
+}
+
+// mirrorCall applies a message relayed by another node to the local call
+// table, so both nodes of a call agree on its state. It reports whether the
+// message may be delivered and, if not, why.
+func (r *registry) mirrorCall(m brokerMessage) (bool, string) {
+	var env struct {
+		To   string `json:"to"`
+		Type string `json:"type"`
+		Txn  string `json:"txn"`
+	}
+	json.Unmarshal(m.Data, &env)
+	if env.To == "" && !r.calls.checksLegacy(env.Type) {
+		// the legacy format, relayed outside of calls
+		return true, ""
+	}
+
+	busy, err := r.calls.apply(m.From, m.To, env.Type)
+	if err != nil {
+		log.Printf("Dropping %s from %s to %s: %v", env.Type, m.From, m.To, err)
+		return false, dropCallState
+	}
+	if busy {
+		log.Printf("Client %s is busy, refusing invite from %s", m.To, m.From)
+		if _, err := r.relay(m.To, m.From, callNotice(kindBusy, m.To, m.From, env.Txn)); err != nil {
+			log.Printf("Failed to send busy to client %s: %v", m.From, err)
+		}
+		return false, dropBusy
+	}
+	return true, ""
+}
+
+// endCall tells the peer of id that its call is over because id left.
+func (r *registry) endCall(id string) {
+	c := r.calls.leave(id)
+	if c == nil {
+		return
+	}
+	kind := kindHangup
+	if c.state != callAccepted {
+		kind = kindDecline
+		if id == c.caller {
+			kind = kindCancel
+		}
+	}
+	peer := c.peer(id)
+	log.Printf("Client %s left its call with %s, sending %s", id, peer, kind)
+	if _, err := r.relay(id, peer, callNotice(kind, id, peer, "")); err != nil {
+		log.Printf("Failed to send %s to client %s: %v", kind, peer, err)
+	}
+}
+
+// callTimedOut tells the local participants of c that nobody answered.
+func (r *registry) callTimedOut(c *call) {
+	log.Printf("Call from %s to %s timed out", c.caller, c.callee)
+	for _, id := range []string{c.caller, c.callee} {
+		if cl, ok := r.lookup(id); ok {
+			cl.enqueue(callNotice(kindTimeout, c.peer(id), id, ""))
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// admitter returns a function admitting the raw messages of c to r's calls.
+func admitter(t *testing.T, r *registry, c *client) func(raw string) (bool, string) {
+	return func(raw string) (bool, string) {
+		t.Helper()
+		msg, rerr := routeMessage(c.id, []byte(raw))
+		if rerr != nil {
+			t.Fatal(rerr)
+		}
+		return r.admitCall(c, msg)
+	}
+}
+
+// callMsg is an envelope of kind to to.
+func callMsg(kind, to string) string {
+	return `{"v":1,"type":"` + kind + `","to":"` + to + `"}`
+}
+
+// nextEnvelope returns the next message queued for c.
+func nextEnvelope(t *testing.T, c *client) envelope {
+	t.Helper()
+	select {
+	case data := <-c.send:
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			t.Fatalf("message %s for %s: %v", data, c.id, err)
+		}
+		return env
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no message for %s", c.id)
+	}
+	return envelope{}
+}
+
+// registerAll registers a client for each id, unregistered at the end of
+// the test.
+func registerAll(t *testing.T, r *registry, ids ...string) []*client {
+	t.Helper()
+	var cs []*client
+	for _, id := range ids {
+		c, _, err := r.register(nil, peerInfo{ID: id}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { r.unregister(c) })
+		cs = append(cs, c)
+	}
+	return cs
+}
+
+func TestCallRequired(t *testing.T) {
+	r := newRegistry(4, dropOldest)
+	r.calls.require = true
+	a := newClient(peerInfo{ID: "a"}, nil, 4, dropOldest)
+	admit := admitter(t, r, a)
+	offer := `{"v":1,"type":"offer","to":"b","payload":{"type":"offer","sdp":"v=0"}}`
+	legacyOffer := `{"id":"b","type":"offer","sdp":"v=0"}`
+
+	for _, m := range []string{offer, legacyOffer} {
+		if ok, reason := admit(m); ok || reason != dropCallState {
+			t.Fatalf("%s relayed outside of a call", m)
+		}
+	}
+	if ok, _ := admit(`{"id":"b","type":"chat"}`); !ok {
+		t.Fatal("legacy message of another type refused")
+	}
+
+	if ok, _ := admit(callMsg(kindInvite, "b")); !ok {
+		t.Fatal("invite refused")
+	}
+	if ok, _ := admit(offer); ok {
+		t.Fatal("offer relayed before the call was accepted")
+	}
+	if _, err := r.calls.apply("b", "a", kindAccept); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{offer, legacyOffer} {
+		if ok, _ := admit(m); !ok {
+			t.Fatalf("%s refused within an accepted call", m)
+		}
+	}
+
+	// without -require-call anything goes
+	r = newRegistry(4, dropOldest)
+	admit = admitter(t, r, a)
+	for _, m := range []string{offer, legacyOffer} {
+		if ok, _ := admit(m); !ok {
+			t.Fatalf("%s refused with calls not required", m)
+		}
+	}
+}
+
+func TestCallInviteTimeout(t *testing.T) {
+	r := newRegistry(4, dropOldest)
+	r.calls.timeout = 20 * time.Millisecond
+	cs := registerAll(t, r, "a", "b")
+	a, b := cs[0], cs[1]
+
+	if ok, _ := admitter(t, r, a)(callMsg(kindInvite, "b")); !ok {
+		t.Fatal("invite refused")
+	}
+	if env := nextEnvelope(t, a); env.Type != kindTimeout || env.From != "b" {
+		t.Fatalf("caller got %+v, want a timeout from b", env)
+	}
+	if env := nextEnvelope(t, b); env.Type != kindTimeout || env.From != "a" {
+		t.Fatalf("callee got %+v, want a timeout from a", env)
+	}
+	if c := r.calls.leave("a"); c != nil {
+		t.Fatal("timed out call still in the table")
+	}
+}
+
+func TestCallBusy(t *testing.T) {
+	r := newRegistry(4, dropOldest)
+	cs := registerAll(t, r, "a", "b", "c")
+	a, c := cs[0], cs[2]
+
+	if ok, _ := admitter(t, r, a)(callMsg(kindInvite, "b")); !ok {
+		t.Fatal("invite refused")
+	}
+	ok, reason := admitter(t, r, c)(`{"v":1,"type":"invite","to":"b","txn":"t1"}`)
+	if ok || reason != dropBusy {
+		t.Fatalf("invite of a callee in a call = %t, %q, want refused as busy", ok, reason)
+	}
+	if env := nextEnvelope(t, c); env.Type != kindBusy || env.From != "b" || env.Txn != "t1" {
+		t.Fatalf("got %+v, want busy from b for t1", env)
+	}
+
+	// calling oneself, or calling while in a call, is a call-state error
+	if ok, reason := admitter(t, r, c)(callMsg(kindInvite, "c")); ok || reason != dropCallState {
+		t.Fatal("self call admitted")
+	}
+	if ok, reason := admitter(t, r, a)(callMsg(kindInvite, "c")); ok || reason != dropCallState {
+		t.Fatal("second call admitted")
+	}
+}
+
+func TestCallCancelDecline(t *testing.T) {
+	r := newRegistry(4, dropOldest)
+	a := newClient(peerInfo{ID: "a"}, nil, 4, dropOldest)
+	b := newClient(peerInfo{ID: "b"}, nil, 4, dropOldest)
+	fromA, fromB := admitter(t, r, a), admitter(t, r, b)
+
+	for _, step := range []struct {
+		admit func(string) (bool, string)
+		msg   string
+		ok    bool
+	}{
+		{fromA, callMsg(kindInvite, "b"), true},
+		{fromB, callMsg(kindRinging, "a"), true},
+		{fromA, callMsg(kindAccept, "b"), false}, // only the callee accepts
+		{fromA, callMsg(kindCancel, "b"), true},
+		{fromB, callMsg(kindDecline, "a"), false}, // canceled already
+		{fromA, callMsg(kindInvite, "b"), true},
+		{fromB, callMsg(kindDecline, "a"), true},
+		{fromA, callMsg(kindCancel, "b"), false}, // declined already
+		{fromA, callMsg(kindHangup, "b"), false}, // never accepted
+		{fromA, callMsg(kindInvite, "b"), true},
+		{fromB, callMsg(kindAccept, "a"), true},
+		{fromA, callMsg(kindCancel, "b"), false}, // accepted calls are hung up
+		{fromB, callMsg(kindHangup, "a"), true},
+		{fromA, callMsg(kindTimeout, "b"), false}, // sent by the relay only
+	} {
+		if ok, _ := step.admit(step.msg); ok != step.ok {
+			t.Fatalf("%s admitted %t, want %t", step.msg, ok, step.ok)
+		}
+	}
+}
+
+func TestCallEndsOnDisconnect(t *testing.T) {
+	for _, tc := range []struct {
+		accept bool
+		leaver int
+		want   string
+	}{
+		{true, 0, kindHangup},
+		{true, 1, kindHangup},
+		{false, 0, kindCancel},
+		{false, 1, kindDecline},
+	} {
+		r := newRegistry(4, dropOldest)
+		cs := registerAll(t, r, "a", "b")
+		if ok, _ := admitter(t, r, cs[0])(callMsg(kindInvite, "b")); !ok {
+			t.Fatal("invite refused")
+		}
+		if tc.accept {
+			if ok, _ := admitter(t, r, cs[1])(callMsg(kindAccept, "a")); !ok {
+				t.Fatal("accept refused")
+			}
+		}
+
+		leaver, peer := cs[tc.leaver], cs[1-tc.leaver]
+		r.unregister(leaver)
+		if env := nextEnvelope(t, peer); env.Type != tc.want || env.From != leaver.id {
+			t.Fatalf("accepted %t, %s left: %s got %+v, want %s", tc.accept, leaver.id, peer.id, env, tc.want)
+		}
+		if c := r.calls.leave(peer.id); c != nil {
+			t.Fatal("call still in the table")
+		}
+	}
+}
+
+func TestCallKindsHaveMetricLabels(t *testing.T) {
+	for _, kind := range []string{kindInvite, kindRinging, kindAccept, kindDecline, kindBusy, kindCancel, kindHangup, kindTimeout} {
+		if got := metricType(kind); got != kind {
+			t.Errorf("metricType(%q) = %q", kind, got)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix is prepended to the upper-cased flag name to form the environment
+// variable of a setting, e.g. -tls-cert is read from SIGNALING_TLS_CERT.
+const envPrefix = "SIGNALING_"
+
+var configFile = flag.String("config", "", "YAML or JSON config file, keyed by flag name")
+
+// loadConfig fills every flag that was not given on the command line from
+// its environment variable or, failing that, from the config file. The
+// precedence is flags, then environment, then config file, then defaults.
+func loadConfig(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	path := *configFile
+	if !set["config"] {
+		if v, ok := os.LookupEnv(envName("config")); ok {
+			path = v
+		}
+	}
+	file, err := readConfigFile(path)
+	if err != nil {
+		return err
+	}
+
+	var ferr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if ferr != nil || set[f.Name] || f.Name == "config" {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			var v interface{}
+			if v, ok = file[f.Name]; !ok {
+				return
+			}
+			value = configValue(v)
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			ferr = fmt.Errorf("invalid value %q for %s: %w", value, f.Name, err)
+		}
+	})
+	return ferr
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// readConfigFile decodes a YAML or JSON file into a map keyed by flag name.
+// The format is chosen by extension, YAML being a superset of JSON for
+// anything else.
+func readConfigFile(path string) (map[string]interface{}, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{})
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, &m)
+	} else {
+		err = yaml.Unmarshal(data, &m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return m, nil
+}
+
+// configValue renders a decoded config value in flag syntax. Lists become
+// comma separated strings.
+func configValue(v interface{}) string {
+	switch v := v.(type) {
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = configValue(item)
+		}
+		return strings.Join(items, ",")
+	case float64:
+		// JSON numbers, avoid exponent notation for large integers
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// splitList splits a comma separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testFlags returns a FlagSet parsed from args, and the config file path
+// loadConfig reads, restored at the end of the test.
+func testFlags(t *testing.T, args ...string) *flag.FlagSet {
+	t.Helper()
+	fs := flag.NewFlagSet("signaling", flag.ContinueOnError)
+	fs.Int("port", 8000, "")
+	fs.String("name", "default", "")
+	fs.String("tls-cert", "", "")
+	fs.String("origins", "", "")
+	fs.Int64("max-size", 0, "")
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	path := *configFile
+	t.Cleanup(func() { *configFile = path })
+	return fs
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	fs := testFlags(t, "-port", "1")
+	*configFile = writeConfig(t, "signaling.yaml", `
+port: 3
+name: file
+tls-cert: file.pem
+origins: [https://a.example, "*.b.example"]
+`)
+	t.Setenv("SIGNALING_PORT", "2")
+	t.Setenv("SIGNALING_NAME", "env")
+
+	if err := loadConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"port":     "1",        // flag over environment and file
+		"name":     "env",      // environment over file
+		"tls-cert": "file.pem", // file over default
+		"origins":  "https://a.example,*.b.example",
+		"max-size": "0", // default
+	} {
+		if got := fs.Lookup(name).Value.String(); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	fs := testFlags(t)
+	*configFile = ""
+	t.Setenv("SIGNALING_CONFIG", writeConfig(t, "signaling.json", `{"max-size": 67108864, "name": null}`))
+
+	if err := loadConfig(fs); err != nil {
+		t.Fatal(err)
+	}
+	if got := fs.Lookup("max-size").Value.String(); got != "67108864" {
+		t.Fatalf("max-size = %q from a JSON number", got)
+	}
+	if got := fs.Lookup("name").Value.String(); got != "" {
+		t.Fatalf("name = %q from null, want empty", got)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	fs := testFlags(t)
+	*configFile = writeConfig(t, "signaling.yaml", "port: eighty\n")
+	if err := loadConfig(fs); err == nil || !strings.Contains(err.Error(), "port") {
+		t.Fatalf("invalid port = %v, want an error naming it", err)
+	}
+
+	*configFile = writeConfig(t, "signaling.json", "port: 1\n")
+	if err := loadConfig(testFlags(t)); err == nil {
+		t.Fatal("YAML accepted in a .json file")
+	}
+
+	*configFile = filepath.Join(t.TempDir(), "missing.yaml")
+	if err := loadConfig(testFlags(t)); !os.IsNotExist(err) {
+		t.Fatalf("missing file = %v", err)
+	}
+}
+
+func TestOriginChecker(t *testing.T) {
+	for _, tc := range []struct {
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{nil, "https://evil.example", true},
+		{[]string{"https://app.example.com"}, "", true},
+		{[]string{"https://app.example.com"}, "https://app.example.com", true},
+		{[]string{"https://app.example.com"}, "http://app.example.com", false},
+		{[]string{"https://*.example.com"}, "https://app.example.com", true},
+		{[]string{"https://*.example.com"}, "https://example.com", false},
+		{[]string{"app.example.com"}, "http://app.example.com", true},
+		{[]string{"*.example.org"}, "https://x.example.org", true},
+		{[]string{"*.example.org"}, "https://x.example.org.evil.com", false},
+		{[]string{"localhost:*"}, "http://localhost:3000", true},
+		{[]string{"*"}, "https://anything.example", true},
+	} {
+		r := httptest.NewRequest("GET", "/a", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		oc := &originChecker{allowed: tc.allowed}
+		if got := oc.check(r); got != tc.want {
+			t.Errorf("%v allows %q: %t, want %t", tc.allowed, tc.origin, got, tc.want)
+		}
+	}
+}
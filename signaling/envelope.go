@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+)
+
+// envelopeVersion is the version of the envelope format understood by the
+// relay.
+const envelopeVersion = 1
+
+// message kinds a client may send in an envelope
+const (
+	kindOffer     = "offer"
+	kindAnswer    = "answer"
+	kindCandidate = "candidate"
+	kindBye       = "bye"
+	kindCustom    = "custom"
+)
+
+// kindError is the type of replies describing a rejected message.
+const kindError = "error"
+
+// error codes carried by error replies
+const (
+	codeBadJSON            = "bad-json"
+	codeBadEnvelope        = "bad-envelope"
+	codeUnsupportedVersion = "unsupported-version"
+	codeUnknownType        = "unknown-type"
+	codeMissingTarget      = "missing-target"
+	codeInvalidPayload     = "invalid-payload"
+	codeNotFound           = "not-found"
+	codeForbidden          = "forbidden"
+	codeRateLimited        = "rate-limited"
+	codeInternal           = "internal"
+)
+
+const maxTxnLen = 128
+
+// envelope is the versioned signaling message. From is always set by the
+// relay to the sender's id; a value supplied by the client is ignored.
+type envelope struct {
+	V       int             `json:"v"`
+	Type    string          `json:"type"`
+	To      string          `json:"to,omitempty"`
+	From    string          `json:"from,omitempty"`
+	Txn     string          `json:"txn,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// errorPayload is the payload of an error reply.
+type errorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// relayError is a rejection reported back to the sender. Txn identifies the
+// rejected message when it could be read.
+type relayError struct {
+	Code    string
+	Message string
+	Txn     string
+}
+
+func (e *relayError) Error() string { return e.Code + ": " + e.Message }
+
+func newRelayError(code, format string, args ...interface{}) *relayError {
+	return &relayError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// routedMessage is an incoming message that passed validation.
+type routedMessage struct {
+	To   string
+	Type string
+	Txn  string
+	Data []byte // what is delivered to To
+
+	// Legacy is set for the legacy format, which predates call control:
+	// only its offers, answers and candidates are checked against calls.
+	Legacy bool
+}
+
+// routeMessage validates data sent by the client from and rewrites it for
+// delivery. Envelopes carry a "to" field; messages with only an "id" field
+// use the legacy format {"id": "<target>", ...}, which is forwarded with id
+// replaced by the sender.
+func routeMessage(from string, data []byte) (*routedMessage, *relayError) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, newRelayError(codeBadJSON, "message is not a JSON object: %v", err)
+	}
+
+	_, hasID := fields["id"]
+	_, hasTo := fields["to"]
+	if hasID && !hasTo {
+		return routeLegacy(from, fields)
+	}
+	return routeEnvelope(from, data)
+}
+
+func routeEnvelope(from string, data []byte) (*routedMessage, *relayError) {
+	var env envelope
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&env); err != nil {
+		return nil, newRelayError(codeBadEnvelope, "%v", err)
+	}
+
+	if len(env.Txn) > maxTxnLen {
+		return nil, newRelayError(codeBadEnvelope, "txn longer than %d bytes", maxTxnLen)
+	}
+	fail := func(code, format string, args ...interface{}) (*routedMessage, *relayError) {
+		e := newRelayError(code, format, args...)
+		e.Txn = env.Txn
+		return nil, e
+	}
+
+	if env.V != envelopeVersion {
+		return fail(codeUnsupportedVersion, "version %d is not supported, use %d", env.V, envelopeVersion)
+	}
+	if env.To == "" {
+		return fail(codeMissingTarget, "missing to")
+	}
+	if err := validatePayload(env.Type, env.Payload); err != nil {
+		return fail(err.Code, "%s", err.Message)
+	}
+
+	env.From = from
+	out, err := json.Marshal(&env)
+	if err != nil {
+		return fail(codeInternal, "%v", err)
+	}
+	return &routedMessage{To: env.To, Type: env.Type, Txn: env.Txn, Data: out}, nil
+}
+
+func routeLegacy(from string, fields map[string]json.RawMessage) (*routedMessage, *relayError) {
+	var to string
+	if err := json.Unmarshal(fields["id"], &to); err != nil || to == "" {
+		return nil, newRelayError(codeMissingTarget, "id must be a non-empty string")
+	}
+
+	var typ string
+	json.Unmarshal(fields["type"], &typ)
+
+	fields["id"], _ = json.Marshal(from)
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return nil, newRelayError(codeInternal, "%v", err)
+	}
+	return &routedMessage{To: to, Type: typ, Data: out, Legacy: true}, nil
+}
+
+// validatePayload checks that payload has the shape required by kind.
+func validatePayload(kind string, payload json.RawMessage) *relayError {
+	switch kind {
+	case kindOffer, kindAnswer:
+		var p struct {
+			Type *string `json:"type"`
+			SDP  *string `json:"sdp"`
+		}
+		if err := json.Unmarshal(payload, &p); err != nil || p.SDP == nil || *p.SDP == "" {
+			return newRelayError(codeInvalidPayload, "%s payload must be an object with a non-empty sdp", kind)
+		}
+		if p.Type != nil && *p.Type != kind {
+			return newRelayError(codeInvalidPayload, "%s payload has type %q", kind, *p.Type)
+		}
+	case kindCandidate:
+		var p struct {
+			Candidate     *string `json:"candidate"`
+			SDPMid        *string `json:"sdpMid"`
+			SDPMLineIndex *uint16 `json:"sdpMLineIndex"`
+		}
+		if err := json.Unmarshal(payload, &p); err != nil || p.Candidate == nil {
+			return newRelayError(codeInvalidPayload, "candidate payload must be an object with a candidate string")
+		}
+	case kindBye, kindCustom, kindInvite, kindRinging, kindAccept, kindDecline, kindBusy, kindCancel, kindHangup, kindTimeout:
+		if len(payload) > 0 && !json.Valid(payload) {
+			return newRelayError(codeInvalidPayload, "payload is not valid JSON")
+		}
+	case "":
+		return newRelayError(codeBadEnvelope, "missing type")
+	default:
+		return newRelayError(codeUnknownType, "unknown type %q", kind)
+	}
+	return nil
+}
+
+// sendError queues an error reply describing e for c.
+func (c *client) sendError(e *relayError) {
+	payload, _ := json.Marshal(errorPayload{Code: e.Code, Message: e.Message})
+	data, err := json.Marshal(envelope{
+		V:       envelopeVersion,
+		Type:    kindError,
+		Txn:     e.Txn,
+		Payload: payload,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal error reply: %v", err)
+		return
+	}
+	if err := c.enqueue(data); err != nil {
+		log.Printf("Failed to send error reply to client %s: %v", c.id, err)
+	}
+}
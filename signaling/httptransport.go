@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"pion-webrtc-example/signaling/auth"
+)
+
+// httpSession is the state of a client using the HTTP transport: it sends
+// with POST /send/<id> and receives with GET /recv/<id>, either as a
+// Server-Sent Events stream or as long-polls.
+type httpSession struct {
+	mu       sync.Mutex
+	readers  int       // pending GET /recv requests
+	lastSeen time.Time // when the last request ended
+	unsent   [][]byte  // taken off the queue by a GET /recv that failed
+}
+
+func (s *httpSession) attach() {
+	s.mu.Lock()
+	s.readers++
+	s.mu.Unlock()
+}
+
+func (s *httpSession) detach() {
+	s.mu.Lock()
+	s.readers--
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *httpSession) touch() {
+	s.mu.Lock()
+	s.lastSeen = time.Now()
+	s.mu.Unlock()
+}
+
+// requeue keeps msgs, which could not be written, for the next GET /recv,
+// ahead of the queue. At most max messages are kept, dropping the oldest.
+func (s *httpSession) requeue(msgs [][]byte, max int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unsent = append(msgs, s.unsent...)
+	if len(s.unsent) > max {
+		s.unsent = s.unsent[len(s.unsent)-max:]
+	}
+}
+
+// takeUnsent returns the messages kept by requeue.
+func (s *httpSession) takeUnsent() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	msgs := s.unsent
+	s.unsent = nil
+	return msgs
+}
+
+func (s *httpSession) idle(now time.Time, timeout time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readers == 0 && now.Sub(s.lastSeen) > timeout
+}
+
+// watchSession unregisters the HTTP client c once it is closed, evicting it
+// first if it goes sessionTimeout without a pending GET /recv.
+func (r *registry) watchSession(c *client) {
+	defer r.unregister(c)
+
+	var tick <-chan time.Time
+	if r.sessionTimeout > 0 {
+		ticker := time.NewTicker(r.sessionTimeout / 4)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-tick:
+			if c.http.idle(now, r.sessionTimeout) {
+				log.Printf("Client %s stopped polling, disconnecting", c.id)
+				c.evict(closeIdleTimeout, "session timeout")
+			}
+		}
+	}
+}
+
+// httpClient returns the HTTP client of the id in the path of r after
+// prefix, registering it on its first request. It answers r itself and
+// returns nil if the request is not allowed.
+func httpClient(w http.ResponseWriter, r *http.Request, prefix string) (*client, *auth.Claims) {
+	if !allowCORS(w, r) {
+		return nil, nil
+	}
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+	if id == "" || strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return nil, nil
+	}
+
+	claims, err := authenticate(r, id)
+	if err != nil {
+		log.Printf("Client %s rejected: %v", id, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, nil
+	}
+	if c, ok := clients.lookup(id); ok {
+		if c.http == nil {
+			// HTTP requests only replace HTTP sessions, a stray request
+			// must not kick a live websocket
+			log.Printf("Client %s rejected: connected over websocket", id)
+			http.Error(w, "id connected over websocket", http.StatusConflict)
+			return nil, nil
+		}
+		c.http.touch()
+		return c, claims
+	}
+
+	if clients.duplicates == rejectNew && clients.online(id) {
+		log.Printf("Client %s rejected: %v", id, errDuplicateID)
+		http.Error(w, errDuplicateID.Error(), http.StatusConflict)
+		return nil, nil
+	}
+	c, old, err := clients.register(nil, peerInfoFromRequest(id, r), wantsPresence(r))
+	if err != nil {
+		log.Printf("Client %s rejected: %v", id, err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil, nil
+	}
+	if old != nil {
+		log.Printf("Client %s replaced by a new connection", id)
+	}
+	log.Printf("Client %s connected over HTTP", id)
+	return c, claims
+}
+
+// allowCORS applies the origin allowlist to a cross-origin request and
+// answers preflights. It reports whether the request should be served.
+func allowCORS(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if !upgrader.CheckOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return false
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Vary", "Origin")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	return true
+}
+
+// preflight answers an OPTIONS request, which never reaches the client, and
+// reports whether r was one.
+func preflight(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodOptions {
+		return false
+	}
+	if allowCORS(w, r) {
+		// not cross-origin, allowCORS left it unanswered
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return true
+}
+
+// sendHandler serves POST /send/<id>: the body is one message, handled like
+// a websocket text message from id. Rejections are answered on the
+// receiving side like for websocket clients.
+func sendHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodOptions {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if preflight(w, r) {
+		return
+	}
+	c, claims := httpClient(w, r, "/send/")
+	if c == nil {
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, *maxMessageSize))
+	if err != nil {
+		var tooBig *http.MaxBytesError
+		if errors.As(err, &tooBig) {
+			http.Error(w, "message too big", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !handleMessage(c, claims, data, time.Now()) {
+		http.Error(w, c.closeReason, http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// recvHandler serves GET /recv/<id>. With "Accept: text/event-stream" the
+// messages for id are streamed as Server-Sent Events; otherwise the request
+// is a long-poll answered with a JSON array of messages once any arrive,
+// or 204 after -poll-wait.
+func recvHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodOptions {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if preflight(w, r) {
+		return
+	}
+	c, _ := httpClient(w, r, "/recv/")
+	if c == nil {
+		return
+	}
+	c.http.attach()
+	defer c.http.detach()
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamEvents(w, r, c)
+		return
+	}
+	longPoll(w, r, c)
+}
+
+// streamEvents sends the messages of c as Server-Sent Events. The messages
+// written since the last successful flush are requeued for the next GET
+// /recv if a write or the flush fails.
+func streamEvents(w http.ResponseWriter, r *http.Request, c *client) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	pending := c.http.takeUnsent()
+	_, err := io.WriteString(w, ": connected\n\n")
+	for _, data := range pending {
+		if err != nil {
+			break
+		}
+		err = writeEvent(w, "", data)
+	}
+
+	var ping <-chan time.Time
+	if c.pingInterval > 0 {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			if len(pending) > 0 {
+				log.Printf("Failed to send %d messages to client %s: %v", len(pending), c.id, err)
+				c.http.requeue(pending, cap(c.send))
+			}
+			return
+		}
+		pending = nil
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.done:
+			for _, data := range drain(c) {
+				writeEvent(w, "", data)
+			}
+			writeEvent(w, "close", []byte(closeInfo(c)))
+			rc.Flush()
+			return
+		case <-ping:
+			_, err = io.WriteString(w, ": ping\n\n")
+		case data := <-c.send:
+			pending = [][]byte{data}
+			err = writeEvent(w, "", data)
+		}
+	}
+}
+
+// writeEvent writes one Server-Sent Event.
+func writeEvent(w io.Writer, event string, data []byte) error {
+	var b bytes.Buffer
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+func longPoll(w http.ResponseWriter, r *http.Request, c *client) {
+	timer := time.NewTimer(*pollWait)
+	defer timer.Stop()
+
+	// messages a failed poll could not write go first
+	msgs := c.http.takeUnsent()
+	if len(msgs) > 0 {
+		msgs = append(msgs, drain(c)...)
+		writePoll(w, c, msgs)
+		return
+	}
+
+	select {
+	case <-r.Context().Done():
+		return
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-c.done:
+		msgs = drain(c)
+		if len(msgs) == 0 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusGone)
+			io.WriteString(w, closeInfo(c))
+			return
+		}
+	case data := <-c.send:
+		msgs = append([][]byte{data}, drain(c)...)
+	}
+	writePoll(w, c, msgs)
+}
+
+// writePoll answers a long-poll with msgs. Messages that cannot be written
+// are requeued for the next poll, rather than lost with the response.
+func writePoll(w http.ResponseWriter, c *client, msgs [][]byte) {
+	w.Header().Set("Content-Type", "application/json")
+	body := append(append([]byte("["), bytes.Join(msgs, []byte(","))...), "]\n"...)
+	_, err := w.Write(body)
+	if err == nil {
+		if err = http.NewResponseController(w).Flush(); errors.Is(err, http.ErrNotSupported) {
+			err = nil
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to send %d messages to client %s: %v", len(msgs), c.id, err)
+		c.http.requeue(msgs, cap(c.send))
+	}
+}
+
+// drain takes every message queued for c without waiting.
+func drain(c *client) [][]byte {
+	var msgs [][]byte
+	for {
+		select {
+		case data := <-c.send:
+			msgs = append(msgs, data)
+		default:
+			return msgs
+		}
+	}
+}
+
+// closeInfo describes why the closed client c was disconnected, like the
+// close frame sent to websocket clients.
+func closeInfo(c *client) string {
+	return fmt.Sprintf(`{"code":%d,"reason":%q}`, c.closeCode, c.closeReason)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// failingWriter is a ResponseWriter whose client has gone.
+type failingWriter struct {
+	header http.Header
+}
+
+func (w *failingWriter) Header() http.Header       { return w.header }
+func (w *failingWriter) Write([]byte) (int, error) { return 0, errors.New("connection reset") }
+func (w *failingWriter) WriteHeader(int)           {}
+
+// flakyWriter is a ResponseWriter whose connection breaks after flushes
+// successful flushes, the writes before it are buffered.
+type flakyWriter struct {
+	header  http.Header
+	flushes int
+}
+
+func (w *flakyWriter) Header() http.Header         { return w.header }
+func (w *flakyWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *flakyWriter) WriteHeader(int)             {}
+func (w *flakyWriter) Flush()                      { w.FlushError() }
+
+func (w *flakyWriter) FlushError() error {
+	if w.flushes == 0 {
+		return errors.New("connection reset")
+	}
+	w.flushes--
+	return nil
+}
+
+func TestPreflightWithoutOrigin(t *testing.T) {
+	clients = newRegistry(4, dropOldest)
+	for _, h := range []http.HandlerFunc{sendHandler, recvHandler} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodOptions, "/send/a", nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("OPTIONS answered %d, want %d", w.Code, http.StatusNoContent)
+		}
+	}
+	if clients.online("a") {
+		t.Fatal("OPTIONS registered a client")
+	}
+}
+
+func TestLongPollRequeue(t *testing.T) {
+	clients = newRegistry(4, dropOldest)
+	c, _, err := clients.register(nil, peerInfo{ID: "a"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clients.unregister(c)
+	for _, m := range []string{`"1"`, `"2"`} {
+		if err := c.enqueue([]byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	longPoll(&failingWriter{header: http.Header{}}, httptest.NewRequest(http.MethodGet, "/recv/a", nil), c)
+	if err := c.enqueue([]byte(`"3"`)); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	longPoll(w, httptest.NewRequest(http.MethodGet, "/recv/a", nil), c)
+	if got, want := w.Body.String(), "[\"1\",\"2\",\"3\"]\n"; got != want {
+		t.Fatalf("poll after a failed one got %q, want %q", got, want)
+	}
+}
+
+func TestHTTPDoesNotKickWebsocket(t *testing.T) {
+	clients = newRegistry(4, dropOldest)
+	// a client registered with a websocket has no httpSession
+	ws := newClient(peerInfo{ID: "a"}, nil, 4, dropOldest)
+	clients.clients["a"] = ws
+
+	w := httptest.NewRecorder()
+	recvHandler(w, httptest.NewRequest(http.MethodGet, "/recv/a", nil))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("GET /recv of a websocket id answered %d, want %d", w.Code, http.StatusConflict)
+	}
+	if c, _ := clients.lookup("a"); c != ws {
+		t.Fatal("websocket client replaced")
+	}
+	select {
+	case <-ws.done:
+		t.Fatal("websocket client closed")
+	default:
+	}
+}
+
+func TestEventStreamRequeue(t *testing.T) {
+	clients = newRegistry(4, dropOldest)
+	c, _, err := clients.register(nil, peerInfo{ID: "a"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clients.unregister(c)
+	c.http.requeue([][]byte{[]byte(`"1"`)}, cap(c.send))
+	stream := func(w http.ResponseWriter) {
+		req := httptest.NewRequest(http.MethodGet, "/recv/a", nil)
+		streamEvents(w, req, c)
+	}
+
+	if err := c.enqueue([]byte(`"2"`)); err != nil {
+		t.Fatal(err)
+	}
+	// the unsent message is kept when the first flush fails
+	stream(&flakyWriter{header: http.Header{}})
+	// it goes out with the next flush, the live one is kept when the flush
+	// after it fails
+	stream(&flakyWriter{header: http.Header{}, flushes: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		streamEvents(w, httptest.NewRequest(http.MethodGet, "/recv/a", nil).WithContext(ctx), c)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	if got := w.Body.String(); got != ": connected\n\ndata: \"2\"\n\n" {
+		t.Fatalf("stream after failed ones got %q, want the message not flushed", got)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// close codes sent to evicted clients, in the range reserved for
+// applications by RFC 6455
+const (
+	closeIdleTimeout  = 4000
+	closeRateLimited  = 4001
+	closeReplaced     = 4002
+	closeSlowConsumer = 4003
+)
+
+// controlWriteWait bounds how long a ping or close frame may take to write.
+const controlWriteWait = time.Second
+
+// rateLimitStrikes is how many messages in a row a client may have rejected
+// by its rate limit before it is evicted.
+const rateLimitStrikes = 10
+
+// evict closes c and tells it why with a close frame carrying code and
+// reason. Only the first close or evict of a client takes effect.
+func (c *client) evict(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// sendCloseFrame is called by writePump once the client is closed. An
+// evicted client first gets the messages still queued for it, such as the
+// error replies explaining the eviction.
+func (c *client) sendCloseFrame() {
+	if c.closeCode == 0 {
+		return
+	}
+	for drained := false; !drained; {
+		select {
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(controlWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		default:
+			drained = true
+		}
+	}
+	msg := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(controlWriteWait))
+}
+
+func (c *client) sendPing() error {
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(controlWriteWait))
+}
+
+// readDeadline returns the deadline for the next read from a client whose
+// last message arrived at lastMessage: the pong wait when keepalive is on,
+// capped by the idle timeout. The zero time means no deadline.
+func readDeadline(lastMessage time.Time) time.Time {
+	var deadline time.Time
+	if *pingInterval > 0 && *pongWait > 0 {
+		deadline = time.Now().Add(*pongWait)
+	}
+	if *readTimeout > 0 {
+		idle := lastMessage.Add(*readTimeout)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	return deadline
+}
+
+// evictOnReadError picks the close code for a failed read. Errors caused
+// by the peer going away need no close frame.
+func (c *client) evictOnReadError(err error) {
+	var ne net.Error
+	switch {
+	case errors.Is(err, websocket.ErrReadLimit):
+		c.evict(websocket.CloseMessageTooBig, "message too big")
+	case errors.As(err, &ne) && ne.Timeout():
+		c.evict(closeIdleTimeout, "idle timeout")
+	}
+}
+
+// newLimiter returns the rate limiter for a new client, or nil without
+// -rate-limit.
+func newLimiter() *tokenBucket {
+	if *rateLimit <= 0 {
+		return nil
+	}
+	return newTokenBucket(*rateLimit, *rateBurst)
+}
+
+// limit applies the rate limit of c to a message received at now. A message
+// over the limit is answered with an error and not allowed; after
+// rateLimitStrikes of them in a row c is evicted.
+func (c *client) limit(now time.Time) (allowed, evicted bool) {
+	if c.limiter == nil {
+		return true, false
+	}
+	c.limitMu.Lock()
+	defer c.limitMu.Unlock()
+
+	if c.limiter.allow(now) {
+		c.strikes = 0
+		return true, false
+	}
+	if c.strikes++; c.strikes >= rateLimitStrikes {
+		log.Printf("Client %s keeps exceeding the rate limit, evicting", c.id)
+		c.evict(closeRateLimited, "rate limit exceeded")
+		return false, true
+	}
+	c.sendError(newRelayError(codeRateLimited, "rate limit exceeded, message dropped"))
+	stats.dropped.inc(metricType(""), dropRateLimited)
+	return false, false
+}
+
+// tokenBucket is a per-client rate limiter allowing rate messages per second
+// with bursts of up to burst messages. It is guarded by limitMu of its
+// client.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes one token if available.
+func (tb *tokenBucket) allow(now time.Time) bool {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(2, 3)
+	now := tb.last
+	for i := 0; i < 3; i++ {
+		if !tb.allow(now) {
+			t.Fatalf("message %d of the burst refused", i)
+		}
+	}
+	if tb.allow(now) {
+		t.Fatal("message over the burst allowed")
+	}
+	// 2 per second, one token after half a second
+	now = now.Add(500 * time.Millisecond)
+	if !tb.allow(now) || tb.allow(now) {
+		t.Fatal("want exactly one message after half a second")
+	}
+	// refills up to the burst only
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !tb.allow(now) {
+			t.Fatalf("message %d after a long pause refused", i)
+		}
+	}
+	if tb.allow(now) {
+		t.Fatal("bucket refilled over the burst")
+	}
+
+	if tb := newTokenBucket(1, 0); !tb.allow(tb.last) {
+		t.Fatal("a burst below 1 refuses every message")
+	}
+}
+
+func TestLimitEvictsAfterStrikes(t *testing.T) {
+	c := newClient(peerInfo{ID: "a"}, nil, rateLimitStrikes, dropOldest)
+	c.limiter = newTokenBucket(1, 1)
+	now := c.limiter.last
+
+	if allowed, _ := c.limit(now); !allowed {
+		t.Fatal("first message refused")
+	}
+	for i := 1; i < rateLimitStrikes; i++ {
+		if allowed, evicted := c.limit(now); allowed || evicted {
+			t.Fatalf("strike %d: allowed %t, evicted %t", i, allowed, evicted)
+		}
+		if env := nextEnvelope(t, c); env.Type != "error" {
+			t.Fatalf("strike %d answered with %+v", i, env)
+		}
+	}
+
+	// an allowed message resets the strikes
+	now = now.Add(time.Second)
+	if allowed, _ := c.limit(now); !allowed {
+		t.Fatal("message after a second refused")
+	}
+	for i := 1; i < rateLimitStrikes; i++ {
+		if _, evicted := c.limit(now); evicted {
+			t.Fatalf("evicted after %d strikes following an allowed message", i)
+		}
+		nextEnvelope(t, c)
+	}
+	if _, evicted := c.limit(now); !evicted {
+		t.Fatalf("not evicted after %d strikes", rateLimitStrikes)
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("evicted client not closed")
+	}
+	if c.closeCode != closeRateLimited {
+		t.Fatalf("close code %d, want %d", c.closeCode, closeRateLimited)
+	}
+
+	// without -rate-limit everything goes
+	c = newClient(peerInfo{ID: "b"}, nil, 4, dropOldest)
+	for i := 0; i < 100; i++ {
+		if allowed, _ := c.limit(now); !allowed {
+			t.Fatal("message refused without a limiter")
+		}
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	defer func(ping, pong, read time.Duration) {
+		*pingInterval, *pongWait, *readTimeout = ping, pong, read
+	}(*pingInterval, *pongWait, *readTimeout)
+
+	last := time.Now().Add(-time.Minute)
+	for _, tc := range []struct {
+		ping, pong, read time.Duration
+		want             time.Time // zero for none
+		fromNow          time.Duration
+	}{
+		{0, 0, 0, time.Time{}, 0},
+		{time.Second, 0, 0, time.Time{}, 0},
+		{time.Second, 10 * time.Second, 0, time.Time{}, 10 * time.Second},
+		{0, 0, 2 * time.Minute, last.Add(2 * time.Minute), 0},
+		{time.Second, 10 * time.Second, 2 * time.Minute, time.Time{}, 10 * time.Second},
+		{time.Second, 10 * time.Minute, 2 * time.Minute, last.Add(2 * time.Minute), 0},
+	} {
+		*pingInterval, *pongWait, *readTimeout = tc.ping, tc.pong, tc.read
+		before := time.Now()
+		got := readDeadline(last)
+		switch {
+		case tc.fromNow > 0:
+			if got.Before(before.Add(tc.fromNow)) || got.After(time.Now().Add(tc.fromNow)) {
+				t.Errorf("ping %s, pong %s, read %s: deadline in %s, want %s", tc.ping, tc.pong, tc.read, time.Until(got), tc.fromNow)
+			}
+		case !got.Equal(tc.want):
+			t.Errorf("ping %s, pong %s, read %s: deadline %s, want %s", tc.ping, tc.pong, tc.read, got, tc.want)
+		}
+	}
+}
+
+// timeoutError is a net.Error of a read past its deadline.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestEvictOnReadError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{websocket.ErrReadLimit, websocket.CloseMessageTooBig},
+		{fmt.Errorf("read: %w", timeoutError{}), closeIdleTimeout},
+		{&websocket.CloseError{Code: websocket.CloseGoingAway}, 0},
+		{errors.New("connection reset"), 0},
+	} {
+		c := newClient(peerInfo{ID: "a"}, nil, 4, dropOldest)
+		c.evictOnReadError(tc.err)
+		if c.closeCode != tc.code {
+			t.Errorf("%v: close code %d, want %d", tc.err, c.closeCode, tc.code)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate in certFile/keyFile and reloads it
+// when either file changes, so renewed certificates are picked up without a
+// restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	modTime := cr.latestModTime()
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range []string{cr.certFile, cr.keyFile} {
+		if fi, err := os.Stat(f); err == nil && fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest
+}
+
+// watch polls the files every interval and reloads them after a change. A
+// broken pair is logged and the previous certificate stays in use.
+func (cr *certReloader) watch(interval time.Duration) {
+	for range time.NewTicker(interval).C {
+		cr.mu.RLock()
+		modTime := cr.modTime
+		cr.mu.RUnlock()
+
+		if !cr.latestModTime().After(modTime) {
+			continue
+		}
+		if err := cr.load(); err != nil {
+			log.Printf("Failed to reload TLS certificate: %v", err)
+			continue
+		}
+		log.Printf("Reloaded TLS certificate %s", cr.certFile)
+	}
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// originChecker implements the websocket CheckOrigin hook against an
+// allowlist. Entries are full origins ("https://app.example.com") or host
+// names, and may contain path.Match wildcards ("https://*.example.com").
+// Requests without an Origin header come from non-browser clients and are
+// always allowed. An empty allowlist allows every origin.
+type originChecker struct {
+	allowed []string
+}
+
+func (oc *originChecker) check(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(oc.allowed) == 0 {
+		return true
+	}
+
+	host := origin
+	if u, err := url.Parse(origin); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	for _, pattern := range oc.allowed {
+		if pattern == "*" {
+			return true
+		}
+		if ok, _ := path.Match(pattern, origin); ok {
+			return true
+		}
+		if !strings.Contains(pattern, "://") {
+			if ok, _ := path.Match(pattern, host); ok {
+				return true
+			}
+		}
+	}
+	log.Printf("Rejected origin %s", origin)
+	return false
+}
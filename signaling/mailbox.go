@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const eventDeliveryFailed = "delivery-failed"
+
+var errMailboxFull = errors.New("mailbox full")
+
+// storedMessage is a relayed message waiting for its target to connect.
+type storedMessage struct {
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Data    json.RawMessage `json:"data"`
+	Expires time.Time       `json:"expires"`
+}
+
+// mailbox stores messages for offline targets. Implementations must be safe
+// for concurrent use and must return messages in the order they were put.
+type mailbox interface {
+	// Put appends m to the queue of m.To, or returns errMailboxFull.
+	Put(m storedMessage) error
+	// Take removes and returns all messages queued for id.
+	Take(id string) ([]storedMessage, error)
+	// Expire removes and returns every message that expired before now.
+	// On error it still returns the messages it removed.
+	Expire(now time.Time) ([]storedMessage, error)
+}
+
+// deliveryFailed is sent back to the sender of a message that could not
+// be delivered.
+type deliveryFailed struct {
+	Type    string          `json:"type"`
+	To      string          `json:"to"`
+	Reason  string          `json:"reason"`
+	Message json.RawMessage `json:"message,omitempty"`
+}
+
+func newMailbox(kind, dir string, depth int) (mailbox, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "memory":
+		return newMemoryMailbox(depth), nil
+	case "file":
+		return newFileMailbox(dir, depth)
+	}
+	return nil, fmt.Errorf("unknown mailbox %q", kind)
+}
+
+// store queues data for the offline client id. It must be called with r.mu
+// held so a concurrent register cannot miss the message, or with the
+// flushMu of a flushing client.
+func (r *registry) store(from, id string, data []byte) error {
+	err := r.mailbox.Put(storedMessage{
+		From:    from,
+		To:      id,
+		Data:    data,
+		Expires: time.Now().Add(r.mailboxTTL),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Client %s offline, message from %s queued", id, from)
+	return nil
+}
+
+// deliver hands data from from to the connected client c. While c is
+// flushing its mailbox, data is stored behind the flushed messages so it
+// cannot overtake them.
+func (r *registry) deliver(c *client, from string, data []byte) (stored bool, err error) {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+	if c.flushing {
+		return true, r.store(from, c.id, data)
+	}
+	return false, c.enqueue(data)
+}
+
+// flushMailbox delivers the messages queued for c, in order, and tells the
+// senders of the ones that cannot be delivered. It is called without r.mu,
+// once c is registered with flushing set; messages relayed to c meanwhile
+// are stored and flushed too, c gets them directly once the mailbox is
+// empty.
+func (r *registry) flushMailbox(c *client) {
+	flushed := 0
+	defer func() {
+		if flushed > 0 {
+			log.Printf("Client %s flushed %d queued messages", c.id, flushed)
+		}
+	}()
+
+	for {
+		c.flushMu.Lock()
+		msgs, err := r.mailbox.Take(c.id)
+		if err != nil || len(msgs) == 0 {
+			c.flushing = false
+			c.flushMu.Unlock()
+			if err != nil {
+				log.Printf("Failed to read mailbox of client %s: %v", c.id, err)
+			}
+			return
+		}
+		c.flushMu.Unlock()
+
+		live, expired := splitExpired(msgs, time.Now())
+		for _, m := range expired {
+			r.notifyDeliveryFailed(m.From, m.To, "expired", m.Data)
+		}
+		for i, m := range live {
+			if err := c.enqueue(m.Data); err != nil {
+				log.Printf("Failed to flush mailbox of client %s: %v", c.id, err)
+				for _, m := range live[i:] {
+					r.notifyDeliveryFailed(m.From, m.To, "disconnected", m.Data)
+				}
+				c.flushMu.Lock()
+				c.flushing = false
+				c.flushMu.Unlock()
+				return
+			}
+			flushed++
+		}
+	}
+}
+
+// forwardMailbox hands the messages queued here for id to the node id
+// connected to, when another node asks for them.
+func (r *registry) forwardMailbox(id string) {
+	msgs, err := r.mailbox.Take(id)
+	if err != nil {
+		log.Printf("Failed to read mailbox of client %s: %v", id, err)
+		return
+	}
+	live, expired := splitExpired(msgs, time.Now())
+	for _, m := range expired {
+		r.notifyDeliveryFailed(m.From, m.To, "expired", m.Data)
+	}
+	for _, m := range live {
+		// stored again if id left meanwhile
+		if _, err := r.relay(m.From, m.To, m.Data); err != nil {
+			log.Printf("Failed to forward queued message from %s to %s: %v", m.From, m.To, err)
+			r.notifyDeliveryFailed(m.From, m.To, "disconnected", m.Data)
+		}
+	}
+	if len(live) > 0 {
+		log.Printf("Client %s connected to another node, forwarded %d queued messages", id, len(live))
+	}
+}
+
+// notifyDeliveryFailed tells the sender of data that it did not reach id.
+// The notice itself is never queued: if the sender is gone it is dropped.
+func (r *registry) notifyDeliveryFailed(from, id, reason string, data []byte) {
+	c, ok := r.lookup(from)
+	if !ok {
+		return
+	}
+	notice, err := json.Marshal(deliveryFailed{
+		Type:    eventDeliveryFailed,
+		To:      id,
+		Reason:  reason,
+		Message: data,
+	})
+	if err != nil {
+		log.Printf("Failed to marshal delivery notice: %v", err)
+		return
+	}
+	if err := c.enqueue(notice); err != nil {
+		log.Printf("Failed to send %s to client %s: %v", eventDeliveryFailed, from, err)
+	}
+}
+
+// expireMailbox periodically drops expired messages and notifies their
+// senders. It runs until the process exits.
+func (r *registry) expireMailbox(interval time.Duration) {
+	for now := range time.NewTicker(interval).C {
+		// what expired is handled even if part of the mailbox failed
+		msgs, err := r.mailbox.Expire(now)
+		if err != nil {
+			log.Printf("Failed to expire mailbox: %v", err)
+		}
+		for _, m := range msgs {
+			log.Printf("Message from %s to %s expired", m.From, m.To)
+			stats.dropped.inc(metricType(""), dropExpired)
+			r.notifyDeliveryFailed(m.From, m.To, "expired", m.Data)
+		}
+	}
+}
+
+// memoryMailbox keeps queued messages in process memory.
+type memoryMailbox struct {
+	mu    sync.Mutex
+	m     map[string][]storedMessage
+	depth int
+}
+
+func newMemoryMailbox(depth int) *memoryMailbox {
+	return &memoryMailbox{
+		m:     make(map[string][]storedMessage),
+		depth: depth,
+	}
+}
+
+func (mb *memoryMailbox) Put(m storedMessage) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if len(mb.m[m.To]) >= mb.depth {
+		return errMailboxFull
+	}
+	mb.m[m.To] = append(mb.m[m.To], m)
+	return nil
+}
+
+func (mb *memoryMailbox) Take(id string) ([]storedMessage, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	msgs := mb.m[id]
+	delete(mb.m, id)
+	return msgs, nil
+}
+
+func (mb *memoryMailbox) Expire(now time.Time) ([]storedMessage, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	var expired []storedMessage
+	for id, msgs := range mb.m {
+		live, dead := splitExpired(msgs, now)
+		expired = append(expired, dead...)
+		if len(live) == 0 {
+			delete(mb.m, id)
+		} else {
+			mb.m[id] = live
+		}
+	}
+	return expired, nil
+}
+
+// fileMailbox keeps one JSONL file per target id in dir, so queued messages
+// survive a relay restart.
+type fileMailbox struct {
+	mu    sync.Mutex
+	dir   string
+	depth int
+}
+
+func newFileMailbox(dir string, depth int) (*fileMailbox, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileMailbox{dir: dir, depth: depth}, nil
+}
+
+const mailboxFileExt = ".jsonl"
+
+func (mb *fileMailbox) path(id string) string {
+	return filepath.Join(mb.dir, url.PathEscape(id)+mailboxFileExt)
+}
+
+func (mb *fileMailbox) read(path string) ([]storedMessage, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var msgs []storedMessage
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var m storedMessage
+		if err := json.Unmarshal(sc.Bytes(), &m); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, sc.Err()
+}
+
+func (mb *fileMailbox) write(path string, msgs []storedMessage) error {
+	if len(msgs) == 0 {
+		err := os.Remove(path)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, m := range msgs {
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (mb *fileMailbox) Put(m storedMessage) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	path := mb.path(m.To)
+	msgs, err := mb.read(path)
+	if err != nil {
+		return err
+	}
+	if len(msgs) >= mb.depth {
+		return errMailboxFull
+	}
+
+	line, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (mb *fileMailbox) Take(id string) ([]storedMessage, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	path := mb.path(id)
+	msgs, err := mb.read(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := mb.write(path, nil); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (mb *fileMailbox) Expire(now time.Time) ([]storedMessage, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	entries, err := os.ReadDir(mb.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// a bad file is skipped, the others are still expired
+	var expired []storedMessage
+	var errs []error
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), mailboxFileExt) {
+			continue
+		}
+		path := filepath.Join(mb.dir, e.Name())
+		msgs, err := mb.read(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		live, dead := splitExpired(msgs, now)
+		if len(dead) == 0 {
+			continue
+		}
+		if err := mb.write(path, live); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		expired = append(expired, dead...)
+	}
+	return expired, errors.Join(errs...)
+}
+
+// splitExpired partitions msgs into those still valid at now and those that
+// have expired, preserving order.
+func splitExpired(msgs []storedMessage, now time.Time) (live, expired []storedMessage) {
+	for _, m := range msgs {
+		if now.After(m.Expires) {
+			expired = append(expired, m)
+		} else {
+			live = append(live, m)
+		}
+	}
+	return live, expired
+}
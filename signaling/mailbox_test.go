@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newMailboxRegistry(queueSize int, policy overflowPolicy) *registry {
+	r := newRegistry(queueSize, policy)
+	r.mailbox = newMemoryMailbox(queueSize)
+	r.mailboxTTL = time.Minute
+	return r
+}
+
+func TestMailboxFlushOnRegister(t *testing.T) {
+	r := newMailboxRegistry(4, dropOldest)
+	for _, m := range []string{`"1"`, `"2"`} {
+		if stored, err := r.relay("a", "b", []byte(m)); err != nil || !stored {
+			t.Fatalf("relay to offline client = %t, %v", stored, err)
+		}
+	}
+
+	b, _, err := r.register(nil, peerInfo{ID: "b"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.unregister(b)
+	for _, want := range []string{`"1"`, `"2"`} {
+		select {
+		case got := <-b.send:
+			if string(got) != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		default:
+			t.Fatalf("stored message %s not flushed", want)
+		}
+	}
+}
+
+func TestMailboxFlushFailureNotifies(t *testing.T) {
+	r := newMailboxRegistry(4, disconnectSlow)
+	a, _, err := r.register(nil, peerInfo{ID: "a"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.unregister(a)
+	for _, m := range []string{`"1"`, `"2"`, `"3"`} {
+		if _, err := r.relay("a", "b", []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b cannot take its whole mailbox and is disconnected on the second
+	r.queueSize = 1
+	b, _, err := r.register(nil, peerInfo{ID: "b"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.unregister(b)
+
+	for _, want := range []string{`"2"`, `"3"`} {
+		select {
+		case data := <-a.send:
+			var notice deliveryFailed
+			if err := json.Unmarshal(data, &notice); err != nil {
+				t.Fatal(err)
+			}
+			if notice.Type != eventDeliveryFailed || notice.To != "b" || string(notice.Message) != want {
+				t.Fatalf("got %s, want a delivery-failed notice for %s", data, want)
+			}
+		default:
+			t.Fatalf("no notice for %s", want)
+		}
+	}
+}
+
+func TestMailboxFlushAcrossNodes(t *testing.T) {
+	b := newLocalBroker()
+	defer b.Close()
+	node1, node2 := newMailboxRegistry(4, dropOldest), newMailboxRegistry(4, dropOldest)
+	if err := node1.attachBroker(b, "node1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := node2.attachBroker(b, "node2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if stored, err := node1.relay("a", "b", []byte(`"hello"`)); err != nil || !stored {
+		t.Fatalf("relay to offline client = %t, %v", stored, err)
+	}
+	c, _, err := node2.register(nil, peerInfo{ID: "b"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node2.unregister(c)
+
+	select {
+	case data := <-c.send:
+		if string(data) != `"hello"` {
+			t.Fatalf("got %s", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message stored on the other node not delivered")
+	}
+}
+
+// pausedMailbox holds the first Take until release is closed.
+type pausedMailbox struct {
+	mailbox
+	taking  chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (mb *pausedMailbox) Take(id string) ([]storedMessage, error) {
+	mb.once.Do(func() {
+		close(mb.taking)
+		<-mb.release
+	})
+	return mb.mailbox.Take(id)
+}
+
+func TestMailboxFlushKeepsOrder(t *testing.T) {
+	r := newMailboxRegistry(4, dropOldest)
+	mb := &pausedMailbox{mailbox: r.mailbox, taking: make(chan struct{}), release: make(chan struct{})}
+	r.mailbox = mb
+	for _, m := range []string{`"1"`, `"2"`} {
+		if _, err := r.relay("a", "b", []byte(m)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	registered := make(chan *client)
+	go func() {
+		b, _, err := r.register(nil, peerInfo{ID: "b"}, false)
+		if err != nil {
+			t.Error(err)
+		}
+		registered <- b
+	}()
+
+	// b is registered and flushing, a live message must wait its turn
+	<-mb.taking
+	relayed := make(chan error)
+	go func() {
+		_, err := r.relay("a", "b", []byte(`"3"`))
+		relayed <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(mb.release)
+	if err := <-relayed; err != nil {
+		t.Fatal(err)
+	}
+	b := <-registered
+	defer r.unregister(b)
+
+	for _, want := range []string{`"1"`, `"2"`, `"3"`} {
+		select {
+		case got := <-b.send:
+			if string(got) != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s not delivered", want)
+		}
+	}
+
+	// flushed, b gets messages directly again
+	if stored, err := r.relay("a", "b", []byte(`"4"`)); err != nil || stored {
+		t.Fatalf("relay after the flush = %t, %v", stored, err)
+	}
+}
+
+func TestFileMailboxExpireSkipsBadFile(t *testing.T) {
+	mb, err := newFileMailbox(t.TempDir(), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	past := time.Now().Add(-time.Minute)
+	for _, to := range []string{"a", "b"} {
+		if err := mb.Put(storedMessage{From: "x", To: to, Data: []byte(`"m"`), Expires: past}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(mb.path("bad"), []byte("{not json\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err := mb.Expire(time.Now())
+	if err == nil {
+		t.Fatal("corrupt file not reported")
+	}
+	if len(expired) != 2 {
+		t.Fatalf("expired %d messages, want the 2 of the good files", len(expired))
+	}
+	if _, err := os.Stat(mb.path("bad")); err != nil {
+		t.Fatalf("corrupt file removed: %v", err)
+	}
+}
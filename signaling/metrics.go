@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// drop reasons used as the reason label of signaling_messages_dropped_total
+const (
+	dropInvalid     = "invalid"
+	dropForbidden   = "forbidden"
+	dropRateLimited = "rate-limited"
+	dropMailboxFull = "mailbox-full"
+	dropExpired     = "expired"
+	dropQueueFull   = "queue-full"
+	dropSendFailed  = "send-failed"
+	dropCallState   = "call-state"
+	dropBusy        = "busy"
+)
+
+// counterVec is a Prometheus counter with labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by label values joined with \xff
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (cv *counterVec) inc(labelValues ...string) {
+	cv.mu.Lock()
+	cv.values[strings.Join(labelValues, "\xff")]++
+	cv.mu.Unlock()
+}
+
+func (cv *counterVec) write(w io.Writer) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", cv.name, cv.help, cv.name)
+	keys := make([]string, 0, len(cv.values))
+	for k := range cv.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %g\n", cv.name, formatLabels(cv.labels, strings.Split(k, "\xff")), cv.values[k])
+	}
+}
+
+// histogram is a Prometheus histogram without labels.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, le, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+// relayMetrics holds everything exported on /metrics.
+type relayMetrics struct {
+	relayed  *counterVec
+	queued   *counterVec
+	dropped  *counterVec
+	notFound *counterVec
+	latency  *histogram
+}
+
+var stats = &relayMetrics{
+	relayed:  newCounterVec("signaling_messages_relayed_total", "Messages handed to a connected client or another node.", "type"),
+	queued:   newCounterVec("signaling_messages_queued_total", "Messages stored in the mailbox for an offline client.", "type"),
+	dropped:  newCounterVec("signaling_messages_dropped_total", "Messages discarded without delivery.", "type", "reason"),
+	notFound: newCounterVec("signaling_messages_not_found_total", "Messages addressed to an id that is not connected.", "type"),
+	latency: newHistogram("signaling_relay_duration_seconds", "Time from reading a message to handing it to its target.",
+		[]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}),
+}
+
+// metricType maps a message type to a label value with bounded cardinality,
+// since legacy messages may carry any type.
+func metricType(t string) string {
+	switch t {
+	case kindOffer, kindAnswer, kindCandidate, kindBye, kindCustom,
+		kindInvite, kindRinging, kindAccept, kindDecline, kindBusy, kindCancel, kindHangup, kindTimeout:
+		return t
+	case "":
+		return "unknown"
+	}
+	return "other"
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	fmt.Fprintf(w, "# HELP signaling_connected_clients Clients connected to this node.\n")
+	fmt.Fprintf(w, "# TYPE signaling_connected_clients gauge\n")
+	fmt.Fprintf(w, "signaling_connected_clients %d\n", clients.count())
+
+	stats.relayed.write(w)
+	stats.queued.write(w)
+	stats.dropped.write(w)
+	stats.notFound.write(w)
+	stats.latency.write(w)
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// ready is set once the relay is about to accept connections.
+var ready struct {
+	sync.Mutex
+	ok bool
+}
+
+func setReady(ok bool) {
+	ready.Lock()
+	ready.ok = ok
+	ready.Unlock()
+}
+
+// readyzHandler reports whether the relay can serve traffic: it has started
+// and its broker, if any, is reachable.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready.Lock()
+	ok := ready.ok
+	ready.Unlock()
+	if !ok {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	if clients.broker != nil {
+		if err := clients.broker.Ping(); err != nil {
+			log.Printf("Readiness check failed: %v", err)
+			http.Error(w, "broker unavailable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// observeRelay records how long handing a message read at received took.
+func observeRelay(received time.Time) {
+	stats.latency.observe(time.Since(received).Seconds())
+}
@@ -0,0 +1,55 @@
+// mint-token issues signaling relay access tokens offline, for test
+// environments.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"pion-webrtc-example/signaling/auth"
+)
+
+func main() {
+	key := flag.String("key", "", "HMAC key shared with the relay")
+	keyFile := flag.String("key-file", "", "file holding the HMAC key, instead of -key")
+	sub := flag.String("sub", "", "peer id the token is issued for")
+	ttl := flag.Duration("ttl", time.Hour, "token lifetime, 0 for a token that never expires")
+	targets := flag.String("targets", "", "comma separated id patterns the peer may send to, e.g. 'bob,room-*' (empty allows all)")
+	flag.Parse()
+
+	secret := []byte(*key)
+	if *keyFile != "" {
+		b, err := os.ReadFile(*keyFile)
+		if err != nil {
+			log.Fatalf("Failed to read key file: %v", err)
+		}
+		secret = []byte(strings.TrimSpace(string(b)))
+	}
+	if len(secret) == 0 {
+		log.Fatal("Missing -key or -key-file")
+	}
+
+	now := time.Now()
+	c := auth.Claims{
+		Subject:  *sub,
+		IssuedAt: now.Unix(),
+	}
+	if *ttl > 0 {
+		c.ExpiresAt = now.Add(*ttl).Unix()
+	}
+	for _, t := range strings.Split(*targets, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			c.Targets = append(c.Targets, t)
+		}
+	}
+
+	token, err := auth.Sign(c, secret)
+	if err != nil {
+		log.Fatalf("Failed to sign token: %v", err)
+	}
+	fmt.Println(token)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	eventPeerJoined = "peer-joined"
+	eventPeerLeft   = "peer-left"
+)
+
+// peerInfo is the presence record of a connected client. Name and
+// capabilities are optional metadata supplied by the client on connect.
+type peerInfo struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name,omitempty"`
+	Capabilities []string  `json:"capabilities,omitempty"`
+	ConnectedAt  time.Time `json:"connectedAt"`
+}
+
+// presenceEvent is pushed to clients that subscribed to presence.
+type presenceEvent struct {
+	Type string   `json:"type"`
+	Peer peerInfo `json:"peer"`
+}
+
+// peerInfoFromRequest builds the presence record for id from the optional
+// ?name=...&caps=a,b query parameters of the upgrade request.
+func peerInfoFromRequest(id string, r *http.Request) peerInfo {
+	q := r.URL.Query()
+	return peerInfo{
+		ID:           id,
+		Name:         q.Get("name"),
+		Capabilities: splitList(q.Get("caps")),
+		ConnectedAt:  time.Now().UTC(),
+	}
+}
+
+// wantsPresence reports whether the client asked for join/leave events
+// with ?presence=1.
+func wantsPresence(r *http.Request) bool {
+	switch r.URL.Query().Get("presence") {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// peers returns the presence records of all connected clients, sorted by id.
+func (r *registry) peers() []peerInfo {
+	r.mu.RLock()
+	list := make([]peerInfo, 0, len(r.clients))
+	for _, c := range r.clients {
+		list = append(list, c.info)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// publishPresence sends a presence event about info to every subscribed
+// client except the one it describes.
+func (r *registry) publishPresence(typ string, info peerInfo) {
+	data, err := json.Marshal(presenceEvent{Type: typ, Peer: info})
+	if err != nil {
+		log.Printf("Failed to marshal presence event: %v", err)
+		return
+	}
+
+	r.mu.RLock()
+	subscribers := make([]*client, 0, len(r.clients))
+	for _, c := range r.clients {
+		if c.presence && c.id != info.ID {
+			subscribers = append(subscribers, c)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, c := range subscribers {
+		if err := c.enqueue(data); err != nil {
+			log.Printf("Failed to send %s to client %s: %v", typ, c.id, err)
+		}
+	}
+}
+
+// peersHandler serves GET /peers with the list of connected clients. With
+// authentication on it takes the same token as a connecting client, and
+// lists only the peers the token may reach.
+func peersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := verifyRequest(r)
+	if err != nil {
+		log.Printf("Peer list rejected: %v", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	list := clients.peers()
+	if claims != nil {
+		reachable := list[:0]
+		for _, p := range list {
+			if claims.CanReach(p.ID) {
+				reachable = append(reachable, p)
+			}
+		}
+		list = reachable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Printf("Failed to write peer list: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"pion-webrtc-example/signaling/auth"
+)
+
+// nextPresence returns the next presence event queued for c.
+func nextPresence(t *testing.T, c *client) presenceEvent {
+	t.Helper()
+	select {
+	case data := <-c.send:
+		var ev presenceEvent
+		if err := json.Unmarshal(data, &ev); err != nil {
+			t.Fatalf("message %s for %s: %v", data, c.id, err)
+		}
+		return ev
+	default:
+		t.Fatalf("no presence event for %s", c.id)
+	}
+	return presenceEvent{}
+}
+
+func TestPresenceEvents(t *testing.T) {
+	r := newRegistry(4, dropOldest)
+	watcher, _, err := r.register(nil, peerInfo{ID: "w"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.unregister(watcher)
+	if len(watcher.send) != 0 {
+		t.Fatal("subscriber told about itself")
+	}
+	other, _, err := r.register(nil, peerInfo{ID: "b", Name: "bob"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ev := nextPresence(t, watcher); ev.Type != eventPeerJoined || ev.Peer.ID != "b" || ev.Peer.Name != "bob" {
+		t.Fatalf("got %+v, want b joined", ev)
+	}
+	r.unregister(other)
+	if ev := nextPresence(t, watcher); ev.Type != eventPeerLeft || ev.Peer.ID != "b" {
+		t.Fatalf("got %+v, want b left", ev)
+	}
+	if len(other.send) != 0 {
+		t.Fatal("client without presence got events")
+	}
+}
+
+func TestPeers(t *testing.T) {
+	clients = newRegistry(4, dropOldest)
+	for _, id := range []string{"c", "a", "b"} {
+		c, _, err := clients.register(nil, peerInfo{ID: id}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clients.unregister(c)
+	}
+
+	authKey = []byte("secret")
+	defer func() { authKey = nil }()
+	token, err := auth.Sign(auth.Claims{Subject: "a", Targets: []string{"b"}}, authKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		code  int
+		want  []string
+	}{
+		{"no token", "", http.StatusUnauthorized, nil},
+		{"bad token", token + "x", http.StatusUnauthorized, nil},
+		{"token", token, http.StatusOK, []string{"b"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/peers", nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		peersHandler(w, req)
+		if w.Code != tc.code {
+			t.Fatalf("%s: answered %d, want %d", tc.name, w.Code, tc.code)
+		}
+		if tc.code != http.StatusOK {
+			continue
+		}
+		var list []peerInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != len(tc.want) || list[0].ID != tc.want[0] {
+			t.Fatalf("%s: listed %+v, want %v", tc.name, list, tc.want)
+		}
+	}
+
+	// without -auth-key everyone is listed, sorted by id
+	authKey = nil
+	w := httptest.NewRecorder()
+	peersHandler(w, httptest.NewRequest(http.MethodGet, "/peers", nil))
+	var list []peerInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 || list[0].ID != "a" || list[1].ID != "b" || list[2].ID != "c" {
+		t.Fatalf("listed %+v, want a, b, c", list)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"pion-webrtc-example/signaling/recording"
+)
+
+// recorder, if set, receives every message read by the relay, invalid ones
+// included, and every message it delivers, including those relayed by
+// other nodes through the broker.
+var recorder *recording.Writer
+
+// record writes one entry to the recorder. Failures are logged and never
+// affect relaying.
+func record(dir, from, to, result string, data []byte) {
+	if recorder == nil {
+		return
+	}
+	err := recorder.Write(recording.Entry{
+		Time:      time.Now().UTC(),
+		Direction: dir,
+		From:      from,
+		To:        to,
+		Result:    result,
+		Data:      data,
+	})
+	if err != nil {
+		log.Printf("Failed to record message: %v", err)
+	}
+}
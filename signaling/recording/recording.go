@@ -0,0 +1,210 @@
+// Package recording stores the traffic of the signaling relay as JSONL, one
+// entry per message, so failed negotiations can be inspected and replayed.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// directions of an entry
+const (
+	In  = "in"  // read by the relay from From
+	Out = "out" // handed by the relay towards To
+)
+
+// Entry is one recorded message.
+type Entry struct {
+	Time      time.Time       `json:"time"`
+	Direction string          `json:"dir"`
+	From      string          `json:"from"`
+	To        string          `json:"to"`
+	Result    string          `json:"result,omitempty"` // outcome of an Out entry
+	Data      json.RawMessage `json:"data"`             // a JSON string if the message was not JSON
+}
+
+// rotatedLayout is the timestamp suffix of rotated files, in UTC.
+const rotatedLayout = "20060102T150405.000"
+
+// Writer appends entries to a JSONL file and rotates it once it grows past
+// maxSize. Rotated files get a timestamp suffix and only the newest keep of
+// them are retained. It is safe for concurrent use.
+type Writer struct {
+	path    string
+	maxSize int64
+	keep    int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// NewWriter opens path for appending. A maxSize of 0 disables rotation.
+func NewWriter(path string, maxSize int64, keep int) (*Writer, error) {
+	w := &Writer{path: path, maxSize: maxSize, keep: keep}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) open() error {
+	if dir := filepath.Dir(w.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f = f
+	w.size = fi.Size()
+	return nil
+}
+
+// Write appends e as one line.
+func (w *Writer) Write(e Entry) error {
+	if !json.Valid(e.Data) {
+		quoted, err := json.Marshal(string(e.Data))
+		if err != nil {
+			return err
+		}
+		e.Data = quoted
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.f == nil {
+		return os.ErrClosed
+	}
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(line)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := w.f.Write(line)
+	w.size += int64(n)
+	return err
+}
+
+// rotate moves the current file aside and starts a new one.
+func (w *Writer) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	w.f = nil
+
+	ext := filepath.Ext(w.path)
+	base := strings.TrimSuffix(w.path, ext)
+	// rotations within the same millisecond take the next free stamp, so an
+	// earlier file is never overwritten and the names still sort in order
+	stamp := time.Now().UTC()
+	rotated := fmt.Sprintf("%s-%s%s", base, stamp.Format(rotatedLayout), ext)
+	for {
+		_, err := os.Lstat(rotated)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		stamp = stamp.Add(time.Millisecond)
+		rotated = fmt.Sprintf("%s-%s%s", base, stamp.Format(rotatedLayout), ext)
+	}
+	if err := os.Rename(w.path, rotated); err != nil {
+		return err
+	}
+	if err := w.prune(base, ext); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// prune removes the oldest rotated files beyond w.keep. Only the files
+// named by rotate are counted, others sharing the prefix are left alone.
+func (w *Writer) prune(base, ext string) error {
+	if w.keep <= 0 {
+		return nil
+	}
+	dir, prefix := filepath.Split(base + "-")
+	entries, err := os.ReadDir(filepath.Clean(dir))
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+		if _, err := time.Parse(rotatedLayout, stamp); err != nil || len(stamp) != len(rotatedLayout) {
+			continue
+		}
+		rotated = append(rotated, filepath.Join(dir, name))
+	}
+	// timestamp suffixes sort chronologically
+	sort.Strings(rotated)
+	for len(rotated) > w.keep {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+// Close closes the current file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// Read calls fn for every entry in r, in order, stopping at the first error.
+func Read(r io.Reader, fn func(Entry) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		if len(strings.TrimSpace(sc.Text())) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
@@ -0,0 +1,131 @@
+package recording
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRotateKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session.jsonl")
+	others := []string{"session-old.jsonl", "session-notes.jsonl", "session-20240101T000000.jsonl"}
+	for _, name := range others {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w, err := NewWriter(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := w.Write(Entry{Time: time.Now(), Direction: In, From: "a", To: "b", Data: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	for _, name := range append(others, "session.jsonl") {
+		if i := sort.SearchStrings(names, name); i == len(names) || names[i] != name {
+			t.Fatalf("%s removed, left %v", name, names)
+		}
+	}
+	if len(names) != len(others)+1+2 {
+		t.Fatalf("left %v, want the other files, the current one and 2 rotated", names)
+	}
+}
+
+func TestRotateWithinMillisecond(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(filepath.Join(dir, "session.jsonl"), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = 20
+	for i := 0; i < n; i++ {
+		if err := w.Write(Entry{Time: time.Now(), Direction: In, Data: []byte(strconv.Itoa(i))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	// every entry is kept, in order of the names
+	names, err := filepath.Glob(filepath.Join(dir, "session-*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	names = append(names, filepath.Join(dir, "session.jsonl"))
+	if len(names) != n {
+		t.Fatalf("%d files, want %d", len(names), n)
+	}
+	for i, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Read(f, func(e Entry) error {
+			if string(e.Data) != strconv.Itoa(i) {
+				t.Errorf("%s holds %s, want %d", name, e.Data, i)
+			}
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadWritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.jsonl")
+	w, err := NewWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Entry{Time: time.Now().UTC(), Direction: Out, From: "a", To: "b", Result: "relayed", Data: []byte(`{"v":1}`)}
+	if err := w.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	// a message that is not JSON is kept as a string
+	if err := w.Write(Entry{Time: time.Now().UTC(), Direction: In, From: "a", Data: []byte(`{"v":`)}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []Entry
+	if err := Read(f, func(e Entry) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !got[0].Time.Equal(want.Time) || got[0].Result != want.Result || !bytes.Equal(got[0].Data, want.Data) {
+		t.Fatalf("read %+v, want %+v", got, want)
+	}
+	if string(got[1].Data) != `"{\"v\":"` {
+		t.Fatalf("invalid message recorded as %s", got[1].Data)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// overflowPolicy decides what happens when a client's outbound queue is full.
+type overflowPolicy int
+
+const (
+	// dropOldest discards the oldest queued message to make room for the new one.
+	dropOldest overflowPolicy = iota
+	// disconnectSlow closes the connection of a client that cannot keep up.
+	disconnectSlow
+)
+
+func parseOverflowPolicy(s string) (overflowPolicy, error) {
+	switch s {
+	case "drop-oldest":
+		return dropOldest, nil
+	case "disconnect":
+		return disconnectSlow, nil
+	}
+	return 0, fmt.Errorf("unknown overflow policy %q", s)
+}
+
+func (p overflowPolicy) String() string {
+	switch p {
+	case dropOldest:
+		return "drop-oldest"
+	case disconnectSlow:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+var (
+	errClientNotFound = errors.New("client not found")
+	errClientClosed   = errors.New("client closed")
+)
+
+// client is one connected peer. All writes to conn go through the send
+// queue and are performed by writePump, so senders never touch the
+// connection directly. Clients using the HTTP transport have no conn; their
+// queue is drained by their pending GET /recv instead.
+type client struct {
+	id     string
+	conn   *websocket.Conn
+	http   *httpSession
+	send   chan []byte
+	policy overflowPolicy
+
+	info     peerInfo
+	presence bool // receives peer-joined/peer-left events
+
+	writeTimeout time.Duration // per message, 0 for none
+	pingInterval time.Duration // 0 disables keepalive pings
+
+	// inbound rate limit, nil for none
+	limitMu sync.Mutex
+	limiter *tokenBucket
+	strikes int
+
+	// flushing is set while the messages stored for the client are
+	// delivered, new ones are stored behind them meanwhile
+	flushMu  sync.Mutex
+	flushing bool
+
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeCode   int // sent in the close frame if not 0, set before done is closed
+	closeReason string
+}
+
+func newClient(info peerInfo, conn *websocket.Conn, queueSize int, policy overflowPolicy) *client {
+	if queueSize < 1 {
+		queueSize = 1
+	}
+	return &client{
+		id:     info.ID,
+		conn:   conn,
+		send:   make(chan []byte, queueSize),
+		policy: policy,
+		info:   info,
+		done:   make(chan struct{}),
+	}
+}
+
+// enqueue puts data on the outbound queue without blocking. When the queue
+// is full the overflow policy is applied.
+func (c *client) enqueue(data []byte) error {
+	for {
+		select {
+		case <-c.done:
+			return errClientClosed
+		default:
+		}
+
+		select {
+		case c.send <- data:
+			return nil
+		default:
+		}
+
+		if c.policy == disconnectSlow {
+			log.Printf("Client %s is too slow, disconnecting", c.id)
+			c.evict(closeSlowConsumer, "slow consumer")
+			return errClientClosed
+		}
+
+		// make room by discarding the oldest message, then retry
+		select {
+		case <-c.send:
+			log.Printf("Client %s queue full, dropped oldest message", c.id)
+			stats.dropped.inc(metricType(""), dropQueueFull)
+		default:
+		}
+	}
+}
+
+// close stops the writer goroutine and closes the underlying connection.
+// It is safe to call more than once and from any goroutine.
+func (c *client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// writePump drains the outbound queue and sends keepalive pings until the
+// client is closed. It is the only goroutine that writes to conn.
+func (c *client) writePump() {
+	defer c.conn.Close()
+
+	var ping <-chan time.Time
+	if c.pingInterval > 0 {
+		ticker := time.NewTicker(c.pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			c.sendCloseFrame()
+			return
+		case <-ping:
+			if err := c.sendPing(); err != nil {
+				log.Printf("Failed to ping client %s: %v", c.id, err)
+				c.close()
+				return
+			}
+		case data := <-c.send:
+			if c.writeTimeout > 0 {
+				c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				log.Printf("Failed to send message to client %s: %v", c.id, err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// registry tracks connected clients by id.
+type registry struct {
+	mu      sync.RWMutex
+	clients map[string]*client
+
+	queueSize    int
+	policy       overflowPolicy
+	duplicates   duplicatePolicy
+	writeTimeout time.Duration
+	pingInterval time.Duration
+	// how long an HTTP client may go without polling
+	sessionTimeout time.Duration
+
+	// optional store for messages to offline clients
+	mailbox    mailbox
+	mailboxTTL time.Duration
+
+	// optional broker shared with other relay nodes, node is our name in it
+	broker broker
+	node   string
+
+	calls *callTable
+}
+
+func newRegistry(queueSize int, policy overflowPolicy) *registry {
+	r := &registry{
+		clients:   make(map[string]*client),
+		queueSize: queueSize,
+		policy:    policy,
+		calls:     newCallTable(),
+	}
+	r.calls.onTimeout = r.callTimedOut
+	return r
+}
+
+// register creates a client for conn, starts its writer and stores it under
+// info.ID. A nil conn registers an HTTP client. If the id is already
+// connected the duplicate policy applies: the previous client is either
+// closed and returned, or errDuplicateID is returned and nothing is
+// registered. Subscribed clients are told about the new peer.
+func (r *registry) register(conn *websocket.Conn, info peerInfo, presence bool) (c *client, old *client, err error) {
+	c = newClient(info, conn, r.queueSize, r.policy)
+	c.presence = presence
+	c.writeTimeout = r.writeTimeout
+	c.pingInterval = r.pingInterval
+	c.limiter = newLimiter()
+
+	r.mu.Lock()
+	old = r.clients[c.id]
+	if old != nil && r.duplicates == rejectNew {
+		r.mu.Unlock()
+		return nil, nil, errDuplicateID
+	}
+	// stored messages go first, before c is published
+	c.flushing = r.mailbox != nil
+	if conn != nil {
+		go c.writePump()
+	} else {
+		c.http = &httpSession{lastSeen: time.Now()}
+		go r.watchSession(c)
+	}
+	r.clients[c.id] = c
+	r.mu.Unlock()
+
+	if old != nil {
+		old.evict(closeReplaced, "replaced by a new login")
+	}
+	if r.broker != nil {
+		r.claim(c)
+	}
+	if r.mailbox != nil {
+		r.flushMailbox(c)
+	}
+	r.publishPresence(eventPeerJoined, info)
+	return c, old, nil
+}
+
+// unregister removes c, unless it has already been replaced by a newer
+// connection with the same id. It reports whether c was removed.
+func (r *registry) unregister(c *client) bool {
+	removed := false
+	r.mu.Lock()
+	if cur, ok := r.clients[c.id]; ok && cur == c {
+		delete(r.clients, c.id)
+		removed = true
+	}
+	r.mu.Unlock()
+	c.close()
+
+	if removed {
+		if r.broker != nil {
+			r.release(c)
+		}
+		r.endCall(c.id)
+		r.publishPresence(eventPeerLeft, c.info)
+	}
+	return removed
+}
+
+func (r *registry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.clients)
+}
+
+func (r *registry) lookup(id string) (*client, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	c, ok := r.clients[id]
+	return c, ok
+}
+
+// online reports whether id is connected to this node or, with a broker, to
+// any node.
+func (r *registry) online(id string) bool {
+	if _, ok := r.lookup(id); ok {
+		return true
+	}
+	if r.broker == nil {
+		return false
+	}
+	_, err := r.broker.Owner(id)
+	return err == nil
+}
+
+// relay queues data from the client from for delivery to the client
+// registered under id. A client on another node is reached through the
+// broker. If id is offline and a mailbox is configured the message is stored
+// until id connects, and stored is true.
+func (r *registry) relay(from, id string, data []byte) (stored bool, err error) {
+	if c, ok := r.lookup(id); ok {
+		return r.deliver(c, from, data)
+	}
+	if r.broker != nil {
+		forwarded, err := r.forward(from, id, data)
+		if forwarded || err != nil {
+			return false, err
+		}
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if c, ok := r.clients[id]; ok {
+		// connected while we were asking the broker
+		return r.deliver(c, from, data)
+	}
+	if r.mailbox == nil {
+		return false, errClientNotFound
+	}
+	if err := r.store(from, id, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
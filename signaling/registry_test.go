@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestEnqueueConcurrent(t *testing.T) {
+	const senders, perSender = 8, 100
+	for _, policy := range []overflowPolicy{dropOldest, disconnectSlow} {
+		c := newClient(peerInfo{ID: "a"}, nil, senders*perSender, policy)
+
+		var wg sync.WaitGroup
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < perSender; j++ {
+					if err := c.enqueue([]byte(fmt.Sprintf("%d-%d", i, j))); err != nil {
+						t.Errorf("%s: enqueue: %v", policy, err)
+						return
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if n := len(c.send); n != senders*perSender {
+			t.Fatalf("%s: %d messages queued, want %d", policy, n, senders*perSender)
+		}
+	}
+}
+
+func TestEnqueueOverflowDropOldest(t *testing.T) {
+	c := newClient(peerInfo{ID: "a"}, nil, 2, dropOldest)
+	for _, m := range []string{"1", "2", "3"} {
+		if err := c.enqueue([]byte(m)); err != nil {
+			t.Fatalf("enqueue %s: %v", m, err)
+		}
+	}
+	for _, want := range []string{"2", "3"} {
+		if got := string(<-c.send); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	// concurrent senders on a full queue never block nor fail
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := c.enqueue([]byte("x")); err != nil {
+					t.Errorf("enqueue: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(c.send); n != cap(c.send) {
+		t.Fatalf("%d messages queued, want a full queue of %d", n, cap(c.send))
+	}
+}
+
+func TestEnqueueOverflowDisconnect(t *testing.T) {
+	c := newClient(peerInfo{ID: "a"}, nil, 1, disconnectSlow)
+	if err := c.enqueue([]byte("1")); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	if err := c.enqueue([]byte("2")); err != errClientClosed {
+		t.Fatalf("enqueue on a full queue = %v, want errClientClosed", err)
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Fatal("slow client not closed")
+	}
+	if c.closeCode != closeSlowConsumer {
+		t.Fatalf("close code %d, want %d", c.closeCode, closeSlowConsumer)
+	}
+	if err := c.enqueue([]byte("3")); err != errClientClosed {
+		t.Fatalf("enqueue on a closed client = %v, want errClientClosed", err)
+	}
+}
+
+func TestRegisterReplaces(t *testing.T) {
+	r := newRegistry(4, dropOldest)
+	first, _, err := r.register(nil, peerInfo{ID: "a"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, old, err := r.register(nil, peerInfo{ID: "a"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != first {
+		t.Fatal("the first client was not replaced")
+	}
+	if first.closeCode != closeReplaced {
+		t.Fatalf("replaced client close code %d, want %d", first.closeCode, closeReplaced)
+	}
+	if r.unregister(first) {
+		t.Fatal("unregistered the replaced client over its successor")
+	}
+	if c, ok := r.lookup("a"); !ok || c != second {
+		t.Fatal("successor not registered")
+	}
+	if !r.unregister(second) || r.count() != 0 {
+		t.Fatalf("%d clients left", r.count())
+	}
+
+	r.duplicates = rejectNew
+	if _, _, err := r.register(nil, peerInfo{ID: "b"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := r.register(nil, peerInfo{ID: "b"}, false); err != errDuplicateID {
+		t.Fatalf("duplicate register = %v, want errDuplicateID", err)
+	}
+}
+
+func TestRegisterChurn(t *testing.T) {
+	r := newRegistry(4, dropOldest)
+	// a subscriber gets the presence events of the churn
+	watcher, _, err := r.register(nil, peerInfo{ID: "watcher"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// ids are shared by pairs of goroutines, so some registrations
+			// replace others
+			id := fmt.Sprintf("peer-%d", i/2)
+			for j := 0; j < 50; j++ {
+				c, _, err := r.register(nil, peerInfo{ID: id}, false)
+				if err != nil {
+					t.Errorf("register %s: %v", id, err)
+					return
+				}
+				if _, err := r.relay(id, "watcher", []byte("hello")); err != nil {
+					t.Errorf("relay: %v", err)
+				}
+				r.unregister(c)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := r.count(); n != 1 {
+		t.Fatalf("%d clients left, want the watcher only", n)
+	}
+	if !r.unregister(watcher) || r.count() != 0 {
+		t.Fatal("watcher not unregistered")
+	}
+}
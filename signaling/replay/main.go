@@ -0,0 +1,164 @@
+// replay re-drives a session recorded by the relay's -record option against a
+// relay instance. Every client that sent messages in the recording is
+// connected again and its messages are resent in the recorded order, so
+// SDP/candidate ordering bugs can be reproduced deterministically.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"pion-webrtc-example/signaling/auth"
+	"pion-webrtc-example/signaling/recording"
+)
+
+func main() {
+	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds)
+	addr := flag.String("addr", "ws://127.0.0.1:8000", "base URL of the relay to replay against")
+	file := flag.String("file", "", "record file written by the relay")
+	ids := flag.String("ids", "", "comma separated client ids to replay (all if empty)")
+	speed := flag.Float64("speed", 1, "replay speed factor relative to the recording, 0 sends without delays")
+	wait := flag.Duration("wait", 2*time.Second, "how long to keep listening after the last message")
+	authKey := flag.String("auth-key", "", "HMAC key to mint access tokens for the replayed ids")
+	insecure := flag.Bool("insecure", false, "skip TLS certificate verification for wss://")
+	flag.Parse()
+
+	if *file == "" {
+		log.Fatal("Missing -file")
+	}
+
+	wanted := make(map[string]bool)
+	for _, id := range strings.Split(*ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			wanted[id] = true
+		}
+	}
+
+	entries, receivers, err := load(*file, wanted)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", *file, err)
+	}
+	if len(entries) == 0 {
+		log.Fatal("Nothing to replay")
+	}
+	log.Printf("Replaying %d messages", len(entries))
+
+	dialer := *websocket.DefaultDialer
+	if *insecure {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	// connect every sender, and every receiver that was online in the
+	// recording, before the first message is sent
+	peers := make([]string, 0, len(entries)+len(receivers))
+	for _, e := range entries {
+		peers = append(peers, e.From)
+	}
+	peers = append(peers, receivers...)
+
+	conns := make(map[string]*websocket.Conn)
+	var wg sync.WaitGroup
+	for _, id := range peers {
+		if _, ok := conns[id]; ok {
+			continue
+		}
+		c, err := dial(&dialer, *addr, id, []byte(*authKey))
+		if err != nil {
+			log.Fatalf("Failed to connect %s: %v", id, err)
+		}
+		conns[id] = c
+
+		wg.Add(1)
+		go func(id string, c *websocket.Conn) {
+			defer wg.Done()
+			for {
+				_, data, err := c.ReadMessage()
+				if err != nil {
+					return
+				}
+				log.Printf("%s << %s", id, data)
+			}
+		}(id, c)
+	}
+
+	start := entries[0].Time
+	began := time.Now()
+	for _, e := range entries {
+		if *speed > 0 {
+			due := began.Add(time.Duration(float64(e.Time.Sub(start)) / *speed))
+			time.Sleep(time.Until(due))
+		}
+		log.Printf("%s >> %s: %s", e.From, e.To, e.Data)
+		if err := conns[e.From].WriteMessage(websocket.TextMessage, e.Data); err != nil {
+			log.Fatalf("Failed to send as %s: %v", e.From, err)
+		}
+	}
+
+	time.Sleep(*wait)
+	for _, c := range conns {
+		c.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "replay done"))
+		c.Close()
+	}
+	wg.Wait()
+}
+
+// load returns the inbound entries of the recording, optionally limited to
+// the senders in wanted, and the ids that received at least one of them.
+func load(path string, wanted map[string]bool) (entries []recording.Entry, receivers []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	err = recording.Read(f, func(e recording.Entry) error {
+		if len(wanted) > 0 && !wanted[e.From] {
+			return nil
+		}
+		switch e.Direction {
+		case recording.In:
+			entries = append(entries, e)
+		case recording.Out:
+			if e.Result == "relayed" && !seen[e.To] {
+				seen[e.To] = true
+				receivers = append(receivers, e.To)
+			}
+		}
+		return nil
+	})
+	return entries, receivers, err
+}
+
+func dial(dialer *websocket.Dialer, base, id string, key []byte) (*websocket.Conn, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + id
+
+	if len(key) > 0 {
+		token, err := auth.Sign(auth.Claims{
+			Subject:   id,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		}, key)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("token", token)
+		u.RawQuery = q.Encode()
+	}
+
+	c, _, err := dialer.Dial(u.String(), nil)
+	return c, err
+}
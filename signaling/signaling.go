@@ -1,26 +1,78 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/tls"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
+
+	"pion-webrtc-example/signaling/auth"
+	"pion-webrtc-example/signaling/recording"
 )
 
-var clients = make(map[string]*websocket.Conn)
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
+var listenAddr = flag.String("listen", ":8000", "address the relay listens on")
+var tlsCert = flag.String("tls-cert", "", "TLS certificate file, serves wss:// when set together with -tls-key")
+var tlsKey = flag.String("tls-key", "", "TLS private key file")
+var tlsReload = flag.Duration("tls-reload", 10*time.Second, "how often the TLS files are checked for changes")
+var allowedOrigins = flag.String("allowed-origins", "", "comma separated origins allowed to connect, e.g. 'https://app.example.com,*.example.org' (all if empty)")
+var readTimeout = flag.Duration("read-timeout", 0, "max time to wait for the next message from a client, 0 for none")
+var writeTimeout = flag.Duration("write-timeout", 10*time.Second, "max time to write one message to a client, 0 for none")
+var pingInterval = flag.Duration("ping-interval", 20*time.Second, "how often clients are pinged, 0 disables keepalive")
+var pongWait = flag.Duration("pong-wait", 60*time.Second, "how long a client may stay silent, pongs included, before it is considered dead")
+var maxMessageSize = flag.Int64("max-message-size", 64*1024, "max size in bytes of a message from a client")
+var rateLimit = flag.Float64("rate-limit", 0, "max messages per second per client, 0 for no limit")
+var rateBurst = flag.Int("rate-burst", 20, "number of messages a client may send at once above -rate-limit")
+var recordFile = flag.String("record", "", "JSONL file every relayed message is recorded to (disabled if empty)")
+var recordMaxSize = flag.Int64("record-max-size", 64<<20, "size in bytes after which the record file is rotated, 0 to never rotate")
+var recordKeep = flag.Int("record-keep", 5, "number of rotated record files to keep, 0 to keep all")
+var queueSize = flag.Int("queue-size", 64, "max number of outbound messages queued per client")
+var overflow = flag.String("overflow", "drop-oldest", "what to do when a client queue is full: drop-oldest or disconnect")
+var mailboxKind = flag.String("mailbox", "", "store messages for offline clients: memory or file (disabled if empty)")
+var mailboxDir = flag.String("mailbox-dir", "mailbox", "directory of the file mailbox")
+var mailboxTTL = flag.Duration("mailbox-ttl", 30*time.Second, "how long a message waits for an offline client")
+var mailboxDepth = flag.Int("mailbox-depth", 32, "max number of messages queued per offline client")
+var authKeyFlag = flag.String("auth-key", "", "HMAC key for access tokens (authentication disabled if empty)")
+var authKeyFile = flag.String("auth-key-file", "", "file holding the HMAC key for access tokens, instead of -auth-key")
+var brokerKind = flag.String("broker", "", "share clients with other relay nodes through redis, or local for a single in-process node (disabled if empty)")
+var redisAddr = flag.String("redis-addr", "127.0.0.1:6379", "address of the Redis-protocol server used by -broker redis")
+var redisPassword = flag.String("redis-password", "", "password of the Redis-protocol server")
+var nodeID = flag.String("node-id", "", "unique name of this relay node in the broker (default hostname-pid)")
+var callTimeout = flag.Duration("call-timeout", 30*time.Second, "how long an invite may stay unanswered, 0 for no limit")
+var requireCall = flag.Bool("require-call", false, "only relay offers, answers and candidates within an accepted call")
+var pollWait = flag.Duration("poll-wait", 25*time.Second, "how long a long-poll GET /recv waits for messages")
+var sessionTimeout = flag.Duration("session-timeout", 30*time.Second, "how long an HTTP client stays online without a pending GET /recv, 0 for ever")
+var duplicate = flag.String("duplicate", "kick", "what to do when a connected id logs in again: kick the old session or reject the new one")
+
+var clients *registry
+var upgrader = websocket.Upgrader{}
 
 func httpHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("%s %s", r.Method, r.URL)
 
 	log.Printf("WS %s", r.URL)
 
+	path := r.URL.Path
+	splitted := strings.Split(path, "/")
+	id := splitted[1]
+
+	claims, err := authenticate(r, id)
+	if err != nil {
+		log.Printf("Client %s rejected: %v", id, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if clients.duplicates == rejectNew && clients.online(id) {
+		log.Printf("Client %s rejected: %v", id, errDuplicateID)
+		http.Error(w, errDuplicateID.Error(), http.StatusConflict)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade to WebSocket: %v", err)
@@ -28,56 +80,223 @@ func httpHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// 回复消息
 	// conn.WriteMessage(websocket.TextMessage, []byte("Hello, client!"))
-	defer conn.Close()
 
-	path := r.URL.Path
-	splitted := strings.Split(path, "/")
-	id := splitted[1]
+	c, old, err := clients.register(conn, peerInfoFromRequest(id, r), wantsPresence(r))
+	if err != nil {
+		// lost a race against another login with the same id
+		log.Printf("Client %s rejected: %v", id, err)
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, err.Error()))
+		conn.Close()
+		return
+	}
+	if old != nil {
+		log.Printf("Client %s replaced by a new connection", id)
+	}
+	// from here on the writer goroutine of c owns closing conn, so that it
+	// can send a close frame first
+	defer clients.unregister(c)
 
-	clients[id] = conn
-	defer delete(clients, id)
+	conn.SetReadLimit(*maxMessageSize)
+	lastMessage := time.Now()
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(readDeadline(lastMessage))
+	})
 
 	for {
+		conn.SetReadDeadline(readDeadline(lastMessage))
 		messageType, data, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("Client %s disconnected: %v", id, err)
+			c.evictOnReadError(err)
 			return
 		}
+		lastMessage = time.Now()
 
 		if messageType == websocket.TextMessage {
-			log.Printf("Client %s << %s", id, data)
-
-			var message map[string]interface{}
-			if err := json.Unmarshal(data, &message); err != nil {
-				log.Printf("Failed to parse message: %v", err)
-				continue
-			}
-
-			destId := message["id"].(string)
-			dest, ok := clients[destId]
-			if ok {
-				message["id"] = id
-				data, _ := json.Marshal(message)
-				log.Printf("Client %s >> %s", destId, data)
-				if err := dest.WriteMessage(websocket.TextMessage, data); err != nil {
-					log.Printf("Failed to send message to client %s: %v", destId, err)
-				}
-			} else {
-				log.Printf("Client %s not found", destId)
+			if !handleMessage(c, claims, data, lastMessage) {
+				return
 			}
 		}
 	}
 }
 
+// handleMessage routes one message received from c at received, whatever
+// transport it came over. Rejections are answered on c. It returns false if
+// c has been evicted.
+func handleMessage(c *client, claims *auth.Claims, data []byte, received time.Time) bool {
+	id := c.id
+	if allowed, evicted := c.limit(received); !allowed {
+		return !evicted
+	}
+
+	log.Printf("Client %s << %s", id, data)
+
+	msg, rerr := routeMessage(id, data)
+	if rerr != nil {
+		log.Printf("Client %s sent an invalid message: %v", id, rerr)
+		c.sendError(rerr)
+		stats.dropped.inc(metricType(""), dropInvalid)
+		record(recording.In, id, "", "", data)
+		record(recording.Out, id, "", dropInvalid, data)
+		return true
+	}
+
+	destId := msg.To
+	typ := metricType(msg.Type)
+	record(recording.In, id, destId, "", data)
+	if claims != nil && !claims.CanReach(destId) {
+		log.Printf("Client %s is not allowed to reach %s", id, destId)
+		c.sendError(&relayError{Code: codeForbidden, Message: "not allowed to reach " + destId, Txn: msg.Txn})
+		stats.dropped.inc(typ, dropForbidden)
+		record(recording.Out, id, destId, dropForbidden, msg.Data)
+		return true
+	}
+	if ok, reason := clients.admitCall(c, msg); !ok {
+		stats.dropped.inc(typ, reason)
+		record(recording.Out, id, destId, reason, msg.Data)
+		return true
+	}
+	log.Printf("Client %s >> %s", destId, msg.Data)
+	stored, err := clients.relay(id, destId, msg.Data)
+	observeRelay(received)
+	result := "relayed"
+	if err == errClientNotFound {
+		log.Printf("Client %s not found", destId)
+		c.sendError(&relayError{Code: codeNotFound, Message: "client " + destId + " not found", Txn: msg.Txn})
+		stats.notFound.inc(typ)
+		result = codeNotFound
+	} else if err == errMailboxFull {
+		log.Printf("Client %s mailbox full", destId)
+		clients.notifyDeliveryFailed(id, destId, "mailbox-full", msg.Data)
+		stats.dropped.inc(typ, dropMailboxFull)
+		result = dropMailboxFull
+	} else if err != nil {
+		log.Printf("Failed to send message to client %s: %v", destId, err)
+		stats.dropped.inc(typ, dropSendFailed)
+		result = dropSendFailed
+	} else if stored {
+		stats.queued.inc(typ)
+		result = "queued"
+	} else {
+		stats.relayed.inc(typ)
+	}
+	if err != nil && msg.Type == kindInvite {
+		// the invite never reached the callee
+		clients.calls.abort(id, destId)
+	}
+	record(recording.Out, id, destId, result, msg.Data)
+	return true
+}
+
 func main() {
-	port := "8000"
-	hostname := "127.0.0.1"
+	flag.Parse()
+	if err := loadConfig(flag.CommandLine); err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	policy, err := parseOverflowPolicy(*overflow)
+	if err != nil {
+		log.Fatalf("Invalid -overflow: %v", err)
+	}
+	clients = newRegistry(*queueSize, policy)
+	clients.writeTimeout = *writeTimeout
+	clients.pingInterval = *pingInterval
+	clients.sessionTimeout = *sessionTimeout
+	clients.calls.timeout = *callTimeout
+	clients.calls.require = *requireCall
+
+	clients.duplicates, err = parseDuplicatePolicy(*duplicate)
+	if err != nil {
+		log.Fatalf("Invalid -duplicate: %v", err)
+	}
+	authKey, err = loadAuthKey(*authKeyFlag, *authKeyFile)
+	if err != nil {
+		log.Fatalf("Failed to load auth key: %v", err)
+	}
+	if len(authKey) == 0 {
+		log.Printf("Authentication disabled, any client can claim any id")
+	}
+
+	mb, err := newMailbox(*mailboxKind, *mailboxDir, *mailboxDepth)
+	if err != nil {
+		log.Fatalf("Invalid -mailbox: %v", err)
+	}
+	if mb != nil {
+		// a client must be able to take its whole mailbox at once
+		if *mailboxDepth > *queueSize {
+			log.Fatalf("Invalid -mailbox-depth: %d is more than the -queue-size of %d", *mailboxDepth, *queueSize)
+		}
+		clients.mailbox = mb
+		clients.mailboxTTL = *mailboxTTL
+		go clients.expireMailbox(time.Second)
+	}
+
+	b, err := newBroker(*brokerKind, *redisAddr, *redisPassword)
+	if err != nil {
+		log.Fatalf("Invalid -broker: %v", err)
+	}
+	if b != nil {
+		node := *nodeID
+		if node == "" {
+			host, _ := os.Hostname()
+			node = fmt.Sprintf("%s-%d", host, os.Getpid())
+		}
+		if err := clients.attachBroker(b, node); err != nil {
+			log.Fatalf("Failed to attach broker: %v", err)
+		}
+		log.Printf("Joined %s broker as node %s", *brokerKind, node)
+	}
+
+	if *recordFile != "" {
+		recorder, err = recording.NewWriter(*recordFile, *recordMaxSize, *recordKeep)
+		if err != nil {
+			log.Fatalf("Failed to open record file: %v", err)
+		}
+		log.Printf("Recording relayed messages to %s", *recordFile)
+	}
+
+	origins := &originChecker{allowed: splitList(*allowedOrigins)}
+	upgrader.CheckOrigin = origins.check
+	if len(origins.allowed) == 0 {
+		log.Printf("No -allowed-origins, accepting every origin")
+	}
 
 	http.HandleFunc("/", httpHandler)
+	http.HandleFunc("/send/", sendHandler)
+	http.HandleFunc("/recv/", recvHandler)
+	http.HandleFunc("/peers", peersHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler)
 	//http.HandleFunc("/ws/", wsHandler)
 
-	log.Printf("Server listening on %s:%s", hostname, port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+	server := &http.Server{
+		Addr:              *listenAddr,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	if *tlsCert != "" || *tlsKey != "" {
+		certs, err := newCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		go certs.watch(*tlsReload)
+		server.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: certs.getCertificate,
+		}
+
+		setReady(true)
+		log.Printf("Server listening on %s with TLS (queue %d, overflow %s)", *listenAddr, *queueSize, policy)
+		if err := server.ListenAndServeTLS("", ""); err != nil {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+		return
+	}
+
+	setReady(true)
+	log.Printf("Server listening on %s (queue %d, overflow %s)", *listenAddr, *queueSize, policy)
+	if err := server.ListenAndServe(); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }